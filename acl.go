@@ -0,0 +1,278 @@
+package archer
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/astaxie/beego/config"
+	"github.com/dongzerun/archer/util"
+)
+
+// proxy 端的认证和权限，用户定义在 [users] section，每行一个用户，规则是 Redis ACL 的子集
+//   on / off            启用或者禁用用户
+//   >password           添加密码，#<sha256> 添加密码的 sha256
+//   nopass              不需要密码
+//   +@category -@category  允许或者禁止一类命令，category 见 aclCategories
+//   +command -command   允许或者禁止单个命令
+//   allcommands         等同于 +@all
+//   ~pattern            允许访问的 key，glob 匹配，allkeys 等同于 ~*
+//   reset               清空之前的规则
+// 规则按顺序生效，例如
+//   reader=on >secret +@read -keys ~app:*
+// [proxy] password 等同于 Redis 的 requirepass，是 default 用户的密码
+// 没有配置任何密码时 default 用户不需要认证
+
+const DefaultUser = "default"
+
+var (
+	NoAuthError    = errors.New("NOAUTH Authentication required.")
+	WrongPassError = errors.New("WRONGPASS invalid username-password pair or user is disabled.")
+	NoPassError    = errors.New("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+	NoPermKeyError = errors.New("NOPERM No permissions to access a key")
+)
+
+// aclCategories 命令分类，和命令表中的 flags 对应
+var aclCategories = map[string]func(ci *CommandInfo) bool{
+	"all":      func(ci *CommandInfo) bool { return true },
+	"read":     func(ci *CommandInfo) bool { return ci.Has(FlagRead) },
+	"write":    func(ci *CommandInfo) bool { return ci.Has(FlagWrite) },
+	"admin":    func(ci *CommandInfo) bool { return ci.Has(FlagAdmin) },
+	"blocking": func(ci *CommandInfo) bool { return ci.Has(FlagBlocking) },
+	"pubsub":   func(ci *CommandInfo) bool { return ci.Has(FlagPubSub) },
+	"keyspace": func(ci *CommandInfo) bool { return ci.FirstKey > 0 || ci.keys != nil },
+	"connection": func(ci *CommandInfo) bool {
+		return connectionCommands[ci.Name]
+	},
+	"dangerous": func(ci *CommandInfo) bool {
+		return ci.Has(FlagAdmin) || dangerousCommands[ci.Name]
+	},
+}
+
+// 发给所有主库的命令，可能很慢或者删除所有数据
+var dangerousCommands = map[string]bool{
+	"KEYS":     true,
+	"FLUSHDB":  true,
+	"FLUSHALL": true,
+}
+
+var connectionCommands = map[string]bool{
+	"AUTH":   true,
+	"HELLO":  true,
+	"PING":   true,
+	"SELECT": true,
+	"QUIT":   true,
+	"CLIENT": true,
+}
+
+// 不需要认证就可以执行的命令，所有用户都允许
+var noAuthCommands = map[string]bool{
+	"AUTH":  true,
+	"HELLO": true,
+	"QUIT":  true,
+}
+
+type User struct {
+	Name string
+
+	enabled   bool
+	nopass    bool
+	passwords [][]byte // sha256
+	commands  map[string]bool
+	allKeys   bool
+	patterns  [][]byte
+}
+
+func NewUser(name string) *User {
+	return &User{
+		Name:     name,
+		commands: make(map[string]bool),
+	}
+}
+
+// SetRules 按顺序应用规则
+func (u *User) SetRules(rules string) error {
+	for _, r := range strings.Fields(rules) {
+		if err := u.setRule(r); err != nil {
+			return fmt.Errorf("user %s rule %s: %s", u.Name, r, err.Error())
+		}
+	}
+	return nil
+}
+
+func (u *User) setRule(r string) error {
+	switch lr := strings.ToLower(r); {
+	case lr == "on":
+		u.enabled = true
+	case lr == "off":
+		u.enabled = false
+	case lr == "nopass":
+		u.nopass = true
+		u.passwords = nil
+	case lr == "allkeys":
+		u.allKeys = true
+		u.patterns = nil
+	case lr == "allcommands":
+		u.setCategory("all", true)
+	case lr == "reset":
+		*u = *NewUser(u.Name)
+	case r[0] == '>':
+		sum := sha256.Sum256([]byte(r[1:]))
+		u.addPassword(sum[:])
+	case r[0] == '#':
+		sum, err := hex.DecodeString(r[1:])
+		if err != nil || len(sum) != sha256.Size {
+			return errors.New("wrong sha256 password")
+		}
+		u.addPassword(sum)
+	case r[0] == '~':
+		if r == "~*" {
+			u.allKeys = true
+			u.patterns = nil
+		} else if !u.allKeys {
+			u.patterns = append(u.patterns, []byte(r[1:]))
+		}
+	case r[0] == '+' || r[0] == '-':
+		allow := r[0] == '+'
+		if strings.HasPrefix(r[1:], "@") {
+			return u.setCategory(strings.ToLower(r[2:]), allow)
+		}
+		name := strings.ToUpper(r[1:])
+		if _, ok := commandTable[name]; !ok {
+			return errors.New("unknown command")
+		}
+		u.commands[name] = allow
+	default:
+		return errors.New("syntax error")
+	}
+	return nil
+}
+
+func (u *User) addPassword(sum []byte) {
+	u.nopass = false
+	u.passwords = append(u.passwords, sum)
+}
+
+func (u *User) setCategory(cat string, allow bool) error {
+	match, ok := aclCategories[cat]
+	if !ok {
+		return errors.New("unknown command category")
+	}
+	for name, ci := range commandTable {
+		if match(ci) {
+			u.commands[name] = allow
+		}
+	}
+	return nil
+}
+
+// checkPassword 用 sha256 做常量时间比较
+func (u *User) checkPassword(pass []byte) bool {
+	if !u.enabled {
+		return false
+	}
+	if u.nopass {
+		return true
+	}
+	sum := sha256.Sum256(pass)
+	ok := false
+	for _, p := range u.passwords {
+		if subtle.ConstantTimeCompare(p, sum[:]) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// CheckCommand 检查命令和 key 的权限，command 是命令表中的大写名字
+func (u *User) CheckCommand(command string, req *ArrayResp) error {
+	if !u.commands[command] && !noAuthCommands[command] {
+		return fmt.Errorf("NOPERM User %s has no permissions to run the '%s' command", u.Name, strings.ToLower(command))
+	}
+	if u.allKeys {
+		return nil
+	}
+
+	ci := commandTable[command]
+	idx, err := ci.KeyIndexes(req)
+	if err != nil {
+		return err
+	}
+	for _, i := range idx {
+		if !u.matchKey(req.Arg(i)) {
+			return NoPermKeyError
+		}
+	}
+	return nil
+}
+
+func (u *User) matchKey(key []byte) bool {
+	for _, p := range u.patterns {
+		if util.Match(p, key) {
+			return true
+		}
+	}
+	return false
+}
+
+type ACL struct {
+	users map[string]*User
+}
+
+// NewACL password 是 default 用户的密码，users 是 [users] section
+func NewACL(password string, users map[string]string) (*ACL, error) {
+	def := NewUser(DefaultUser)
+	if err := def.SetRules("on allkeys allcommands"); err != nil {
+		return nil, err
+	}
+	// 密码可能包含空格，不经过 SetRules 拆分
+	if password != "" {
+		sum := sha256.Sum256([]byte(password))
+		def.addPassword(sum[:])
+	} else if err := def.SetRules("nopass"); err != nil {
+		return nil, err
+	}
+
+	a := &ACL{
+		users: map[string]*User{DefaultUser: def},
+	}
+	for name, rules := range users {
+		u := NewUser(name)
+		if err := u.SetRules(rules); err != nil {
+			return nil, err
+		}
+		a.users[name] = u
+	}
+	return a, nil
+}
+
+// Authenticate 校验用户名和密码
+func (a *ACL) Authenticate(name, pass []byte) (*User, error) {
+	u, ok := a.users[string(name)]
+	if !ok || !u.checkPassword(pass) {
+		return nil, WrongPassError
+	}
+	return u, nil
+}
+
+// NoAuthUser default 用户是 nopass 时新连接自动以 default 用户认证，否则返回 nil
+func (a *ACL) NoAuthUser() *User {
+	u := a.users[DefaultUser]
+	if u.enabled && u.nopass {
+		return u
+	}
+	return nil
+}
+
+// loadACL 读取 [proxy] password 和 [users] section
+func loadACL(c config.Configer) (*ACL, error) {
+	users, err := c.GetSection("users")
+	if err != nil {
+		// 没有 [users] section
+		users = nil
+	}
+	return NewACL(c.DefaultString("proxy::password", ""), users)
+}
@@ -0,0 +1,90 @@
+package archer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func Test_ACL(t *testing.T) {
+	sum := sha256.Sum256([]byte("hashed"))
+	a, err := NewACL("secret", map[string]string{
+		"reader":   "on >pw +@read -keys ~app:* ~{user}:*",
+		"writer":   "on #" + hex.EncodeToString(sum[:]) + " allcommands -@admin allkeys",
+		"disabled": "off >pw allcommands allkeys",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.NoAuthUser() != nil {
+		t.Fatal("default user requires password")
+	}
+
+	auth := func(name, pass string) *User {
+		u, err := a.Authenticate([]byte(name), []byte(pass))
+		if err != nil {
+			return nil
+		}
+		return u
+	}
+	if auth("default", "secret") == nil || auth("default", "wrong") != nil {
+		t.Fatal("default password")
+	}
+	if auth("writer", "hashed") == nil || auth("disabled", "pw") != nil || auth("nobody", "pw") != nil {
+		t.Fatal("user password")
+	}
+
+	reader := auth("reader", "pw")
+	cases := map[string]string{
+		"GET app:1":        "",
+		"MGET app:1 app:2": "",
+		"MGET app:1 other": NoPermKeyError.Error(),
+		"GET {user}:1":     "",
+		"SET app:1 v":      "NOPERM User reader has no permissions to run the 'set' command",
+		"KEYS *":           "NOPERM User reader has no permissions to run the 'keys' command",
+		"AUTH pw":          "",
+	}
+	for line, want := range cases {
+		req := newTestCommand(line)
+		err := reader.CheckCommand(commandOf(req).Name, req)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != want {
+			t.Fatalf("%s got %q want %q", line, got, want)
+		}
+	}
+
+	writer := auth("writer", "hashed")
+	if err := writer.CheckCommand("SET", newTestCommand("SET any v")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.CheckCommand("CONFIG", newTestCommand("CONFIG GET *")); err == nil {
+		t.Fatal("writer has no admin permission")
+	}
+
+	for _, rules := range []string{"+nosuchcommand", "+@nosuchcategory", "#abc", "bogus"} {
+		if _, err := NewACL("", map[string]string{"u": rules}); err == nil {
+			t.Fatalf("%s expect error", rules)
+		}
+	}
+	if a, _ := NewACL("", nil); a.NoAuthUser() == nil {
+		t.Fatal("no password configured, default user is nopass")
+	}
+
+	// 包含空格的密码整体作为密码，不会被当成规则
+	a, err = NewACL("two words ~x", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Authenticate([]byte(DefaultUser), []byte("two words ~x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Authenticate([]byte(DefaultUser), []byte("two")); err != WrongPassError {
+		t.Fatalf("partial password got %v", err)
+	}
+	if u := a.users[DefaultUser]; !u.allKeys || len(u.patterns) != 0 {
+		t.Fatal("password words parsed as rules")
+	}
+}
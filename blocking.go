@@ -0,0 +1,175 @@
+package archer
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dongzerun/archer/hack"
+	log "github.com/ngaut/logging"
+)
+
+var errBlockCanceled = errors.New("blocking command canceled")
+
+// 阻塞命令 timeout 参数的位置，负数从最后一个参数开始计算
+var blockingTimeout = map[string]int{
+	"BLPOP":      -1,
+	"BRPOP":      -1,
+	"BRPOPLPUSH": -1,
+	"BLMOVE":     -1,
+	"BZPOPMIN":   -1,
+	"BZPOPMAX":   -1,
+	"BLMPOP":     1,
+	"BZMPOP":     1,
+}
+
+// xreadBlock 返回 XREAD XREADGROUP 的 BLOCK 参数的位置，没有 BLOCK 时返回 false
+func xreadBlock(req *ArrayResp) (int, bool) {
+	for i := 1; i+1 < len(req.Args); i++ {
+		opt := req.Arg(i)
+		if strings.EqualFold(hack.String(opt), "STREAMS") {
+			break
+		}
+		if strings.EqualFold(hack.String(opt), "BLOCK") {
+			return i + 1, true
+		}
+	}
+	return 0, false
+}
+
+// blockDeadline 按命令的 timeout 参数计算读超时，多等待 readTimeout 让后端先回复超时
+// timeout 为 0 表示一直阻塞，返回零值不设置超时
+func (s *Session) blockDeadline(req *ArrayResp) time.Time {
+	ci := commandOf(req)
+	if ci == nil {
+		return time.Time{}
+	}
+	pos, ok := blockingTimeout[ci.Name]
+	unit := float64(time.Second)
+	// XREAD XREADGROUP 的 BLOCK 单位是毫秒
+	if ci.Name == "XREAD" || ci.Name == "XREADGROUP" {
+		pos, ok = xreadBlock(req)
+		unit = float64(time.Millisecond)
+	}
+	if !ok {
+		return time.Time{}
+	}
+	if pos < 0 {
+		pos += len(req.Args)
+	}
+	timeout, err := strconv.ParseFloat(hack.String(req.Arg(pos)), 64)
+	// 参数错误时由后端回复错误
+	if err != nil || timeout <= 0 || timeout > math.MaxInt32 {
+		return time.Time{}
+	}
+	grace := s.p.pc.readTimeout
+	if grace <= 0 {
+		grace = time.Second
+	}
+	return time.Now().Add(time.Duration(timeout*unit) + grace)
+}
+
+// Blocking 在阻塞命令专用的连接上执行，阻塞期间不占用普通连接池
+// 跨 slot 已经在 Dispatch 中拒绝，客户端断开时关闭后端连接取消阻塞
+// 阻塞期间一直占用 Session 的并发配额：回复按 seq 顺序写回，提前归还也不能让后面的命令先回复，
+// 占用配额还限制了一个客户端同时占用的阻塞连接数，waitRoutes 也会等待阻塞命令回复
+// 后端已经弹出元素、回复还没有写给客户端时客户端断开，这个元素会丢失，
+// proxy 不把元素写回去，因为写回的位置和时机都不能保证和原来一致
+func (s *Session) Blocking(req *ArrayResp, seq int64) {
+	defer func() {
+		s.conCurrency <- 1
+	}()
+	atomic.AddInt32(&s.blocked, 1)
+	defer atomic.AddInt32(&s.blocked, -1)
+
+	id := s.p.cluster.topo.GetNodeID(RouteKey(req), false)
+	resp, err := s.execBlocking(id, req, false)
+	if er, ok := resp.(*ErrorResp); ok && err == nil {
+		//-MOVED 15495 10.10.200.11:6481 重定向只重试一次
+		e := strings.Fields(hack.String(er.Args[0]))
+		if len(e) == 3 && (e[0] == "MOVED" || e[0] == "ASK") {
+			if e[0] == "MOVED" {
+				s.p.cluster.topo.Reload()
+			}
+			Release(resp)
+			resp, err = s.execBlocking(e[2], req, e[0] == "ASK")
+		}
+	}
+	if err == errBlockCanceled {
+		return
+	}
+	if err != nil {
+		s.resps <- WrappedErrorResp([]byte("proxy internal error "+err.Error()), seq)
+		return
+	}
+	s.resps <- WrappedResp(s.resp3Reply(req, resp), seq)
+}
+
+// execBlocking 设置读超时之后执行，Session 关闭时把读超时提前到当前时间中断读取
+// 中断或者出错的连接直接关闭，Redis 会取消连接上的阻塞命令，不会再弹出元素
+func (s *Session) execBlocking(id string, req *ArrayResp, asking bool) (Resp, error) {
+	conn, err := s.p.cluster.GetBlockConn(id)
+	if err != nil {
+		return nil, err
+	}
+	rc, ok := conn.(*RedisConn)
+	if !ok {
+		s.p.cluster.RemoveBlockConn(conn)
+		return nil, errors.New("proxy error: GetBlockConn failed")
+	}
+	rc.c.SetReadDeadline(s.blockDeadline(req))
+
+	var (
+		mu       sync.Mutex
+		finished bool
+		canceled bool
+	)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-done:
+		case <-s.quitChan:
+			mu.Lock()
+			if !finished {
+				canceled = true
+				rc.c.SetReadDeadline(time.Now())
+			}
+			mu.Unlock()
+		}
+	}()
+
+	var resp Resp
+	if asking {
+		var resps []Resp
+		resps, err = s.ExecPipeline(rc, []*ArrayResp{NewCommand(ASKING), req})
+		if err == nil {
+			resp = resps[1]
+		}
+	} else {
+		resp, err = s.ExecOnce(rc, req)
+	}
+
+	mu.Lock()
+	finished = true
+	mu.Unlock()
+	if canceled {
+		if err == nil {
+			Release(resp)
+		}
+		s.p.cluster.RemoveBlockConn(rc)
+		return nil, errBlockCanceled
+	}
+	if err != nil {
+		log.Warning("Session blocking command failed ", id, err)
+		s.p.cluster.RemoveBlockConn(rc)
+		return nil, err
+	}
+	rc.c.SetReadDeadline(time.Time{})
+	s.p.cluster.PutBlockConn(rc)
+	return resp, nil
+}
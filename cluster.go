@@ -2,24 +2,36 @@ package archer
 
 import (
 	"fmt"
+	"net"
+	"strconv"
+	"sync"
 
 	log "github.com/ngaut/logging"
 )
 
 type Cluster struct {
-	pc    *ProxyConfig
+	pc *ProxyConfig
+
+	mu    sync.RWMutex         // 保护 pools blockPools txPools 和 opts
 	pools map[string]*ConnPool //key: node id host:port
 	opts  map[string]*Options
 
+	// 阻塞命令使用的连接池，按需创建，大小是 blockPoolSize
+	blockPools map[string]*ConnPool
+	// WATCH MULTI 固定的连接使用的连接池，按需创建，大小是 txPoolSize
+	txPools map[string]*ConnPool
+
 	topo *Topology
 }
 
 func NewCluster(pc *ProxyConfig) *Cluster {
 	c := &Cluster{
-		pc:    pc,
-		pools: make(map[string]*ConnPool, 1),
-		opts:  make(map[string]*Options, 1),
-		topo:  NewTopo(pc),
+		pc:         pc,
+		pools:      make(map[string]*ConnPool, 1),
+		opts:       make(map[string]*Options, 1),
+		blockPools: make(map[string]*ConnPool, 1),
+		txPools:    make(map[string]*ConnPool, 1),
+		topo:       NewTopo(pc),
 	}
 	c.initializePool()
 	return c
@@ -29,20 +41,42 @@ func (c *Cluster) GetConn(key []byte, slave bool) (Conn, error) {
 	id := c.topo.GetNodeID(key, slave)
 	log.Infof("GetConn %s for key: %s", id, string(key))
 
+	pool, err := c.getPool(id)
+	if err != nil {
+		return nil, err
+	}
+	return pool.Get()
+}
+
+func (c *Cluster) getPool(id string) (*ConnPool, error) {
+	c.mu.RLock()
 	pool, ok := c.pools[id]
+	c.mu.RUnlock()
+	if ok {
+		return pool, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pool, ok = c.pools[id]
 	if !ok {
 		// opt一定存在要做个判断
 		opt := c.opts[id]
 		if opt == nil {
 			n := c.topo.GetNode(id)
 			if n == nil {
-				return nil, fmt.Errorf("Cluster GetConn ID %s not exists ", id)
+				// MOVED/ASK 的目标可能还不在拓扑中，id 就是 host:port
+				host, port, err := splitAddr(id)
+				if err != nil {
+					return nil, fmt.Errorf("Cluster GetConn ID %s not exists ", id)
+				}
+				n = &Node{id: id, host: host, port: port}
 			}
 
-			opt := &Options{
+			opt = &Options{
 				Network:      "tcp",
-				Addr:         fmt.Sprintf("%s:%d", n.host, n.port),
-				Dialer:       RedisConnDialer(n.host, n.port, n.id, c.pc),
+				Addr:         net.JoinHostPort(n.host, strconv.Itoa(n.port)),
+				Dialer:       RedisConnDialer(n.host, n.port, n.id, n.role == "slave", c.pc),
 				DialTimeout:  c.pc.dialTimeout,
 				ReadTimeout:  c.pc.readTimeout,
 				WriteTimeout: c.pc.writeTimeout,
@@ -54,12 +88,22 @@ func (c *Cluster) GetConn(key []byte, slave bool) (Conn, error) {
 		pool = NewConnPool(opt)
 		c.pools[id] = pool
 	}
+	return pool, nil
+}
 
+// GetConnByID 获取指定节点的连接，id 是 host:port
+func (c *Cluster) GetConnByID(id string) (Conn, error) {
+	pool, err := c.getPool(id)
+	if err != nil {
+		return nil, err
+	}
 	return pool.Get()
 }
 
 func (c *Cluster) PutConn(cn Conn) {
+	c.mu.RLock()
 	pool, ok := c.pools[cn.ID()]
+	c.mu.RUnlock()
 	if !ok {
 		log.Warningf("Cluster PutConn %s, belong no pool", cn.ID())
 		return
@@ -67,11 +111,105 @@ func (c *Cluster) PutConn(cn Conn) {
 	pool.Put(cn)
 }
 
+// RemoveConn 关闭已经无法使用的连接，连接池会补充新的连接
+func (c *Cluster) RemoveConn(cn Conn) {
+	c.mu.RLock()
+	pool, ok := c.pools[cn.ID()]
+	c.mu.RUnlock()
+	if !ok {
+		log.Warningf("Cluster RemoveConn %s, belong no pool", cn.ID())
+		cn.Close()
+		return
+	}
+	pool.Remove(cn)
+}
+
+// getSidePool 返回 pools 中 id 对应的连接池，不存在时按普通连接池的 Options 创建，大小是 size
+// 阻塞命令和事务长时间占用连接，使用单独的连接池，不影响普通请求
+func (c *Cluster) getSidePool(pools map[string]*ConnPool, id string, size int) (*ConnPool, error) {
+	c.mu.RLock()
+	pool, ok := pools[id]
+	c.mu.RUnlock()
+	if ok {
+		return pool, nil
+	}
+
+	// 复用普通连接池的 Options
+	if _, err := c.getPool(id); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pool, ok = pools[id]
+	if !ok {
+		opt := *c.opts[id]
+		opt.PoolSize = size
+		pool = NewConnPool(&opt)
+		pools[id] = pool
+	}
+	return pool, nil
+}
+
+// putSideConn clean 为 false 时关闭连接
+func (c *Cluster) putSideConn(pools map[string]*ConnPool, cn Conn, clean bool) {
+	c.mu.RLock()
+	pool, ok := pools[cn.ID()]
+	c.mu.RUnlock()
+	if !ok {
+		log.Warningf("Cluster put side conn %s, belong no pool", cn.ID())
+		cn.Close()
+		return
+	}
+	if clean {
+		pool.Put(cn)
+	} else {
+		pool.Remove(cn)
+	}
+}
+
+// GetBlockConn 获取阻塞命令使用的连接，用完之后调用 PutBlockConn 或者 RemoveBlockConn
+func (c *Cluster) GetBlockConn(id string) (Conn, error) {
+	pool, err := c.getSidePool(c.blockPools, id, c.pc.blockPoolSize)
+	if err != nil {
+		return nil, err
+	}
+	return pool.Get()
+}
+
+func (c *Cluster) PutBlockConn(cn Conn) {
+	c.putSideConn(c.blockPools, cn, true)
+}
+
+// RemoveBlockConn 关闭连接，后端会取消连接上的阻塞命令
+func (c *Cluster) RemoveBlockConn(cn Conn) {
+	c.putSideConn(c.blockPools, cn, false)
+}
+
+// GetTxConn 获取事务固定的连接，连接池用完时等待 PoolTimeout 之后返回错误
+func (c *Cluster) GetTxConn(key []byte) (Conn, error) {
+	pool, err := c.getSidePool(c.txPools, c.topo.GetNodeID(key, false), c.pc.txPoolSize)
+	if err != nil {
+		return nil, err
+	}
+	return pool.Get()
+}
+
+func (c *Cluster) PutTxConn(cn Conn) {
+	c.putSideConn(c.txPools, cn, true)
+}
+
+func (c *Cluster) RemoveTxConn(cn Conn) {
+	c.putSideConn(c.txPools, cn, false)
+}
+
 // initialize conn Pool before Serve
 func (c *Cluster) initializePool() {
 	log.Info("Cluster start initializePool ", len(c.pc.nodes))
 	nodes := make(map[string]*Node, len(c.pc.nodes))
 	for _, s := range c.topo.slots {
+		if s == nil {
+			continue
+		}
 		if s.master != nil {
 			nodes[s.master.id] = s.master
 		}
@@ -90,8 +228,8 @@ func (c *Cluster) initializePool() {
 
 		opt := &Options{
 			Network:      "tcp",
-			Addr:         fmt.Sprintf("%s:%d", n.host, n.port),
-			Dialer:       RedisConnDialer(n.host, n.port, n.id, c.pc),
+			Addr:         net.JoinHostPort(n.host, strconv.Itoa(n.port)),
+			Dialer:       RedisConnDialer(n.host, n.port, n.id, n.role == "slave", c.pc),
 			DialTimeout:  c.pc.dialTimeout,
 			ReadTimeout:  c.pc.readTimeout,
 			WriteTimeout: c.pc.writeTimeout,
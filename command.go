@@ -0,0 +1,200 @@
+package archer
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/dongzerun/archer/hack"
+	"github.com/dongzerun/archer/util"
+)
+
+var CrossSlotError = errors.New("CROSSSLOT Keys in request don't hash to the same slot")
+
+// CommandFlag 命令属性，和 Redis COMMAND INFO 中的 flags 对应
+type CommandFlag uint32
+
+const (
+	FlagRead     CommandFlag = 1 << iota // 只读，slaveok 时可以发到从库
+	FlagWrite                            // 修改数据
+	FlagAdmin                            // 管理命令
+	FlagBlocking                         // 可能阻塞连接
+	FlagMultiKey                         // 多个 key，跨 slot 需要拆分
+	FlagPubSub                           // 发布订阅
+)
+
+// CommandInfo 命令描述，key 的位置和 Redis COMMAND INFO 一致
+//
+//	Arity 为正数表示参数个数固定，负数表示最少参数个数，包含命令名
+//	MaxArity 参数个数上限，包含命令名，0 表示不限制
+//	FirstKey 第一个 key 的下标，0 表示没有 key
+//	LastKey 最后一个 key 的下标，负数从后往前数，-1 是最后一个参数
+//	Step 相邻两个 key 的间隔，MSET 为 2
+//
+// key 位置取决于参数的命令 (EVAL numkeys, XREAD STREAMS) 由 keys 计算
+type CommandInfo struct {
+	Name     string
+	Arity    int
+	MaxArity int
+	Flags    CommandFlag
+	FirstKey int
+	LastKey  int
+	Step     int
+
+	keys func(req *ArrayResp) ([]int, error)
+}
+
+func (ci *CommandInfo) Has(f CommandFlag) bool {
+	return ci.Flags&f != 0
+}
+
+func (ci *CommandInfo) IsRead() bool {
+	return ci.Has(FlagRead) && !ci.Has(FlagWrite)
+}
+
+func (ci *CommandInfo) IsWrite() bool {
+	return ci.Has(FlagWrite)
+}
+
+// limit 设置参数个数上限
+func (ci *CommandInfo) limit(max int) *CommandInfo {
+	ci.MaxArity = max
+	return ci
+}
+
+// CheckArity 检查参数个数，n 包含命令名
+func (ci *CommandInfo) CheckArity(n int) bool {
+	if ci.Arity >= 0 {
+		return n == ci.Arity
+	}
+	if ci.MaxArity > 0 && n > ci.MaxArity {
+		return false
+	}
+	return n >= -ci.Arity
+}
+
+// KeyIndexes 返回请求中所有 key 的下标
+func (ci *CommandInfo) KeyIndexes(req *ArrayResp) ([]int, error) {
+	if ci.keys != nil {
+		return ci.keys(req)
+	}
+	if ci.FirstKey <= 0 {
+		return nil, nil
+	}
+
+	n := len(req.Args)
+	last := ci.LastKey
+	if last < 0 {
+		last = n + last
+	}
+	if last >= n {
+		last = n - 1
+	}
+	step := ci.Step
+	if step <= 0 {
+		step = 1
+	}
+
+	idx := make([]int, 0, (last-ci.FirstKey)/step+1)
+	for i := ci.FirstKey; i <= last; i += step {
+		idx = append(idx, i)
+	}
+	return idx, nil
+}
+
+// LookupCommand 查找命令描述，name 大小写不敏感，不存在返回 nil
+// 不修改 name，命令名不超过 32 字节时不分配内存
+func LookupCommand(name []byte) *CommandInfo {
+	if ci, ok := commandTable[hack.String(name)]; ok {
+		return ci
+	}
+	var buf [32]byte
+	if len(name) > len(buf) {
+		return nil
+	}
+	for i, b := range name {
+		buf[i] = upper(b)
+	}
+	return commandTable[string(buf[:len(name)])]
+}
+
+func upper(b byte) byte {
+	if 'a' <= b && b <= 'z' {
+		return b - 'a' + 'A'
+	}
+	return b
+}
+
+// commandOf 返回请求对应的命令描述
+func commandOf(req *ArrayResp) *CommandInfo {
+	return LookupCommand(req.Arg(0))
+}
+
+// RouteKey 返回用来计算 slot 的 key，也就是第一个 key
+// 没有 key 的命令返回 nil，发到 slot 0 所在的节点
+// 不在命令表中的请求按照 req.Arg(1) 路由
+func RouteKey(req *ArrayResp) []byte {
+	ci := commandOf(req)
+	if ci == nil {
+		return req.Arg(1)
+	}
+	idx, err := ci.KeyIndexes(req)
+	if err != nil || len(idx) == 0 {
+		return nil
+	}
+	return req.Arg(idx[0])
+}
+
+// sameSlot 判断请求中所有 key 是否在同一个 slot，没有 key 时返回 true
+func sameSlot(ci *CommandInfo, req *ArrayResp) bool {
+	idx, err := ci.KeyIndexes(req)
+	if err != nil || len(idx) == 0 {
+		return true
+	}
+	slot := util.Crc16sum(req.Arg(idx[0])) % 16384
+	for _, i := range idx[1:] {
+		if util.Crc16sum(req.Arg(i))%16384 != slot {
+			return false
+		}
+	}
+	return true
+}
+
+// keysNumKeys 处理 numkeys 之后跟着 key 的命令
+// EVAL script numkeys key...     keysNumKeys(0, 2)
+// ZUNIONSTORE dest numkeys key... keysNumKeys(1, 2)
+func keysNumKeys(dest, numIdx int) func(req *ArrayResp) ([]int, error) {
+	return func(req *ArrayResp) ([]int, error) {
+		numkeys, err := strconv.Atoi(hack.String(req.Arg(numIdx)))
+		if err != nil || numkeys < 0 || numIdx+numkeys >= len(req.Args) {
+			return nil, WrongCommandKey
+		}
+		idx := make([]int, 0, numkeys+1)
+		if dest > 0 {
+			idx = append(idx, dest)
+		}
+		for i := 0; i < numkeys; i++ {
+			idx = append(idx, numIdx+1+i)
+		}
+		return idx, nil
+	}
+}
+
+// keysStreams 处理 XREAD/XREADGROUP ... STREAMS key... id...
+func keysStreams(req *ArrayResp) ([]int, error) {
+	for i := 1; i < len(req.Args); i++ {
+		if !strings.EqualFold(hack.String(req.Arg(i)), "STREAMS") {
+			continue
+		}
+		rest := len(req.Args) - i - 1
+		if rest == 0 || rest%2 != 0 {
+			return nil, WrongCommandKey
+		}
+		idx := make([]int, 0, rest/2)
+		for j := 0; j < rest/2; j++ {
+			idx = append(idx, i+1+j)
+		}
+		return idx, nil
+	}
+	return nil, WrongCommandKey
+}
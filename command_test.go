@@ -0,0 +1,94 @@
+package archer
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestCommand(line string) *ArrayResp {
+	var args [][]byte
+	for _, f := range strings.Fields(line) {
+		args = append(args, []byte(f))
+	}
+	return NewCommand(args...)
+}
+
+func Test_CommandKeyIndexes(t *testing.T) {
+	cases := []struct {
+		line string
+		keys []int
+	}{
+		{"GET foo", []int{1}},
+		{"PING", nil},
+		{"MSET a 1 b 2 c 3", []int{1, 3, 5}},
+		{"BLPOP a b 0", []int{1, 2}},
+		{"OBJECT ENCODING foo", []int{2}},
+		{"BITOP AND dest a b", []int{2, 3, 4}},
+		{"EVAL script 2 a b arg", []int{3, 4}},
+		{"EVAL script 0", []int{}},
+		{"ZUNIONSTORE dest 2 a b WEIGHTS 1 2", []int{1, 3, 4}},
+		{"XREAD COUNT 2 STREAMS s1 s2 0 0", []int{4, 5}},
+		{"xread streams s1 0", []int{2}},
+	}
+	for _, c := range cases {
+		req := newTestCommand(c.line)
+		ci := commandOf(req)
+		if ci == nil {
+			t.Fatalf("%s not found", c.line)
+		}
+		idx, err := ci.KeyIndexes(req)
+		if err != nil {
+			t.Fatalf("%s %s", c.line, err)
+		}
+		if len(idx) != len(c.keys) || len(idx) > 0 && !reflect.DeepEqual(idx, c.keys) {
+			t.Fatalf("%s got %v want %v", c.line, idx, c.keys)
+		}
+	}
+
+	for _, line := range []string{"EVAL script 3 a b", "EVAL script x", "XREAD STREAMS s1", "XREAD COUNT 1"} {
+		req := newTestCommand(line)
+		if _, err := commandOf(req).KeyIndexes(req); err != WrongCommandKey {
+			t.Fatalf("%s expect WrongCommandKey got %v", line, err)
+		}
+	}
+
+	if k := RouteKey(newTestCommand("OBJECT ENCODING foo")); string(k) != "foo" {
+		t.Fatalf("RouteKey got %s", k)
+	}
+	if k := RouteKey(newTestCommand("TIME")); k != nil {
+		t.Fatalf("RouteKey got %s", k)
+	}
+}
+
+func Test_StrFilterArity(t *testing.T) {
+	f := &StrFilter{}
+	cases := map[string]error{
+		"get foo":                    nil,
+		"GET":                        WrongArgumentCount,
+		"GET a b":                    WrongArgumentCount,
+		"SET a b EX 10 NX":           nil,
+		"MGET a b c":                 nil,
+		"EVAL s 1":                   WrongCommandKey,
+		"NOSUCHCOMMAND a":            BadCommandError,
+		"KEYS *":                     CommandForbidden,
+		"SET a b EX 10 NX GET":       WrongArgumentCount,
+		"ZRANGE z 0 -1 WITHSCORES x": WrongArgumentCount,
+		"ECHO hi":                    BadCommandError,
+		"XREAD STREAMS s1 s2 0":      WrongCommandKey,
+	}
+	for line, want := range cases {
+		if _, err := f.Inspect(newTestCommand(line)); err != want {
+			t.Fatalf("%s got %v want %v", line, err, want)
+		}
+	}
+
+	// 超过上限的多 key 命令
+	mget := "MGET" + strings.Repeat(" k", 2000)
+	if _, err := f.Inspect(newTestCommand(mget)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Inspect(newTestCommand(mget + " k")); err != WrongArgumentCount {
+		t.Fatalf("MGET with 2001 keys got %v", err)
+	}
+}
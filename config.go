@@ -13,6 +13,11 @@ import (
 	log "github.com/ngaut/logging"
 )
 
+const (
+	MSetError      = "error"      // 回复错误并列出没有写入的 key
+	MSetBestEffort = "besteffort" // 记录日志，回复 OK
+)
+
 type ProxyConfig struct {
 	//proxy
 	name        string
@@ -23,12 +28,53 @@ type ProxyConfig struct {
 	conCurrency int
 	pipeLength  int
 
+	// 客户端协议限制
+	maxBulkLen     int
+	maxMultiBulk   int
+	maxInlineLen   int
+	maxRequestSize int
+
+	// 超过这个大小的 bulk 直接在客户端和后端之间拷贝，0 表示关闭
+	streamThreshold int
+
+	// 命令过滤器 str 或者 trie
+	filter string
+
+	// MSET 部分节点失败时的处理，见 MSetError
+	msetPolicy string
+
+	// 跨 slot 集合和有序集合运算读取的成员总数上限，0 表示不限制
+	maxSetMembers int
+
+	// proxy 缓存的 Lua 脚本个数上限，节点回复 NOSCRIPT 时用来重新加载
+	maxScripts int
+
+	// [commands] 中的命令策略
+	commands map[string]*CommandPolicy
+
+	// [proxy] password 和 [users] 中的用户
+	acl *ACL
+
+	// 客户端回复合并发送，缓冲超过 flushBytes 或者等待超过 flushDelay 时 Flush
+	flushBytes int
+	flushDelay time.Duration
+
 	//redis
 	nodes      []string
 	kickOff    []string //TODO: handle kickOff nodes
 	poolSize   int
 	reloadSlot time.Duration
 
+	// 阻塞命令单独使用的连接池大小，阻塞期间一直占用连接
+	blockPoolSize int
+	// WATCH MULTI 固定连接的连接池大小，用完之后新的事务回复错误
+	txPoolSize int
+
+	// 后端认证，新连接上发送 AUTH [user] password 和 CLIENT SETNAME
+	redisUser     string
+	redisPassword string
+	clientName    string
+
 	//common
 	idleTimeout  time.Duration
 	readTimeout  time.Duration
@@ -59,11 +105,39 @@ func NewProxyConfig(file string) *ProxyConfig {
 	pc.maxConn = c.DefaultInt("proxy::maxconn", 4000)
 	pc.conCurrency = c.DefaultInt("proxy::concurrency", 5)
 	pc.pipeLength = c.DefaultInt("proxy::pipelength", 4096)
+	pc.maxBulkLen = c.DefaultInt("proxy::maxbulklen", 512*1024*1024)
+	pc.maxMultiBulk = c.DefaultInt("proxy::maxmultibulk", 1024*1024)
+	pc.maxInlineLen = c.DefaultInt("proxy::maxinlinelen", 64*1024)
+	pc.maxRequestSize = c.DefaultInt("proxy::maxrequestsize", 1024*1024*1024)
+	pc.streamThreshold = c.DefaultInt("proxy::streamthreshold", 0)
+	pc.filter = c.DefaultString("proxy::filter", "str")
+	pc.msetPolicy = c.DefaultString("proxy::msetpolicy", MSetError)
+	pc.maxSetMembers = c.DefaultInt("proxy::maxsetmembers", 100000)
+	pc.maxScripts = c.DefaultInt("proxy::maxscripts", 10000)
+	pc.flushBytes = c.DefaultInt("proxy::flushbytes", 64*1024)
+	pc.flushDelay = time.Duration(c.DefaultInt("proxy::flushdelay", 1000)) * time.Microsecond
+
+	// commands
+	pc.commands, err = loadCommandPolicies(c)
+	if err != nil {
+		log.Fatal("load command policies failed ", err)
+	}
+
+	// users
+	pc.acl, err = loadACL(c)
+	if err != nil {
+		log.Fatal("load users failed ", err)
+	}
 
 	// redis
 	pc.poolSize = c.DefaultInt("redis::poolsize", 10)
+	pc.blockPoolSize = c.DefaultInt("redis::blockpoolsize", 64)
+	pc.txPoolSize = c.DefaultInt("redis::txpoolsize", 16)
 	pc.nodes = strings.Fields(c.DefaultString("redis::nodes", ""))
 	pc.reloadSlot = time.Duration(c.DefaultInt("redis::reloadslot", 600)) * time.Second
+	pc.redisUser = c.DefaultString("redis::user", "")
+	pc.redisPassword = c.DefaultString("redis::password", "")
+	pc.clientName = c.DefaultString("redis::clientname", "")
 
 	//common
 	pc.idleTimeout = time.Duration(c.DefaultInt("common::idletimeout", 30)) * time.Second
@@ -103,6 +177,22 @@ func (pc *ProxyConfig) apply() {
 		log.Fatal("ProxyConfig port  must not 0")
 	}
 
+	if pc.filter != "str" && pc.filter != "trie" {
+		log.Fatalf("ProxyConfig filter %s must be str or trie", pc.filter)
+	}
+
+	if pc.redisUser != "" && pc.redisPassword == "" {
+		log.Fatal("ProxyConfig redis user needs password")
+	}
+
+	if pc.clientName != "" && !validClientName([]byte(pc.clientName)) {
+		log.Fatalf("ProxyConfig redis clientname %s contains spaces or special characters", pc.clientName)
+	}
+
+	if pc.msetPolicy != MSetError && pc.msetPolicy != MSetBestEffort {
+		log.Fatalf("ProxyConfig msetpolicy %s must be %s or %s", pc.msetPolicy, MSetError, MSetBestEffort)
+	}
+
 	if pc.cpu > runtime.NumCPU() {
 		log.Warningf("ProxyConfig cpu  %d exceed %d, adjust to %d ", pc.cpu, runtime.NumCPU(), runtime.NumCPU())
 		pc.cpu = runtime.NumCPU()
@@ -120,6 +210,16 @@ func (pc *ProxyConfig) apply() {
 		pc.poolSize = 10
 	}
 
+	if pc.blockPoolSize <= 0 {
+		log.Warningf("ProxyConfig blockPoolSize %d , adjust to 64", pc.blockPoolSize)
+		pc.blockPoolSize = 64
+	}
+
+	if pc.txPoolSize <= 0 {
+		log.Warningf("ProxyConfig txPoolSize %d , adjust to 16", pc.txPoolSize)
+		pc.txPoolSize = 16
+	}
+
 	if pc.cpuFile != "" {
 		f, err := os.Create(pc.cpuFile)
 		if err != nil {
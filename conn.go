@@ -32,44 +32,109 @@ type RedisConn struct {
 	closed bool
 }
 
-func NewRedisConn(host string, port int) (*RedisConn, error) {
-	conn := &RedisConn{}
-	c, err := net.Dial("tcp4", fmt.Sprintf("%s:%d", host, port))
+// NewRedisConn 建立后端连接并完成握手，拓扑发现和订阅连接通过它连接后端
+func NewRedisConn(host string, port int, pc *ProxyConfig) (*RedisConn, error) {
+	return dialRedisConn(host, port, pc, false)
+}
+
+// dialRedisConn readonly 为 true 时握手中发送 READONLY，只用于从库连接
+func dialRedisConn(host string, port int, pc *ProxyConfig, readonly bool) (*RedisConn, error) {
+	var (
+		c   net.Conn
+		err error
+	)
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	if pc.dialTimeout > 0 {
+		c, err = net.DialTimeout("tcp", addr, pc.dialTimeout)
+	} else {
+		c, err = net.Dial("tcp", addr)
+	}
 	if err != nil {
-		log.Fatalf("Backend Dial  %s:%d failed %s", host, port, err)
+		log.Warningf("Backend Dial  %s:%d failed %s", host, port, err)
+		return nil, err
 	}
 
-	conn.w = bufio.NewWriter(c)
-	conn.r = bufio.NewReader(c)
+	conn := &RedisConn{
+		id:           host + ":" + strconv.Itoa(port),
+		c:            c,
+		w:            bufio.NewWriter(c),
+		r:            bufio.NewReader(c),
+		readTimeout:  pc.readTimeout,
+		writeTimeout: pc.writeTimeout,
+		lastUsed:     time.Now(),
+	}
+	if err := conn.handshake(pc, readonly); err != nil {
+		log.Warningf("Backend handshake %s:%d failed %s", host, port, err)
+		c.Close()
+		return nil, err
+	}
 	return conn, nil
 }
 
-func RedisConnDialer(host string, port int, id string, pc *ProxyConfig) func() (Conn, error) {
+// RedisConnDialer 连接池的 dialer，readonly 表示目标是从库
+func RedisConnDialer(host string, port int, id string, readonly bool, pc *ProxyConfig) func() (Conn, error) {
 	return func() (Conn, error) {
-		var c net.Conn
-		var err error
-
-		if pc.dialTimeout > 0 {
-			c, err = net.DialTimeout("tcp4", fmt.Sprintf("%s:%d", host, port), pc.dialTimeout*time.Second)
-		} else {
-			c, err = net.Dial("tcp4", fmt.Sprintf("%s:%d", host, port))
-		}
+		conn, err := dialRedisConn(host, port, pc, readonly)
 		if err != nil {
 			log.Warning("RedisConnDialer failed ", err)
 			return nil, err
 		}
+		conn.id = id
+		return conn, nil
+	}
+}
 
-		conn := &RedisConn{
-			id:           id,
-			c:            c,
-			w:            bufio.NewWriter(c),
-			r:            bufio.NewReader(c),
-			readTimeout:  pc.readTimeout,
-			writeTimeout: pc.writeTimeout,
-			lastUsed:     time.Now(),
+// handshake 新连接上依次发送 AUTH、CLIENT SETNAME 和 READONLY，一次往返
+// slaveok 时只读命令会发到从库，只有从库连接需要 READONLY
+// 集群模式只有 db 0，不发送 SELECT
+func (c *RedisConn) handshake(pc *ProxyConfig, readonly bool) error {
+	var cmds []*ArrayResp
+	if pc.redisPassword != "" {
+		if pc.redisUser != "" {
+			cmds = append(cmds, NewCommand([]byte("AUTH"), []byte(pc.redisUser), []byte(pc.redisPassword)))
+		} else {
+			cmds = append(cmds, NewCommand([]byte("AUTH"), []byte(pc.redisPassword)))
 		}
-		return conn, nil
 	}
+	if pc.clientName != "" {
+		cmds = append(cmds, NewCommand([]byte("CLIENT"), []byte("SETNAME"), []byte(pc.clientName)))
+	}
+	if pc.slaveOk && readonly {
+		cmds = append(cmds, NewCommand([]byte("READONLY")))
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+
+	// 连接放回连接池时不能带着 deadline，谁设置谁在用完之后清除，比如 execBlocking 的读超时
+	defer c.c.SetDeadline(time.Time{})
+	if c.writeTimeout > 0 {
+		c.c.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	for _, cmd := range cmds {
+		if err := cmd.Encode(c.w); err != nil {
+			return err
+		}
+	}
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	if c.readTimeout > 0 {
+		c.c.SetReadDeadline(time.Now().Add(c.readTimeout))
+	}
+
+	// 读完所有回复再返回错误，错误信息中不包含密码
+	var first error
+	for _, cmd := range cmds {
+		r, err := ReadProtocol(c.r)
+		if err != nil {
+			return err
+		}
+		if er, ok := r.(*ErrorResp); ok && first == nil {
+			first = fmt.Errorf("%s %s", cmd.Arg(0), er.Args[0])
+		}
+	}
+	return first
 }
 
 func (c *RedisConn) Close() error {
@@ -133,11 +198,16 @@ func (c *RedisConn) Ping() bool {
 	return false
 }
 
-func GetClusterNodes(host string, port int) ([]*Node, error) {
-	c, err := NewRedisConn(host, port)
+func GetClusterNodes(host string, port int, pc *ProxyConfig) ([]*Node, error) {
+	c, err := NewRedisConn(host, port, pc)
 	if err != nil {
 		return nil, err
 	}
+	defer c.Close()
+
+	if pc.dialTimeout > 0 {
+		c.c.SetDeadline(time.Now().Add(pc.dialTimeout))
+	}
 
 	_, err = c.w.Write(ClusterNodes)
 	if err != nil {
@@ -154,6 +224,10 @@ func GetClusterNodes(host string, port int) ([]*Node, error) {
 		return nil, e
 	}
 
+	if er, ok := r.(*ErrorResp); ok {
+		return nil, fmt.Errorf("Cluster nodes Command failed %s", er.Args[0])
+	}
+
 	br, ok := r.(*BulkResp)
 	if !ok {
 		return nil, errors.New("wrong resp type, respect BulkResp in GetClusterNodes")
@@ -163,51 +237,65 @@ func GetClusterNodes(host string, port int) ([]*Node, error) {
 		return nil, errors.New("Cluster nodes Command failed")
 	}
 
-	lines := strings.Split(string(br.Args[0]), "\n")
-	// 96ea3677b33334fb27382a08e475571a48342db0 10.10.10.86:6592 slave 4382646a92a3949bb9fdcfdc5a383e5e4b20a849 0 1447149668244 57 connected
-	// 219dfcf127e995244a43a5d57d95ea5f55b69c07 10.10.10.96:6595 master - 0 1447149668743 44 connected 3736-3939
+	return parseClusterNodes(string(br.Args[0]))
+}
+
+// parseClusterNodes 解析 cluster nodes 的输出
+// 96ea3677b33334fb27382a08e475571a48342db0 10.10.10.86:6592 slave 4382646a92a3949bb9fdcfdc5a383e5e4b20a849 0 1447149668244 57 connected
+// 219dfcf127e995244a43a5d57d95ea5f55b69c07 10.10.10.96:6595@16595 master - 0 1447149668743 44 connected 0-100 3736-3939 5000 [5001->-96ea3677b33334fb27382a08e475571a48342db0]
+func parseClusterNodes(s string) ([]*Node, error) {
 	ns := make([]*Node, 0)
-	for _, l := range lines[:len(lines)-1] {
-		n := &Node{
-			serveSlot: new(SlotRange),
-		}
+	for _, l := range strings.Split(s, "\n") {
 		fields := strings.Fields(l)
+		if len(fields) == 0 {
+			continue
+		}
 		log.Info("GetClusterNodes fields: ", len(fields), fields)
-		if len(fields) < 8 || len(fields) > 9 {
+		if len(fields) < 8 {
 			return nil, errors.New("Cluster nodes fileds wrong")
 		}
 
-		n.id = fields[1]
-
-		url := strings.Split(fields[1], ":")
+		n := &Node{
+			name: fields[0],
+		}
 
-		if len(url) != 2 {
-			return nil, errors.New("cluster nodes url wrong")
+		// 3.x host:port, 4.x 之后 host:port@cport, 7.x 之后还可能有 ,hostname
+		addr := fields[1]
+		if i := strings.IndexAny(addr, "@,"); i >= 0 {
+			addr = addr[:i]
 		}
+		n.id = addr
 
-		n.host = url[0]
 		var err error
-		n.port, err = strconv.Atoi(url[1])
+		n.host, n.port, err = splitAddr(addr)
 		if err != nil {
-			return nil, errors.New("cluster nodes port wrong")
+			return nil, err
 		}
 
-		if strings.Contains(fields[2], "slave") {
+		flags := fields[2]
+		if strings.Contains(flags, "noaddr") || strings.Contains(flags, "handshake") {
+			continue
+		}
+
+		if strings.Contains(flags, "slave") {
+			// 失败的从库不参与读
+			if strings.Contains(flags, "fail") {
+				continue
+			}
 			n.role = "slave"
 			n.slaveOf = fields[3]
 		} else {
 			n.role = "master"
-			slot := strings.Split(fields[8], "-")
-
-			var err error
-			n.serveSlot.start, err = strconv.Atoi(slot[0])
-			if err != nil {
-				return nil, errors.New("cluster nodes serve slots wrong")
-			}
-
-			n.serveSlot.stop, err = strconv.Atoi(slot[1])
-			if err != nil {
-				return nil, errors.New("cluster nodes serve slots wrong")
+			for _, f := range fields[8:] {
+				// 迁移中的 slot [slot->-node] [slot-<-node]，由 MOVED/ASK 处理
+				if strings.HasPrefix(f, "[") {
+					continue
+				}
+				r, err := parseSlotRange(f)
+				if err != nil {
+					return nil, err
+				}
+				n.serveSlots = append(n.serveSlots, r)
 			}
 		}
 
@@ -215,3 +303,39 @@ func GetClusterNodes(host string, port int) ([]*Node, error) {
 	}
 	return ns, nil
 }
+
+// splitAddr 拆分 cluster nodes 和 MOVED 中的 ip:port，IPv6 地址没有方括号
+func splitAddr(addr string) (string, int, error) {
+	i := strings.LastIndexByte(addr, ':')
+	if i < 0 {
+		return "", 0, errors.New("cluster nodes url wrong")
+	}
+	port, err := strconv.Atoi(addr[i+1:])
+	if err != nil {
+		return "", 0, errors.New("cluster nodes port wrong")
+	}
+	return strings.Trim(addr[:i], "[]"), port, nil
+}
+
+func parseSlotRange(f string) (*SlotRange, error) {
+	var (
+		r   = new(SlotRange)
+		err error
+	)
+	slot := strings.SplitN(f, "-", 2)
+	r.start, err = strconv.Atoi(slot[0])
+	if err != nil {
+		return nil, errors.New("cluster nodes serve slots wrong")
+	}
+	r.stop = r.start
+	if len(slot) == 2 {
+		r.stop, err = strconv.Atoi(slot[1])
+		if err != nil {
+			return nil, errors.New("cluster nodes serve slots wrong")
+		}
+	}
+	if r.start < 0 || r.stop >= 16384 || r.start > r.stop {
+		return nil, errors.New("cluster nodes serve slots wrong")
+	}
+	return r, nil
+}
@@ -0,0 +1,38 @@
+package archer
+
+import (
+	"testing"
+)
+
+func Test_ParseClusterNodes(t *testing.T) {
+	out := "96ea3677b33334fb27382a08e475571a48342db0 10.10.10.86:6592 slave 219dfcf127e995244a43a5d57d95ea5f55b69c07 0 1447149668244 57 connected\n" +
+		"219dfcf127e995244a43a5d57d95ea5f55b69c07 10.10.10.96:6595@16595,host myself,master - 0 1447149668743 44 connected 0-100 200 [201->-96ea3677b33334fb27382a08e475571a48342db0]\n" +
+		"4382646a92a3949bb9fdcfdc5a383e5e4b20a849 :0@0 master,noaddr - 0 0 0 disconnected\n"
+	ns, err := parseClusterNodes(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ns) != 2 {
+		t.Fatalf("nodes %d", len(ns))
+	}
+	s, m := ns[0], ns[1]
+	if s.role != "slave" || s.slaveOf != m.name || s.id != "10.10.10.86:6592" {
+		t.Fatalf("slave %+v", s)
+	}
+	if m.id != "10.10.10.96:6595" || m.port != 6595 || len(m.serveSlots) != 2 {
+		t.Fatalf("master %+v", m)
+	}
+	if r := m.serveSlots[1]; r.start != 200 || r.stop != 200 {
+		t.Fatalf("single slot %+v", r)
+	}
+
+	// IPv6 地址没有方括号
+	ns, err = parseClusterNodes("id 2001:db8::1:6379@16379 master - 0 0 1 connected 0-16383\n")
+	if err != nil || ns[0].id != "2001:db8::1:6379" || ns[0].host != "2001:db8::1" || ns[0].port != 6379 {
+		t.Fatalf("ipv6 %+v %v", ns, err)
+	}
+
+	if _, err := parseClusterNodes("id 1.1.1.1:1 master - 0 0 1 connected 100-50\n"); err == nil {
+		t.Fatal("expect wrong slot range error")
+	}
+}
@@ -0,0 +1,487 @@
+package fakeredis
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Command 描述一个命令，key 的位置和 Redis COMMAND 的 firstkey/lastkey/step 一致
+type Command struct {
+	Func     func(ctx *Ctx) Reply
+	Arity    int // 负数表示最少参数个数
+	FirstKey int
+	LastKey  int // 负数从后往前数
+	Step     int
+	ReadOnly bool
+	NumKeys  int // 大于 0 时 key 的个数在这个下标，key 紧跟在后面，比如 EVAL
+}
+
+func (cmd *Command) keys(args [][]byte) [][]byte {
+	if cmd.NumKeys > 0 {
+		n, err := strconv.Atoi(string(args[cmd.NumKeys]))
+		if err != nil || n < 0 || cmd.NumKeys+n >= len(args) {
+			return nil
+		}
+		return args[cmd.NumKeys+1 : cmd.NumKeys+1+n]
+	}
+	if cmd.FirstKey <= 0 || cmd.FirstKey >= len(args) {
+		return nil
+	}
+	last := cmd.LastKey
+	if last < 0 {
+		last = len(args) + last
+	}
+	step := cmd.Step
+	if step <= 0 {
+		step = 1
+	}
+	var keys [][]byte
+	for i := cmd.FirstKey; i <= last && i < len(args); i += step {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
+// Ctx 是命令执行的上下文
+type Ctx struct {
+	cluster *Cluster
+	node    *Node
+	client  *client
+	Args    [][]byte
+}
+
+func (ctx *Ctx) Node() *Node {
+	return ctx.node
+}
+
+func (ctx *Ctx) DB() *DB {
+	return ctx.cluster.db
+}
+
+func (ctx *Ctx) Arg(i int) string {
+	return string(ctx.Args[i])
+}
+
+// CloseConn 关闭当前命令所在的连接，用来模拟执行过程中连接断开
+func (ctx *Ctx) CloseConn() {
+	ctx.client.conn.Close()
+}
+
+var builtin = map[string]*Command{
+	"PING":         {Func: cmdPing, Arity: -1},
+	"ECHO":         {Func: cmdEcho, Arity: 2},
+	"QUIT":         {Func: cmdQuit, Arity: 1},
+	"ASKING":       {Func: cmdAsking, Arity: 1},
+	"READONLY":     {Func: cmdReadOnly, Arity: 1},
+	"AUTH":         {Func: cmdAuth, Arity: -2},
+	"CLIENT":       {Func: cmdClient, Arity: -2},
+	"CLUSTER":      {Func: cmdCluster, Arity: -2},
+	"GET":          {Func: cmdGet, Arity: 2, FirstKey: 1, LastKey: 1, Step: 1, ReadOnly: true},
+	"SET":          {Func: cmdSet, Arity: -3, FirstKey: 1, LastKey: 1, Step: 1},
+	"INCR":         {Func: cmdIncr, Arity: 2, FirstKey: 1, LastKey: 1, Step: 1},
+	"EXISTS":       {Func: cmdExists, Arity: -2, FirstKey: 1, LastKey: -1, Step: 1, ReadOnly: true},
+	"DEL":          {Func: cmdDel, Arity: -2, FirstKey: 1, LastKey: -1, Step: 1},
+	"UNLINK":       {Func: cmdDel, Arity: -2, FirstKey: 1, LastKey: -1, Step: 1},
+	"TOUCH":        {Func: cmdExists, Arity: -2, FirstKey: 1, LastKey: -1, Step: 1, ReadOnly: true},
+	"MGET":         {Func: cmdMget, Arity: -2, FirstKey: 1, LastKey: -1, Step: 1, ReadOnly: true},
+	"MSET":         {Func: cmdMset, Arity: -3, FirstKey: 1, LastKey: -1, Step: 2},
+	"MSETNX":       {Func: cmdMsetnx, Arity: -3, FirstKey: 1, LastKey: -1, Step: 2},
+	"SADD":         {Func: cmdSadd, Arity: -3, FirstKey: 1, LastKey: 1, Step: 1},
+	"SREM":         {Func: cmdSrem, Arity: -3, FirstKey: 1, LastKey: 1, Step: 1},
+	"SMEMBERS":     {Func: cmdSmembers, Arity: 2, FirstKey: 1, LastKey: 1, Step: 1, ReadOnly: true},
+	"SCARD":        {Func: cmdScard, Arity: 2, FirstKey: 1, LastKey: 1, Step: 1, ReadOnly: true},
+	"SINTER":       {Func: cmdSetOp("SINTER"), Arity: -2, FirstKey: 1, LastKey: -1, Step: 1, ReadOnly: true},
+	"SUNION":       {Func: cmdSetOp("SUNION"), Arity: -2, FirstKey: 1, LastKey: -1, Step: 1, ReadOnly: true},
+	"SDIFF":        {Func: cmdSetOp("SDIFF"), Arity: -2, FirstKey: 1, LastKey: -1, Step: 1, ReadOnly: true},
+	"SINTERSTORE":  {Func: cmdSetOpStore("SINTER"), Arity: -3, FirstKey: 1, LastKey: -1, Step: 1},
+	"SUNIONSTORE":  {Func: cmdSetOpStore("SUNION"), Arity: -3, FirstKey: 1, LastKey: -1, Step: 1},
+	"SDIFFSTORE":   {Func: cmdSetOpStore("SDIFF"), Arity: -3, FirstKey: 1, LastKey: -1, Step: 1},
+	"ZADD":         {Func: cmdZadd, Arity: -4, FirstKey: 1, LastKey: 1, Step: 1},
+	"ZCARD":        {Func: cmdZcard, Arity: 2, FirstKey: 1, LastKey: 1, Step: 1, ReadOnly: true},
+	"ZSCORE":       {Func: cmdZscore, Arity: 3, FirstKey: 1, LastKey: 1, Step: 1, ReadOnly: true},
+	"ZRANGE":       {Func: cmdZrange, Arity: -4, FirstKey: 1, LastKey: 1, Step: 1, ReadOnly: true},
+	"DUMP":         {Func: cmdDump, Arity: 2, FirstKey: 1, LastKey: 1, Step: 1, ReadOnly: true},
+	"RESTORE":      {Func: cmdRestore, Arity: -4, FirstKey: 1, LastKey: 1, Step: 1},
+	"PEXPIRE":      {Func: cmdPexpire, Arity: 3, FirstKey: 1, LastKey: 1, Step: 1},
+	"PTTL":         {Func: cmdPttl, Arity: 2, FirstKey: 1, LastKey: 1, Step: 1, ReadOnly: true},
+	"SCAN":         {Func: cmdScan, Arity: -2, ReadOnly: true},
+	"HSCAN":        {Func: cmdScanKey, Arity: -3, FirstKey: 1, LastKey: 1, Step: 1, ReadOnly: true},
+	"SSCAN":        {Func: cmdScanKey, Arity: -3, FirstKey: 1, LastKey: 1, Step: 1, ReadOnly: true},
+	"ZSCAN":        {Func: cmdScanKey, Arity: -3, FirstKey: 1, LastKey: 1, Step: 1, ReadOnly: true},
+	"KEYS":         {Func: cmdKeys, Arity: 2, ReadOnly: true},
+	"DBSIZE":       {Func: cmdDbsize, Arity: 1, ReadOnly: true},
+	"RANDOMKEY":    {Func: cmdRandomkey, Arity: 1, ReadOnly: true},
+	"FLUSHDB":      {Func: cmdFlush, Arity: -1},
+	"FLUSHALL":     {Func: cmdFlush, Arity: -1},
+	"MULTI":        {Func: cmdMulti, Arity: 1},
+	"EXEC":         {Func: cmdExec, Arity: 1},
+	"DISCARD":      {Func: cmdDiscard, Arity: 1},
+	"WATCH":        {Func: cmdWatch, Arity: -2, FirstKey: 1, LastKey: -1, Step: 1},
+	"UNWATCH":      {Func: cmdUnwatch, Arity: 1},
+	"EVAL":         {Func: cmdEval, Arity: -3, NumKeys: 2},
+	"EVALSHA":      {Func: cmdEvalsha, Arity: -3, NumKeys: 2},
+	"EVAL_RO":      {Func: cmdEval, Arity: -3, NumKeys: 2, ReadOnly: true},
+	"EVALSHA_RO":   {Func: cmdEvalsha, Arity: -3, NumKeys: 2, ReadOnly: true},
+	"SCRIPT":       {Func: cmdScript, Arity: -2},
+	"SUBSCRIBE":    {Func: cmdSubscribe("subscribe", "subscribe"), Arity: -2},
+	"PSUBSCRIBE":   {Func: cmdSubscribe("psubscribe", "psubscribe"), Arity: -2},
+	"SSUBSCRIBE":   {Func: cmdSubscribe("ssubscribe", "ssubscribe"), Arity: -2, FirstKey: 1, LastKey: -1, Step: 1},
+	"UNSUBSCRIBE":  {Func: cmdUnsubscribe("unsubscribe", "subscribe"), Arity: -1},
+	"PUNSUBSCRIBE": {Func: cmdUnsubscribe("punsubscribe", "psubscribe"), Arity: -1},
+	"SUNSUBSCRIBE": {Func: cmdUnsubscribe("sunsubscribe", "ssubscribe"), Arity: -1, FirstKey: 1, LastKey: -1, Step: 1},
+	"PUBLISH":      {Func: cmdPublish, Arity: 3},
+	"SPUBLISH":     {Func: cmdSpublish, Arity: 3, FirstKey: 1, LastKey: 1, Step: 1},
+	"LPUSH":        {Func: cmdPush(true), Arity: -3, FirstKey: 1, LastKey: 1, Step: 1},
+	"RPUSH":        {Func: cmdPush(false), Arity: -3, FirstKey: 1, LastKey: 1, Step: 1},
+	"LLEN":         {Func: cmdLlen, Arity: 2, FirstKey: 1, LastKey: 1, Step: 1, ReadOnly: true},
+	"LRANGE":       {Func: cmdLrange, Arity: 4, FirstKey: 1, LastKey: 1, Step: 1, ReadOnly: true},
+	"BLPOP":        {Func: cmdBpop(true), Arity: -3, FirstKey: 1, LastKey: -2, Step: 1},
+	"BRPOP":        {Func: cmdBpop(false), Arity: -3, FirstKey: 1, LastKey: -2, Step: 1},
+	"BRPOPLPUSH":   {Func: cmdBlmove, Arity: 4, FirstKey: 1, LastKey: 2, Step: 1},
+	"BLMOVE":       {Func: cmdBlmove, Arity: 6, FirstKey: 1, LastKey: 2, Step: 1},
+	"BZPOPMIN":     {Func: cmdBzpop(true), Arity: -3, FirstKey: 1, LastKey: -2, Step: 1},
+	"BZPOPMAX":     {Func: cmdBzpop(false), Arity: -3, FirstKey: 1, LastKey: -2, Step: 1},
+	"HSET":         {Func: cmdHset, Arity: -4, FirstKey: 1, LastKey: 1, Step: 1},
+	"HGET":         {Func: cmdHget, Arity: 3, FirstKey: 1, LastKey: 1, Step: 1, ReadOnly: true},
+	"HGETALL":      {Func: cmdHgetall, Arity: 2, FirstKey: 1, LastKey: 1, Step: 1, ReadOnly: true},
+}
+
+var (
+	errWrongType = Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+	errNotInt    = Error("ERR value is not an integer or out of range")
+	errSyntax    = Error("ERR syntax error")
+)
+
+func cmdPing(ctx *Ctx) Reply {
+	// 订阅模式下 PING 回复数组
+	if ctx.client.subscribed() {
+		msg := []byte{}
+		if len(ctx.Args) > 1 {
+			msg = ctx.Args[1]
+		}
+		return []Reply{"pong", msg}
+	}
+	if len(ctx.Args) > 1 {
+		return ctx.Args[1]
+	}
+	return Status("PONG")
+}
+
+func cmdEcho(ctx *Ctx) Reply {
+	return ctx.Args[1]
+}
+
+func cmdQuit(ctx *Ctx) Reply {
+	return errQuit
+}
+
+func cmdAsking(ctx *Ctx) Reply {
+	ctx.client.asking = true
+	return OK
+}
+
+func cmdReadOnly(ctx *Ctx) Reply {
+	ctx.client.mu.Lock()
+	ctx.client.readonly = true
+	ctx.client.mu.Unlock()
+	return OK
+}
+
+// AUTH [username] password，没有设置用户时和 Redis 一样返回错误
+func cmdAuth(ctx *Ctx) Reply {
+	user, pass := "default", ctx.Arg(1)
+	switch len(ctx.Args) {
+	case 2:
+	case 3:
+		user, pass = ctx.Arg(1), ctx.Arg(2)
+	default:
+		return Error("ERR syntax error")
+	}
+	if !ctx.cluster.requireAuth() {
+		return Error("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+	}
+	if !ctx.cluster.authenticate(user, pass) {
+		return Error("WRONGPASS invalid username-password pair or user is disabled.")
+	}
+	ctx.client.mu.Lock()
+	ctx.client.user = user
+	ctx.client.mu.Unlock()
+	return OK
+}
+
+func cmdClient(ctx *Ctx) Reply {
+	switch strings.ToUpper(ctx.Arg(1)) {
+	case "SETNAME":
+		if len(ctx.Args) != 3 {
+			return Error("ERR wrong number of arguments for 'client|setname' command")
+		}
+		ctx.client.mu.Lock()
+		ctx.client.name = ctx.Arg(2)
+		ctx.client.mu.Unlock()
+		return OK
+	case "GETNAME":
+		ctx.client.mu.Lock()
+		defer ctx.client.mu.Unlock()
+		if ctx.client.name == "" {
+			return []byte(nil)
+		}
+		return ctx.client.name
+	}
+	return Error("ERR unknown subcommand '" + ctx.Arg(1) + "'")
+}
+
+func cmdCluster(ctx *Ctx) Reply {
+	switch strings.ToUpper(ctx.Arg(1)) {
+	case "NODES":
+		return []byte(ctx.cluster.clusterNodes(ctx.node))
+	case "KEYSLOT":
+		if len(ctx.Args) != 3 {
+			return Error("ERR wrong number of arguments for 'cluster|keyslot' command")
+		}
+		return Slot(ctx.Arg(2))
+	}
+	return Error("ERR unknown subcommand '" + ctx.Arg(1) + "'")
+}
+
+func cmdGet(ctx *Ctx) Reply {
+	v, err := ctx.DB().String(ctx.Arg(1))
+	if err != nil {
+		return err
+	}
+	return v
+}
+
+func cmdSet(ctx *Ctx) Reply {
+	nx, xx := false, false
+	for _, opt := range ctx.Args[3:] {
+		switch strings.ToUpper(string(opt)) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		default:
+			return errSyntax
+		}
+	}
+	db := ctx.DB()
+	db.Lock()
+	defer db.Unlock()
+	_, exists := db.data[ctx.Arg(1)]
+	if nx && exists || xx && !exists {
+		return nil
+	}
+	db.data[ctx.Arg(1)] = copyBytes(ctx.Args[2])
+	delete(db.ttls, ctx.Arg(1))
+	return OK
+}
+
+func cmdIncr(ctx *Ctx) Reply {
+	db := ctx.DB()
+	db.Lock()
+	defer db.Unlock()
+	var n int64
+	switch v := db.data[ctx.Arg(1)].(type) {
+	case nil:
+	case []byte:
+		var err error
+		n, err = strconv.ParseInt(string(v), 10, 64)
+		if err != nil {
+			return errNotInt
+		}
+	default:
+		return errWrongType
+	}
+	n++
+	db.data[ctx.Arg(1)] = []byte(strconv.FormatInt(n, 10))
+	return n
+}
+
+func cmdExists(ctx *Ctx) Reply {
+	n := 0
+	for _, k := range ctx.Args[1:] {
+		if ctx.DB().Exists(string(k)) {
+			n++
+		}
+	}
+	return n
+}
+
+func cmdDel(ctx *Ctx) Reply {
+	db := ctx.DB()
+	db.Lock()
+	defer db.Unlock()
+	n := 0
+	for _, k := range ctx.Args[1:] {
+		if _, ok := db.data[string(k)]; ok {
+			delete(db.data, string(k))
+			delete(db.ttls, string(k))
+			n++
+		}
+	}
+	return n
+}
+
+func cmdMget(ctx *Ctx) Reply {
+	rs := make([]Reply, 0, len(ctx.Args)-1)
+	for _, k := range ctx.Args[1:] {
+		v, err := ctx.DB().String(string(k))
+		if err != nil {
+			// MGET 对于其它类型的 key 返回 nil
+			v = nil
+		}
+		rs = append(rs, v)
+	}
+	return rs
+}
+
+func cmdMset(ctx *Ctx) Reply {
+	if len(ctx.Args)%2 != 1 {
+		return Error("ERR wrong number of arguments for 'mset' command")
+	}
+	db := ctx.DB()
+	db.Lock()
+	defer db.Unlock()
+	for i := 1; i < len(ctx.Args); i += 2 {
+		db.data[string(ctx.Args[i])] = copyBytes(ctx.Args[i+1])
+	}
+	return OK
+}
+
+func cmdMsetnx(ctx *Ctx) Reply {
+	if len(ctx.Args)%2 != 1 {
+		return Error("ERR wrong number of arguments for 'msetnx' command")
+	}
+	db := ctx.DB()
+	db.Lock()
+	defer db.Unlock()
+	for i := 1; i < len(ctx.Args); i += 2 {
+		if _, ok := db.data[string(ctx.Args[i])]; ok {
+			return 0
+		}
+	}
+	for i := 1; i < len(ctx.Args); i += 2 {
+		db.data[string(ctx.Args[i])] = copyBytes(ctx.Args[i+1])
+	}
+	return 1
+}
+
+func cmdHset(ctx *Ctx) Reply {
+	if len(ctx.Args)%2 != 0 {
+		return Error("ERR wrong number of arguments for 'hset' command")
+	}
+	db := ctx.DB()
+	db.Lock()
+	defer db.Unlock()
+	h, err := db.hash(ctx.Arg(1), true)
+	if err != nil {
+		return err
+	}
+	n := 0
+	for i := 2; i < len(ctx.Args); i += 2 {
+		f := string(ctx.Args[i])
+		if _, ok := h[f]; !ok {
+			n++
+		}
+		h[f] = copyBytes(ctx.Args[i+1])
+	}
+	return n
+}
+
+func cmdHget(ctx *Ctx) Reply {
+	db := ctx.DB()
+	db.Lock()
+	defer db.Unlock()
+	h, err := db.hash(ctx.Arg(1), false)
+	if err != nil {
+		return err
+	}
+	if v, ok := h[ctx.Arg(2)]; ok {
+		return v
+	}
+	return nil
+}
+
+func cmdHgetall(ctx *Ctx) Reply {
+	db := ctx.DB()
+	db.Lock()
+	defer db.Unlock()
+	h, err := db.hash(ctx.Arg(1), false)
+	if err != nil {
+		return err
+	}
+	rs := make([]Reply, 0, 2*len(h))
+	for f, v := range h {
+		rs = append(rs, []byte(f), v)
+	}
+	return rs
+}
+
+// DB 是所有节点共享的数据
+// value 类型: []byte string, map[string][]byte hash, map[string]struct{} set, map[string]float64 zset
+type DB struct {
+	sync.Mutex
+	data map[string]interface{}
+	ttls map[string]int64 // PEXPIRE 设置的毫秒数，不会过期
+}
+
+func NewDB() *DB {
+	return &DB{data: make(map[string]interface{}), ttls: make(map[string]int64)}
+}
+
+func (db *DB) Exists(key string) bool {
+	db.Lock()
+	defer db.Unlock()
+	_, ok := db.data[key]
+	return ok
+}
+
+// String 返回 string 类型的值，不存在返回 nil
+func (db *DB) String(key string) ([]byte, Reply) {
+	db.Lock()
+	defer db.Unlock()
+	switch v := db.data[key].(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		return v, nil
+	}
+	return nil, errWrongType
+}
+
+// Set 直接写入 string，测试用来准备数据
+func (db *DB) Set(key string, value string) {
+	db.Lock()
+	db.data[key] = []byte(value)
+	db.Unlock()
+}
+
+// Keys 返回所有 key
+func (db *DB) Keys() []string {
+	db.Lock()
+	defer db.Unlock()
+	keys := make([]string, 0, len(db.data))
+	for k := range db.data {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// hash 调用前需要加锁
+func (db *DB) hash(key string, create bool) (map[string][]byte, Reply) {
+	switch v := db.data[key].(type) {
+	case nil:
+		h := make(map[string][]byte)
+		if create {
+			db.data[key] = h
+		}
+		return h, nil
+	case map[string][]byte:
+		return v, nil
+	}
+	return nil, errWrongType
+}
+
+func copyBytes(b []byte) []byte {
+	return append([]byte(nil), b...)
+}
@@ -0,0 +1,119 @@
+package fakeredis
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// dump 是 DUMP 的序列化格式，只在 fakeredis 内部使用
+type dump struct {
+	Str  []byte
+	Hash map[string][]byte
+	Set  []string
+	ZSet map[string]float64
+}
+
+func cmdDump(ctx *Ctx) Reply {
+	db := ctx.DB()
+	db.Lock()
+	defer db.Unlock()
+	var d dump
+	switch v := db.data[ctx.Arg(1)].(type) {
+	case nil:
+		return nil
+	case []byte:
+		d.Str = v
+	case map[string][]byte:
+		d.Hash = v
+	case map[string]struct{}:
+		for m := range v {
+			d.Set = append(d.Set, m)
+		}
+		sort.Strings(d.Set)
+	case map[string]float64:
+		d.ZSet = v
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&d); err != nil {
+		return Error("ERR " + err.Error())
+	}
+	return buf.Bytes()
+}
+
+// RESTORE key ttl payload [REPLACE]
+func cmdRestore(ctx *Ctx) Reply {
+	ttl, err := strconv.ParseInt(ctx.Arg(2), 10, 64)
+	if err != nil || ttl < 0 {
+		return Error("ERR Invalid TTL value, must be >= 0")
+	}
+	replace := false
+	for _, opt := range ctx.Args[4:] {
+		if !strings.EqualFold(string(opt), "REPLACE") {
+			return errSyntax
+		}
+		replace = true
+	}
+	var d dump
+	if err := gob.NewDecoder(bytes.NewReader(ctx.Args[3])).Decode(&d); err != nil {
+		return Error("ERR DUMP payload version or checksum are wrong")
+	}
+
+	db := ctx.DB()
+	db.Lock()
+	defer db.Unlock()
+	key := ctx.Arg(1)
+	if _, ok := db.data[key]; ok && !replace {
+		return Error("BUSYKEY Target key name already exists.")
+	}
+	switch {
+	case d.Hash != nil:
+		db.data[key] = d.Hash
+	case d.Set != nil:
+		s := make(map[string]struct{}, len(d.Set))
+		for _, m := range d.Set {
+			s[m] = struct{}{}
+		}
+		db.data[key] = s
+	case d.ZSet != nil:
+		db.data[key] = d.ZSet
+	default:
+		db.data[key] = append([]byte{}, d.Str...)
+	}
+	delete(db.ttls, key)
+	if ttl > 0 {
+		db.ttls[key] = ttl
+	}
+	return OK
+}
+
+// PEXPIRE 只记录 ttl，key 不会真的过期
+func cmdPexpire(ctx *Ctx) Reply {
+	ms, err := strconv.ParseInt(ctx.Arg(2), 10, 64)
+	if err != nil {
+		return errNotInt
+	}
+	db := ctx.DB()
+	db.Lock()
+	defer db.Unlock()
+	if _, ok := db.data[ctx.Arg(1)]; !ok {
+		return 0
+	}
+	db.ttls[ctx.Arg(1)] = ms
+	return 1
+}
+
+func cmdPttl(ctx *Ctx) Reply {
+	db := ctx.DB()
+	db.Lock()
+	defer db.Unlock()
+	if _, ok := db.data[ctx.Arg(1)]; !ok {
+		return -2
+	}
+	if ms, ok := db.ttls[ctx.Arg(1)]; ok {
+		return ms
+	}
+	return -1
+}
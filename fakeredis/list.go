@@ -0,0 +1,246 @@
+package fakeredis
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// list 调用前需要加锁
+func (db *DB) list(key string) ([][]byte, Reply) {
+	switch v := db.data[key].(type) {
+	case nil:
+		return nil, nil
+	case [][]byte:
+		return v, nil
+	}
+	return nil, errWrongType
+}
+
+// setList 空列表删除 key，调用前需要加锁
+func (db *DB) setList(key string, l [][]byte) {
+	if len(l) == 0 {
+		delete(db.data, key)
+		return
+	}
+	db.data[key] = l
+}
+
+func cmdPush(left bool) func(ctx *Ctx) Reply {
+	return func(ctx *Ctx) Reply {
+		db := ctx.DB()
+		db.Lock()
+		defer db.Unlock()
+		l, err := db.list(ctx.Arg(1))
+		if err != nil {
+			return err
+		}
+		for _, v := range ctx.Args[2:] {
+			v = append([]byte(nil), v...)
+			if left {
+				l = append([][]byte{v}, l...)
+			} else {
+				l = append(l, v)
+			}
+		}
+		db.setList(ctx.Arg(1), l)
+		return len(l)
+	}
+}
+
+func cmdLlen(ctx *Ctx) Reply {
+	db := ctx.DB()
+	db.Lock()
+	defer db.Unlock()
+	l, err := db.list(ctx.Arg(1))
+	if err != nil {
+		return err
+	}
+	return len(l)
+}
+
+// LRANGE key start stop
+func cmdLrange(ctx *Ctx) Reply {
+	start, err1 := strconv.Atoi(ctx.Arg(2))
+	stop, err2 := strconv.Atoi(ctx.Arg(3))
+	if err1 != nil || err2 != nil {
+		return errNotInt
+	}
+	db := ctx.DB()
+	db.Lock()
+	defer db.Unlock()
+	l, err := db.list(ctx.Arg(1))
+	if err != nil {
+		return err
+	}
+	if start < 0 {
+		start += len(l)
+	}
+	if stop < 0 {
+		stop += len(l)
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= len(l) {
+		stop = len(l) - 1
+	}
+	replies := []Reply{}
+	for i := start; i <= stop; i++ {
+		replies = append(replies, l[i])
+	}
+	return replies
+}
+
+// popLocked 从 key 的左边或者右边弹出一个元素，调用前需要加锁
+func (db *DB) popLocked(key string, left bool) ([]byte, Reply) {
+	l, err := db.list(key)
+	if err != nil || len(l) == 0 {
+		return nil, err
+	}
+	var v []byte
+	if left {
+		v, l = l[0], l[1:]
+	} else {
+		v, l = l[len(l)-1], l[:len(l)-1]
+	}
+	db.setList(key, l)
+	return v, nil
+}
+
+// parseTimeout 阻塞命令的超时时间，单位秒，0 表示一直阻塞
+func parseTimeout(s string) (time.Duration, Reply) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, Error("ERR timeout is not a float or out of range")
+	}
+	if f < 0 {
+		return 0, Error("ERR timeout is negative")
+	}
+	return time.Duration(f * float64(time.Second)), nil
+}
+
+// block 反复调用 try 直到返回非 nil、超时或者客户端断开
+// 超时返回 timeoutReply，客户端断开时返回值不会写出
+func block(ctx *Ctx, timeout time.Duration, timeoutReply Reply, try func() Reply) Reply {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	for {
+		if r := try(); r != nil {
+			return r
+		}
+		// MULTI 中的阻塞命令不阻塞
+		if ctx.client.multi || !deadline.IsZero() && time.Now().After(deadline) {
+			return timeoutReply
+		}
+		if !ctx.client.alive(5 * time.Millisecond) {
+			return timeoutReply
+		}
+	}
+}
+
+// BLPOP BRPOP key [key ...] timeout
+func cmdBpop(left bool) func(ctx *Ctx) Reply {
+	return func(ctx *Ctx) Reply {
+		timeout, reply := parseTimeout(ctx.Arg(len(ctx.Args) - 1))
+		if reply != nil {
+			return reply
+		}
+		keys := ctx.Args[1 : len(ctx.Args)-1]
+		db := ctx.DB()
+		return block(ctx, timeout, NilArray, func() Reply {
+			db.Lock()
+			defer db.Unlock()
+			for _, k := range keys {
+				v, err := db.popLocked(string(k), left)
+				if err != nil {
+					return err
+				}
+				if v != nil {
+					return []Reply{k, v}
+				}
+			}
+			return nil
+		})
+	}
+}
+
+// BRPOPLPUSH source destination timeout 等价于 BLMOVE source destination RIGHT LEFT timeout
+// BLMOVE source destination LEFT|RIGHT LEFT|RIGHT timeout
+func cmdBlmove(ctx *Ctx) Reply {
+	from, to := "RIGHT", "LEFT"
+	if len(ctx.Args) == 6 {
+		from, to = strings.ToUpper(ctx.Arg(3)), strings.ToUpper(ctx.Arg(4))
+		if from != "LEFT" && from != "RIGHT" || to != "LEFT" && to != "RIGHT" {
+			return errSyntax
+		}
+	}
+	timeout, reply := parseTimeout(ctx.Arg(len(ctx.Args) - 1))
+	if reply != nil {
+		return reply
+	}
+	src, dst := ctx.Arg(1), ctx.Arg(2)
+	db := ctx.DB()
+	return block(ctx, timeout, nil, func() Reply {
+		db.Lock()
+		defer db.Unlock()
+		if _, err := db.list(dst); err != nil {
+			return err
+		}
+		v, err := db.popLocked(src, from == "LEFT")
+		if err != nil || v == nil {
+			return err
+		}
+		l, _ := db.list(dst)
+		if to == "LEFT" {
+			l = append([][]byte{v}, l...)
+		} else {
+			l = append(l, v)
+		}
+		db.setList(dst, l)
+		return v
+	})
+}
+
+// BZPOPMIN BZPOPMAX key [key ...] timeout
+func cmdBzpop(min bool) func(ctx *Ctx) Reply {
+	return func(ctx *Ctx) Reply {
+		timeout, reply := parseTimeout(ctx.Arg(len(ctx.Args) - 1))
+		if reply != nil {
+			return reply
+		}
+		keys := ctx.Args[1 : len(ctx.Args)-1]
+		db := ctx.DB()
+		return block(ctx, timeout, NilArray, func() Reply {
+			db.Lock()
+			defer db.Unlock()
+			for _, k := range keys {
+				z, err := db.zset(string(k), false)
+				if err != nil {
+					return err
+				}
+				if len(z) == 0 {
+					continue
+				}
+				var member string
+				first := true
+				for m, score := range z {
+					if first || min && (score < z[member] || score == z[member] && m < member) ||
+						!min && (score > z[member] || score == z[member] && m > member) {
+						member, first = m, false
+					}
+				}
+				score := z[member]
+				delete(z, member)
+				if len(z) == 0 {
+					delete(db.data, string(k))
+				}
+				return []Reply{k, member, FormatScore(score)}
+			}
+			return nil
+		})
+	}
+}
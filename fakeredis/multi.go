@@ -0,0 +1,121 @@
+package fakeredis
+
+import (
+	"reflect"
+	"strings"
+)
+
+// 事务中不入队、直接执行的命令
+var txCommands = map[string]bool{
+	"MULTI":   true,
+	"EXEC":    true,
+	"DISCARD": true,
+	"WATCH":   true,
+	"QUIT":    true,
+}
+
+// copyValue 深拷贝，WATCH 用来比较 key 是否被修改
+func copyValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []byte:
+		return copyBytes(v)
+	case map[string][]byte:
+		h := make(map[string][]byte, len(v))
+		for f, val := range v {
+			h[f] = copyBytes(val)
+		}
+		return h
+	case map[string]struct{}:
+		s := make(map[string]struct{}, len(v))
+		for m := range v {
+			s[m] = struct{}{}
+		}
+		return s
+	case map[string]float64:
+		z := make(map[string]float64, len(v))
+		for m, f := range v {
+			z[m] = f
+		}
+		return z
+	}
+	return v
+}
+
+func (cl *client) resetTx() {
+	cl.multi = false
+	cl.dirty = false
+	cl.queue = nil
+	cl.watched = nil
+}
+
+func cmdMulti(ctx *Ctx) Reply {
+	if ctx.client.multi {
+		return Error("ERR MULTI calls can not be nested")
+	}
+	ctx.client.multi = true
+	return OK
+}
+
+func cmdExec(ctx *Ctx) Reply {
+	cl := ctx.client
+	if !cl.multi {
+		return Error("ERR EXEC without MULTI")
+	}
+	defer cl.resetTx()
+	if cl.dirty {
+		return Error("EXECABORT Transaction discarded because of previous errors.")
+	}
+
+	db := ctx.DB()
+	db.Lock()
+	changed := false
+	for k, v := range cl.watched {
+		if !reflect.DeepEqual(v, db.data[k]) {
+			changed = true
+		}
+	}
+	db.Unlock()
+	if changed {
+		return NilArray
+	}
+
+	rs := make([]Reply, 0, len(cl.queue))
+	for _, args := range cl.queue {
+		cmd := ctx.cluster.command(strings.ToUpper(string(args[0])))
+		rs = append(rs, cmd.Func(&Ctx{cluster: ctx.cluster, node: ctx.node, client: cl, Args: args}))
+	}
+	return rs
+}
+
+func cmdDiscard(ctx *Ctx) Reply {
+	if !ctx.client.multi {
+		return Error("ERR DISCARD without MULTI")
+	}
+	ctx.client.resetTx()
+	return OK
+}
+
+func cmdWatch(ctx *Ctx) Reply {
+	cl := ctx.client
+	if cl.multi {
+		cl.dirty = true
+		return Error("ERR WATCH inside MULTI is not allowed")
+	}
+	if cl.watched == nil {
+		cl.watched = make(map[string]interface{})
+	}
+	db := ctx.DB()
+	db.Lock()
+	for _, k := range ctx.Args[1:] {
+		if _, ok := cl.watched[string(k)]; !ok {
+			cl.watched[string(k)] = copyValue(db.data[string(k)])
+		}
+	}
+	db.Unlock()
+	return OK
+}
+
+func cmdUnwatch(ctx *Ctx) Reply {
+	ctx.client.watched = nil
+	return OK
+}
@@ -0,0 +1,165 @@
+package fakeredis
+
+import (
+	"sort"
+
+	"github.com/dongzerun/archer/util"
+)
+
+// 订阅模式下允许执行的命令
+var subscribeCommands = map[string]bool{
+	"SUBSCRIBE":    true,
+	"PSUBSCRIBE":   true,
+	"SSUBSCRIBE":   true,
+	"UNSUBSCRIBE":  true,
+	"PUNSUBSCRIBE": true,
+	"SUNSUBSCRIBE": true,
+	"PING":         true,
+	"QUIT":         true,
+}
+
+func (cl *client) subscribed() bool {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return len(cl.channels)+len(cl.patterns)+len(cl.shards) > 0
+}
+
+// subsLocked 返回 kind 对应的订阅集合，调用者持有 cl.mu
+func (cl *client) subsLocked(kind string) map[string]bool {
+	switch kind {
+	case "psubscribe":
+		if cl.patterns == nil {
+			cl.patterns = make(map[string]bool)
+		}
+		return cl.patterns
+	case "ssubscribe":
+		if cl.shards == nil {
+			cl.shards = make(map[string]bool)
+		}
+		return cl.shards
+	}
+	if cl.channels == nil {
+		cl.channels = make(map[string]bool)
+	}
+	return cl.channels
+}
+
+// countLocked 和 Redis 7 一样，sharded channel 单独计数
+func (cl *client) countLocked(kind string) int {
+	if kind == "ssubscribe" {
+		return len(cl.shards)
+	}
+	return len(cl.channels) + len(cl.patterns)
+}
+
+// SUBSCRIBE channel [channel ...]，每个 channel 回复 kind channel count
+func cmdSubscribe(kind, set string) func(ctx *Ctx) Reply {
+	return func(ctx *Ctx) Reply {
+		cl := ctx.client
+		cl.mu.Lock()
+		defer cl.mu.Unlock()
+		subs := cl.subsLocked(set)
+		var rs replies
+		for _, ch := range ctx.Args[1:] {
+			subs[string(ch)] = true
+			rs = append(rs, []Reply{kind, ch, cl.countLocked(set)})
+		}
+		return rs
+	}
+}
+
+// UNSUBSCRIBE [channel ...]，没有参数时取消所有订阅
+func cmdUnsubscribe(kind, set string) func(ctx *Ctx) Reply {
+	return func(ctx *Ctx) Reply {
+		cl := ctx.client
+		cl.mu.Lock()
+		defer cl.mu.Unlock()
+		subs := cl.subsLocked(set)
+		names := ctx.Args[1:]
+		if len(names) == 0 {
+			all := make([]string, 0, len(subs))
+			for ch := range subs {
+				all = append(all, ch)
+			}
+			sort.Strings(all)
+			for _, ch := range all {
+				names = append(names, []byte(ch))
+			}
+		}
+		if len(names) == 0 {
+			return replies{[]Reply{kind, nil, cl.countLocked(set)}}
+		}
+		var rs replies
+		for _, ch := range names {
+			delete(subs, string(ch))
+			rs = append(rs, []Reply{kind, ch, cl.countLocked(set)})
+		}
+		return rs
+	}
+}
+
+// PUBLISH 发给集群中所有节点上订阅的客户端
+func cmdPublish(ctx *Ctx) Reply {
+	n := 0
+	for _, node := range ctx.cluster.Nodes() {
+		for _, cl := range node.clients() {
+			n += cl.deliver(ctx.Args[1], ctx.Args[2], false)
+		}
+	}
+	return n
+}
+
+// SPUBLISH 只发给 channel 所在的主库和它的从库
+func cmdSpublish(ctx *Ctx) Reply {
+	n := 0
+	nodes := append([]*Node{ctx.Node()}, ctx.cluster.Replicas(ctx.Node())...)
+	for _, node := range nodes {
+		for _, cl := range node.clients() {
+			n += cl.deliver(ctx.Args[1], ctx.Args[2], true)
+		}
+	}
+	return n
+}
+
+func (n *Node) clients() []*client {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	cls := make([]*client, 0, len(n.conns))
+	for _, cl := range n.conns {
+		cls = append(cls, cl)
+	}
+	return cls
+}
+
+// deliver 把消息写给订阅了 channel 的客户端，返回收到消息的订阅数
+func (cl *client) deliver(ch, msg []byte, shard bool) int {
+	var rs replies
+	cl.mu.Lock()
+	switch {
+	case shard:
+		if cl.shards[string(ch)] {
+			rs = append(rs, []Reply{"smessage", ch, msg})
+		}
+	default:
+		if cl.channels[string(ch)] {
+			rs = append(rs, []Reply{"message", ch, msg})
+		}
+		for p := range cl.patterns {
+			if util.Match([]byte(p), ch) {
+				rs = append(rs, []Reply{"pmessage", p, ch, msg})
+			}
+		}
+	}
+	cl.mu.Unlock()
+	if len(rs) == 0 {
+		return 0
+	}
+
+	cl.wmu.Lock()
+	defer cl.wmu.Unlock()
+	if cl.w != nil {
+		writeReply(cl.w, rs)
+		cl.w.Flush()
+	}
+	return len(rs)
+}
@@ -0,0 +1,124 @@
+package fakeredis
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// 这里单独实现一个最小的 RESP 编解码，不能依赖 archer 包，否则 archer 的测试无法引用
+
+// Reply 是命令的返回值，按下面的规则编码
+//
+//	Status   => +OK
+//	Error    => -ERR ...
+//	int      => :1
+//	[]byte   => $3\r\nfoo
+//	nil      => $-1
+//	[]Reply  => *n
+//	NilArray => *-1
+//	replies  => 依次写出每个回复，SUBSCRIBE 每个 channel 一个回复
+type Reply interface{}
+
+type replies []Reply
+
+type Status string
+
+type Error string
+
+type nilArray struct{}
+
+var (
+	OK       = Status("OK")
+	NilArray = nilArray{}
+
+	errProtocol = errors.New("fakeredis protocol error")
+)
+
+func readCommand(r *bufio.Reader) ([][]byte, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, nil
+	}
+	if line[0] != '*' {
+		// inline command
+		return bytes.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil {
+		return nil, errProtocol
+	}
+	args := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errProtocol
+		}
+		l, err := strconv.Atoi(string(line[1:]))
+		if err != nil || l < 0 {
+			return nil, errProtocol
+		}
+		buf := make([]byte, l+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, buf[:l])
+	}
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(line, "\r\n"), nil
+}
+
+func writeReply(w *bufio.Writer, reply Reply) {
+	switch v := reply.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case Status:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case Error:
+		fmt.Fprintf(w, "-%s\r\n", v)
+	case int:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case []byte:
+		if v == nil {
+			w.WriteString("$-1\r\n")
+			return
+		}
+		fmt.Fprintf(w, "$%d\r\n", len(v))
+		w.Write(v)
+		w.WriteString("\r\n")
+	case string:
+		writeReply(w, []byte(v))
+	case nilArray:
+		w.WriteString("*-1\r\n")
+	case []Reply:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, r := range v {
+			writeReply(w, r)
+		}
+	case replies:
+		for _, r := range v {
+			writeReply(w, r)
+		}
+	default:
+		panic(fmt.Sprintf("fakeredis unknown reply type %T", reply))
+	}
+}
@@ -0,0 +1,214 @@
+package fakeredis
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dongzerun/archer/util"
+)
+
+// scanArgs 是 SCAN 的参数 cursor [MATCH pattern] [COUNT count] [TYPE type]
+type scanArgs struct {
+	cursor int
+	match  []byte
+	count  int
+	typ    string
+}
+
+func parseScan(args [][]byte, allowType bool) (*scanArgs, Reply) {
+	sa := &scanArgs{count: 10}
+	c, err := strconv.Atoi(string(args[0]))
+	if err != nil || c < 0 {
+		return nil, Error("ERR invalid cursor")
+	}
+	sa.cursor = c
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return nil, errSyntax
+		}
+		switch opt := strings.ToUpper(string(args[i])); {
+		case opt == "MATCH":
+			sa.match = args[i+1]
+		case opt == "COUNT":
+			n, err := strconv.Atoi(string(args[i+1]))
+			if err != nil || n < 1 {
+				return nil, errSyntax
+			}
+			sa.count = n
+		case opt == "TYPE" && allowType:
+			sa.typ = strings.ToLower(string(args[i+1]))
+		default:
+			return nil, errSyntax
+		}
+	}
+	return sa, nil
+}
+
+func (sa *scanArgs) matchKey(k string) bool {
+	return sa.match == nil || util.Match(sa.match, []byte(k))
+}
+
+func typeOf(v interface{}) string {
+	switch v.(type) {
+	case []byte:
+		return "string"
+	case map[string][]byte:
+		return "hash"
+	case map[string]struct{}:
+		return "set"
+	case map[string]float64:
+		return "zset"
+	case [][]byte:
+		return "list"
+	}
+	return "none"
+}
+
+// SCAN 只返回当前节点负责的 slot 中的 key，cursor 是排序之后的下标
+func cmdScan(ctx *Ctx) Reply {
+	sa, reply := parseScan(ctx.Args[1:], true)
+	if reply != nil {
+		return reply
+	}
+
+	db := ctx.DB()
+	db.Lock()
+	var keys []string
+	for k, v := range db.data {
+		if ctx.cluster.Owner(Slot(k)) != ctx.node {
+			continue
+		}
+		if sa.typ != "" && typeOf(v) != sa.typ {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	db.Unlock()
+	sort.Strings(keys)
+
+	next := sa.cursor + sa.count
+	if next >= len(keys) {
+		next = 0
+	}
+	var rs []Reply
+	for i := sa.cursor; i < len(keys) && (next == 0 || i < next); i++ {
+		if sa.matchKey(keys[i]) {
+			rs = append(rs, []byte(keys[i]))
+		}
+	}
+	if rs == nil {
+		rs = []Reply{}
+	}
+	return []Reply{strconv.Itoa(next), rs}
+}
+
+// HSCAN SSCAN ZSCAN 一次返回所有元素
+func cmdScanKey(ctx *Ctx) Reply {
+	sa, reply := parseScan(ctx.Args[2:], false)
+	if reply != nil {
+		return reply
+	}
+	db := ctx.DB()
+	db.Lock()
+	defer db.Unlock()
+
+	rs := []Reply{}
+	switch v := db.data[ctx.Arg(1)].(type) {
+	case nil:
+	case map[string][]byte:
+		for _, f := range sortedKeys(v) {
+			if sa.matchKey(f) {
+				rs = append(rs, []byte(f), v[f])
+			}
+		}
+	case map[string]struct{}:
+		for _, m := range members(v) {
+			if sa.matchKey(string(m.([]byte))) {
+				rs = append(rs, m)
+			}
+		}
+	case map[string]float64:
+		ms := make([]string, 0, len(v))
+		for m := range v {
+			ms = append(ms, m)
+		}
+		sort.Strings(ms)
+		for _, m := range ms {
+			if sa.matchKey(m) {
+				rs = append(rs, []byte(m), FormatScore(v[m]))
+			}
+		}
+	default:
+		return errWrongType
+	}
+	return []Reply{"0", rs}
+}
+
+func sortedKeys(h map[string][]byte) []string {
+	ks := make([]string, 0, len(h))
+	for k := range h {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	return ks
+}
+
+// ownKeys 返回当前节点负责的 key，调用前需要加锁
+func ownKeys(ctx *Ctx) []string {
+	var keys []string
+	for k := range ctx.DB().data {
+		if ctx.cluster.Owner(Slot(k)) == ctx.node {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func cmdKeys(ctx *Ctx) Reply {
+	db := ctx.DB()
+	db.Lock()
+	defer db.Unlock()
+	rs := []Reply{}
+	for _, k := range ownKeys(ctx) {
+		if util.Match(ctx.Args[1], []byte(k)) {
+			rs = append(rs, []byte(k))
+		}
+	}
+	return rs
+}
+
+func cmdDbsize(ctx *Ctx) Reply {
+	db := ctx.DB()
+	db.Lock()
+	defer db.Unlock()
+	return len(ownKeys(ctx))
+}
+
+func cmdRandomkey(ctx *Ctx) Reply {
+	db := ctx.DB()
+	db.Lock()
+	defer db.Unlock()
+	keys := ownKeys(ctx)
+	if len(keys) == 0 {
+		return nil
+	}
+	return keys[rand.Intn(len(keys))]
+}
+
+// FLUSHDB FLUSHALL [ASYNC|SYNC] 只删除当前节点负责的 key
+func cmdFlush(ctx *Ctx) Reply {
+	if len(ctx.Args) > 2 || len(ctx.Args) == 2 && !strings.EqualFold(ctx.Arg(1), "ASYNC") && !strings.EqualFold(ctx.Arg(1), "SYNC") {
+		return errSyntax
+	}
+	db := ctx.DB()
+	db.Lock()
+	defer db.Unlock()
+	for _, k := range ownKeys(ctx) {
+		delete(db.data, k)
+		delete(db.ttls, k)
+	}
+	return OK
+}
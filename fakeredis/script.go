@@ -0,0 +1,89 @@
+package fakeredis
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+)
+
+// fakeredis 不执行 Lua，脚本的返回值就是脚本本身，用来确认执行的是哪个脚本
+
+// evalKeys 用来检查 numkeys，numkeys 不合法时 keys 返回 nil
+var evalKeys = &Command{NumKeys: 2}
+
+func scriptSHA(body []byte) string {
+	sum := sha1.Sum(body)
+	return hex.EncodeToString(sum[:])
+}
+
+func (n *Node) loadScript(body []byte) string {
+	sha := scriptSHA(body)
+	n.mu.Lock()
+	n.scripts[sha] = append([]byte(nil), body...)
+	n.mu.Unlock()
+	return sha
+}
+
+// HasScript 节点是否缓存了 sha 对应的脚本
+func (n *Node) HasScript(sha string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, ok := n.scripts[sha]
+	return ok
+}
+
+// FlushScripts 清空节点的脚本缓存，模拟节点重启或者故障切换
+func (n *Node) FlushScripts() {
+	n.mu.Lock()
+	n.scripts = make(map[string][]byte)
+	n.mu.Unlock()
+}
+
+// EVAL script numkeys key [key ...] arg [arg ...]
+func cmdEval(ctx *Ctx) Reply {
+	if evalKeys.keys(ctx.Args) == nil {
+		return Error("ERR Number of keys can't be greater than number of args")
+	}
+	ctx.Node().loadScript(ctx.Args[1])
+	return ctx.Args[1]
+}
+
+// EVALSHA sha1 numkeys key [key ...] arg [arg ...]
+func cmdEvalsha(ctx *Ctx) Reply {
+	if evalKeys.keys(ctx.Args) == nil {
+		return Error("ERR Number of keys can't be greater than number of args")
+	}
+	n := ctx.Node()
+	n.mu.Lock()
+	body, ok := n.scripts[strings.ToLower(ctx.Arg(1))]
+	n.mu.Unlock()
+	if !ok {
+		return Error("NOSCRIPT No matching script. Please use EVAL.")
+	}
+	return body
+}
+
+// SCRIPT LOAD script | EXISTS sha1 [sha1 ...] | FLUSH [ASYNC|SYNC]
+func cmdScript(ctx *Ctx) Reply {
+	n := ctx.Node()
+	switch sub := strings.ToUpper(ctx.Arg(1)); {
+	case sub == "LOAD" && len(ctx.Args) == 3:
+		return []byte(n.loadScript(ctx.Args[2]))
+	case sub == "EXISTS" && len(ctx.Args) > 2:
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		replies := make([]Reply, 0, len(ctx.Args)-2)
+		for _, sha := range ctx.Args[2:] {
+			if _, ok := n.scripts[strings.ToLower(string(sha))]; ok {
+				replies = append(replies, 1)
+			} else {
+				replies = append(replies, 0)
+			}
+		}
+		return replies
+	case sub == "FLUSH" && len(ctx.Args) <= 3:
+		n.FlushScripts()
+		return OK
+	}
+	return Error("ERR unknown subcommand or wrong number of arguments for '" + ctx.Arg(1) + "'")
+}
@@ -0,0 +1,586 @@
+// Package fakeredis 是测试用的内存 Redis Cluster
+// 每个 Node 监听一个本地端口，支持 CLUSTER NODES、slot 归属、MOVED/ASK、从库和故障注入
+// 所有节点共享同一份数据，节点只处理自己负责的 slot 中的 key
+package fakeredis
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dongzerun/archer/util"
+)
+
+const SlotNum = 16384
+
+type Cluster struct {
+	mu     sync.Mutex
+	nodes  []*Node
+	owners [SlotNum]*Node
+
+	db *DB
+
+	commands map[string]*Command
+	users    map[string]string // 用户名到密码，为空时不需要认证
+}
+
+type Node struct {
+	ID   string // 40 位 node name
+	Addr string // host:port
+
+	cluster *Cluster
+	master  *Node // 从库指向主库，主库为 nil
+	l       net.Listener
+
+	mu        sync.Mutex
+	conns     map[net.Conn]*client
+	failures  []*failure
+	migrating map[int]*Node
+	importing map[int]bool
+	scripts   map[string][]byte // SCRIPT LOAD 和 EVAL 缓存的脚本，每个节点独立
+	stopped   bool
+}
+
+type failure struct {
+	cmd   string
+	reply Reply
+	times int // -1 表示一直生效
+}
+
+// client 是一个客户端连接的状态
+type client struct {
+	node     *Node
+	asking   bool
+	readonly bool
+
+	// 事务状态，只在连接的 goroutine 中读写
+	multi   bool
+	dirty   bool
+	queue   [][][]byte
+	watched map[string]interface{}
+
+	mu       sync.Mutex
+	user     string // 认证的用户，空表示未认证
+	name     string // CLIENT SETNAME
+	channels map[string]bool
+	patterns map[string]bool
+	shards   map[string]bool
+
+	// PUBLISH 从其它连接的 goroutine 写入订阅的客户端，写回复时需要加锁
+	wmu sync.Mutex
+	w   *bufio.Writer
+
+	// 只在 handle 的 goroutine 中使用，阻塞命令用来检查客户端是否断开
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// alive 等待 d 检查客户端是否断开，不会读走后面的请求
+func (cl *client) alive(d time.Duration) bool {
+	cl.conn.SetReadDeadline(time.Now().Add(d))
+	_, err := cl.r.Peek(1)
+	cl.conn.SetReadDeadline(time.Time{})
+	if err == nil {
+		// 客户端 pipeline 了后面的请求
+		time.Sleep(d)
+		return true
+	}
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+func (cl *client) authUser() string {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.user
+}
+
+// NewCluster 启动 masters 个主库，每个主库 replicas 个从库，slot 平均分配
+func NewCluster(masters, replicas int) (*Cluster, error) {
+	c := &Cluster{
+		db:       NewDB(),
+		commands: make(map[string]*Command),
+	}
+	for name, cmd := range builtin {
+		c.commands[name] = cmd
+	}
+
+	for i := 0; i < masters; i++ {
+		m, err := c.startNode(nil)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		start, stop := i*SlotNum/masters, (i+1)*SlotNum/masters
+		for s := start; s < stop; s++ {
+			c.owners[s] = m
+		}
+		for j := 0; j < replicas; j++ {
+			if _, err := c.startNode(m); err != nil {
+				c.Close()
+				return nil, err
+			}
+		}
+	}
+	return c, nil
+}
+
+func (c *Cluster) startNode(master *Node) (*Node, error) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 20)
+	rand.Read(id)
+	n := &Node{
+		ID:        hex.EncodeToString(id),
+		Addr:      l.Addr().String(),
+		cluster:   c,
+		master:    master,
+		l:         l,
+		conns:     make(map[net.Conn]*client),
+		migrating: make(map[int]*Node),
+		importing: make(map[int]bool),
+		scripts:   make(map[string][]byte),
+	}
+	c.mu.Lock()
+	c.nodes = append(c.nodes, n)
+	c.mu.Unlock()
+	go n.serve()
+	return n, nil
+}
+
+// Addrs 返回所有主库地址，用于 proxy 的 nodes 配置
+func (c *Cluster) Addrs() []string {
+	var addrs []string
+	for _, n := range c.Masters() {
+		addrs = append(addrs, n.Addr)
+	}
+	return addrs
+}
+
+func (c *Cluster) Nodes() []*Node {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*Node(nil), c.nodes...)
+}
+
+func (c *Cluster) Masters() []*Node {
+	var ms []*Node
+	for _, n := range c.Nodes() {
+		if n.master == nil {
+			ms = append(ms, n)
+		}
+	}
+	return ms
+}
+
+// Replicas 返回主库 m 的从库
+func (c *Cluster) Replicas(m *Node) []*Node {
+	var rs []*Node
+	for _, n := range c.Nodes() {
+		if n.master == m {
+			rs = append(rs, n)
+		}
+	}
+	return rs
+}
+
+func (c *Cluster) DB() *DB {
+	return c.db
+}
+
+// Owner 返回负责 slot 的主库
+func (c *Cluster) Owner(slot int) *Node {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.owners[slot]
+}
+
+func (c *Cluster) NodeForKey(key string) *Node {
+	return c.Owner(Slot(key))
+}
+
+// MoveSlot 把 slot 迁移给 to，相当于迁移完成，原节点之后回复 MOVED
+func (c *Cluster) MoveSlot(slot int, to *Node) {
+	c.mu.Lock()
+	from := c.owners[slot]
+	c.owners[slot] = to
+	c.mu.Unlock()
+
+	from.mu.Lock()
+	delete(from.migrating, slot)
+	from.mu.Unlock()
+	to.mu.Lock()
+	delete(to.importing, slot)
+	to.mu.Unlock()
+}
+
+// SetMigrating 把 slot 标记为从当前主库迁移到 to
+// 当前主库上不存在的 key 回复 ASK，to 只接受 ASKING 之后的请求
+func (c *Cluster) SetMigrating(slot int, to *Node) {
+	from := c.Owner(slot)
+	from.mu.Lock()
+	from.migrating[slot] = to
+	from.mu.Unlock()
+	to.mu.Lock()
+	to.importing[slot] = true
+	to.mu.Unlock()
+}
+
+// Handle 注册或者覆盖一个命令
+func (c *Cluster) Handle(name string, cmd *Command) {
+	c.mu.Lock()
+	c.commands[strings.ToUpper(name)] = cmd
+	c.mu.Unlock()
+}
+
+// SetUser 添加用户，之后所有连接必须先 AUTH，user 为 default 时相当于 requirepass
+func (c *Cluster) SetUser(user, password string) {
+	c.mu.Lock()
+	if c.users == nil {
+		c.users = make(map[string]string)
+	}
+	c.users[user] = password
+	c.mu.Unlock()
+}
+
+// authenticate 校验用户名和密码，没有设置用户时总是成功
+func (c *Cluster) authenticate(user, password string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pass, ok := c.users[user]
+	return ok && pass == password
+}
+
+func (c *Cluster) requireAuth() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.users) > 0
+}
+
+func (c *Cluster) command(name string) *Command {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.commands[name]
+}
+
+func (c *Cluster) Close() {
+	for _, n := range c.Nodes() {
+		n.Stop()
+	}
+}
+
+// Slot 计算 key 所属的 slot，Crc16sum 已经处理了 hash tag
+func Slot(key string) int {
+	return int(util.Crc16sum([]byte(key)) % SlotNum)
+}
+
+func (n *Node) IsMaster() bool {
+	return n.master == nil
+}
+
+func (n *Node) Master() *Node {
+	return n.master
+}
+
+// InjectError 让接下来 times 次 cmd 命令直接回复 reply，times 为 -1 时一直生效
+// cmd 为 "*" 匹配所有命令
+func (n *Node) InjectError(cmd string, reply string, times int) {
+	n.inject(cmd, Error(reply), times)
+}
+
+func (n *Node) inject(cmd string, reply Reply, times int) {
+	n.mu.Lock()
+	n.failures = append(n.failures, &failure{
+		cmd:   strings.ToUpper(cmd),
+		reply: reply,
+		times: times,
+	})
+	n.mu.Unlock()
+}
+
+// ClearFailures 清除所有注入的故障
+func (n *Node) ClearFailures() {
+	n.mu.Lock()
+	n.failures = nil
+	n.mu.Unlock()
+}
+
+// Stop 关闭监听和所有客户端连接，模拟节点宕机
+func (n *Node) Stop() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		return
+	}
+	n.stopped = true
+	n.l.Close()
+	for c := range n.conns {
+		c.Close()
+	}
+}
+
+// DropConns 关闭所有客户端连接，节点继续服务
+func (n *Node) DropConns() {
+	n.mu.Lock()
+	for c := range n.conns {
+		c.Close()
+	}
+	n.mu.Unlock()
+}
+
+// ClientNames 返回当前连接的 CLIENT SETNAME 名字，没有设置的为空字符串
+func (n *Node) ClientNames() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	names := make([]string, 0, len(n.conns))
+	for _, cl := range n.conns {
+		cl.mu.Lock()
+		names = append(names, cl.name)
+		cl.mu.Unlock()
+	}
+	return names
+}
+
+// ReadOnlyClients 返回发送过 READONLY 的连接数
+func (n *Node) ReadOnlyClients() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	count := 0
+	for _, cl := range n.conns {
+		cl.mu.Lock()
+		if cl.readonly {
+			count++
+		}
+		cl.mu.Unlock()
+	}
+	return count
+}
+
+func (n *Node) serve() {
+	for {
+		c, err := n.l.Accept()
+		if err != nil {
+			return
+		}
+		n.mu.Lock()
+		if n.stopped {
+			n.mu.Unlock()
+			c.Close()
+			return
+		}
+		cl := &client{node: n}
+		n.conns[c] = cl
+		n.mu.Unlock()
+		go n.handle(c, cl)
+	}
+}
+
+func (n *Node) handle(c net.Conn, cl *client) {
+	defer func() {
+		n.mu.Lock()
+		delete(n.conns, c)
+		n.mu.Unlock()
+		c.Close()
+	}()
+
+	r := bufio.NewReader(c)
+	w := bufio.NewWriter(c)
+	cl.conn, cl.r = c, r
+	cl.wmu.Lock()
+	cl.w = w
+	cl.wmu.Unlock()
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		reply := n.exec(cl, args)
+		cl.wmu.Lock()
+		if reply == errQuit {
+			writeReply(w, OK)
+			w.Flush()
+			cl.wmu.Unlock()
+			return
+		}
+		writeReply(w, reply)
+		// pipeline 中的请求处理完再 Flush
+		if r.Buffered() == 0 {
+			err = w.Flush()
+		}
+		cl.wmu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+var errQuit = Error("QUIT")
+
+func (n *Node) exec(cl *client, args [][]byte) Reply {
+	name := strings.ToUpper(string(args[0]))
+	if reply := n.failure(name); reply != nil {
+		if cl.multi && !txCommands[name] {
+			cl.dirty = true
+		}
+		return reply
+	}
+
+	cmd, reply := n.prepare(cl, name, args)
+	// MULTI 之后命令入队，入队失败时 EXEC 回复 EXECABORT
+	if cl.multi && !txCommands[name] {
+		if reply != nil {
+			cl.dirty = true
+			return reply
+		}
+		cl.queue = append(cl.queue, args)
+		return Status("QUEUED")
+	}
+	if reply != nil {
+		return reply
+	}
+	if !subscribeCommands[name] && cl.subscribed() {
+		return Error(fmt.Sprintf("ERR Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context", strings.ToLower(name)))
+	}
+	return cmd.Func(&Ctx{cluster: n.cluster, node: n, client: cl, Args: args})
+}
+
+// prepare 检查命令、认证、参数个数和 slot
+func (n *Node) prepare(cl *client, name string, args [][]byte) (*Command, Reply) {
+	cmd := n.cluster.command(name)
+	if cmd == nil {
+		return nil, Error(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	}
+	if name != "AUTH" && name != "QUIT" && cl.authUser() == "" && n.cluster.requireAuth() {
+		return nil, Error("NOAUTH Authentication required.")
+	}
+	if cmd.Arity > 0 && len(args) != cmd.Arity || cmd.Arity < 0 && len(args) < -cmd.Arity {
+		return nil, Error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+	}
+
+	asking := cl.asking
+	cl.asking = false
+	if keys := cmd.keys(args); len(keys) > 0 {
+		if reply := n.checkSlot(keys, asking, cl.readonly && cmd.ReadOnly); reply != nil {
+			return nil, reply
+		}
+	}
+	return cmd, nil
+}
+
+func (n *Node) failure(name string) Reply {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for i, f := range n.failures {
+		if f.cmd != "*" && f.cmd != name {
+			continue
+		}
+		if f.times > 0 {
+			f.times--
+			if f.times == 0 {
+				n.failures = append(n.failures[:i], n.failures[i+1:]...)
+			}
+		}
+		return f.reply
+	}
+	return nil
+}
+
+// checkSlot 检查 key 是否由当前节点负责，不是的话返回 MOVED 或者 ASK
+// 从库只在 READONLY 之后处理主库 slot 的只读命令
+func (n *Node) checkSlot(keys [][]byte, asking, readonly bool) Reply {
+	slot := Slot(string(keys[0]))
+	for _, k := range keys[1:] {
+		if Slot(string(k)) != slot {
+			return Error("CROSSSLOT Keys in request don't hash to the same slot")
+		}
+	}
+
+	owner := n.cluster.Owner(slot)
+	if owner == nil {
+		return Error(fmt.Sprintf("CLUSTERDOWN Hash slot %d not served", slot))
+	}
+
+	n.mu.Lock()
+	target := n.migrating[slot]
+	importing := n.importing[slot]
+	n.mu.Unlock()
+
+	switch {
+	case owner == n && target != nil:
+		// 迁移中的 slot，本地不存在的 key 转到目标节点
+		for _, k := range keys {
+			if !n.cluster.db.Exists(string(k)) {
+				return Error(fmt.Sprintf("ASK %d %s", slot, target.Addr))
+			}
+		}
+	case owner == n:
+	case importing && asking:
+	case readonly && owner == n.master:
+	default:
+		return Error(fmt.Sprintf("MOVED %d %s", slot, owner.Addr))
+	}
+	return nil
+}
+
+// clusterNodes 生成 CLUSTER NODES 的输出，格式和 Redis 7 一致
+func (c *Cluster) clusterNodes(myself *Node) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var b strings.Builder
+	for _, n := range c.nodes {
+		flags := "master"
+		master := "-"
+		if n.master != nil {
+			flags = "slave"
+			master = n.master.ID
+		}
+		if n == myself {
+			flags = "myself," + flags
+		}
+		if n.stopped {
+			flags += ",fail"
+		}
+		_, port, _ := net.SplitHostPort(n.Addr)
+		fmt.Fprintf(&b, "%s %s@1%s %s %s 0 0 1 connected", n.ID, n.Addr, port, flags, master)
+		if n.master == nil {
+			for _, r := range slotRanges(c.owners[:], n) {
+				b.WriteString(" ")
+				b.WriteString(r)
+			}
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func slotRanges(owners []*Node, n *Node) []string {
+	var ranges []string
+	for i := 0; i < len(owners); {
+		if owners[i] != n {
+			i++
+			continue
+		}
+		j := i
+		for j+1 < len(owners) && owners[j+1] == n {
+			j++
+		}
+		if i == j {
+			ranges = append(ranges, fmt.Sprintf("%d", i))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", i, j))
+		}
+		i = j + 1
+	}
+	return ranges
+}
@@ -0,0 +1,159 @@
+package fakeredis
+
+import "sort"
+
+// set 调用前需要加锁
+func (db *DB) set(key string, create bool) (map[string]struct{}, Reply) {
+	switch v := db.data[key].(type) {
+	case nil:
+		s := make(map[string]struct{})
+		if create {
+			db.data[key] = s
+		}
+		return s, nil
+	case map[string]struct{}:
+		return v, nil
+	}
+	return nil, errWrongType
+}
+
+// members 按字典序返回，方便测试比较
+func members(s map[string]struct{}) []Reply {
+	ms := make([]string, 0, len(s))
+	for m := range s {
+		ms = append(ms, m)
+	}
+	sort.Strings(ms)
+	rs := make([]Reply, len(ms))
+	for i, m := range ms {
+		rs[i] = []byte(m)
+	}
+	return rs
+}
+
+func cmdSadd(ctx *Ctx) Reply {
+	db := ctx.DB()
+	db.Lock()
+	defer db.Unlock()
+	s, err := db.set(ctx.Arg(1), true)
+	if err != nil {
+		return err
+	}
+	n := 0
+	for _, m := range ctx.Args[2:] {
+		if _, ok := s[string(m)]; !ok {
+			s[string(m)] = struct{}{}
+			n++
+		}
+	}
+	return n
+}
+
+func cmdSrem(ctx *Ctx) Reply {
+	db := ctx.DB()
+	db.Lock()
+	defer db.Unlock()
+	s, err := db.set(ctx.Arg(1), false)
+	if err != nil {
+		return err
+	}
+	n := 0
+	for _, m := range ctx.Args[2:] {
+		if _, ok := s[string(m)]; ok {
+			delete(s, string(m))
+			n++
+		}
+	}
+	if len(s) == 0 {
+		delete(db.data, ctx.Arg(1))
+	}
+	return n
+}
+
+func cmdSmembers(ctx *Ctx) Reply {
+	db := ctx.DB()
+	db.Lock()
+	defer db.Unlock()
+	s, err := db.set(ctx.Arg(1), false)
+	if err != nil {
+		return err
+	}
+	return members(s)
+}
+
+func cmdScard(ctx *Ctx) Reply {
+	db := ctx.DB()
+	db.Lock()
+	defer db.Unlock()
+	s, err := db.set(ctx.Arg(1), false)
+	if err != nil {
+		return err
+	}
+	return len(s)
+}
+
+// setOp 计算 SINTER SUNION SDIFF，调用前需要加锁
+func setOp(db *DB, op string, keys [][]byte) (map[string]struct{}, Reply) {
+	var result map[string]struct{}
+	for i, k := range keys {
+		s, err := db.set(string(k), false)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			result = make(map[string]struct{}, len(s))
+			for m := range s {
+				result[m] = struct{}{}
+			}
+			continue
+		}
+		switch op {
+		case "SUNION":
+			for m := range s {
+				result[m] = struct{}{}
+			}
+		case "SINTER":
+			for m := range result {
+				if _, ok := s[m]; !ok {
+					delete(result, m)
+				}
+			}
+		case "SDIFF":
+			for m := range s {
+				delete(result, m)
+			}
+		}
+	}
+	return result, nil
+}
+
+func cmdSetOp(op string) func(ctx *Ctx) Reply {
+	return func(ctx *Ctx) Reply {
+		db := ctx.DB()
+		db.Lock()
+		defer db.Unlock()
+		s, err := setOp(db, op, ctx.Args[1:])
+		if err != nil {
+			return err
+		}
+		return members(s)
+	}
+}
+
+func cmdSetOpStore(op string) func(ctx *Ctx) Reply {
+	return func(ctx *Ctx) Reply {
+		db := ctx.DB()
+		db.Lock()
+		defer db.Unlock()
+		s, err := setOp(db, op, ctx.Args[2:])
+		if err != nil {
+			return err
+		}
+		if len(s) == 0 {
+			delete(db.data, ctx.Arg(1))
+		} else {
+			db.data[ctx.Arg(1)] = s
+		}
+		return len(s)
+	}
+}
@@ -0,0 +1,146 @@
+package fakeredis
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// zset 调用前需要加锁
+func (db *DB) zset(key string, create bool) (map[string]float64, Reply) {
+	switch v := db.data[key].(type) {
+	case nil:
+		z := make(map[string]float64)
+		if create {
+			db.data[key] = z
+		}
+		return z, nil
+	case map[string]float64:
+		return v, nil
+	}
+	return nil, errWrongType
+}
+
+// FormatScore 和 Redis 一样输出最短的表示，无穷大输出 inf -inf
+func FormatScore(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func parseScore(s string) (float64, bool) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, false
+	}
+	return f, true
+}
+
+// ZADD key score member [score member ...]，不支持 NX XX 等选项
+func cmdZadd(ctx *Ctx) Reply {
+	if len(ctx.Args)%2 != 0 {
+		return errSyntax
+	}
+	db := ctx.DB()
+	db.Lock()
+	defer db.Unlock()
+	z, err := db.zset(ctx.Arg(1), true)
+	if err != nil {
+		return err
+	}
+	n := 0
+	for i := 2; i < len(ctx.Args); i += 2 {
+		f, ok := parseScore(ctx.Arg(i))
+		if !ok {
+			return Error("ERR value is not a valid float")
+		}
+		if _, ok := z[ctx.Arg(i+1)]; !ok {
+			n++
+		}
+		z[ctx.Arg(i+1)] = f
+	}
+	return n
+}
+
+func cmdZcard(ctx *Ctx) Reply {
+	db := ctx.DB()
+	db.Lock()
+	defer db.Unlock()
+	z, err := db.zset(ctx.Arg(1), false)
+	if err != nil {
+		return err
+	}
+	return len(z)
+}
+
+func cmdZscore(ctx *Ctx) Reply {
+	db := ctx.DB()
+	db.Lock()
+	defer db.Unlock()
+	z, err := db.zset(ctx.Arg(1), false)
+	if err != nil {
+		return err
+	}
+	if f, ok := z[ctx.Arg(2)]; ok {
+		return FormatScore(f)
+	}
+	return []byte(nil)
+}
+
+// ZRANGE key start stop [WITHSCORES]，只支持按下标
+func cmdZrange(ctx *Ctx) Reply {
+	start, err1 := strconv.Atoi(ctx.Arg(2))
+	stop, err2 := strconv.Atoi(ctx.Arg(3))
+	if err1 != nil || err2 != nil {
+		return errNotInt
+	}
+	withScores := len(ctx.Args) == 5 && strings.EqualFold(ctx.Arg(4), "WITHSCORES")
+	if len(ctx.Args) > 5 || len(ctx.Args) == 5 && !withScores {
+		return errSyntax
+	}
+
+	db := ctx.DB()
+	db.Lock()
+	defer db.Unlock()
+	z, err := db.zset(ctx.Arg(1), false)
+	if err != nil {
+		return err
+	}
+	ms := make([]string, 0, len(z))
+	for m := range z {
+		ms = append(ms, m)
+	}
+	sort.Slice(ms, func(i, j int) bool {
+		if z[ms[i]] != z[ms[j]] {
+			return z[ms[i]] < z[ms[j]]
+		}
+		return ms[i] < ms[j]
+	})
+
+	n := len(ms)
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	rs := []Reply{}
+	for i := start; i <= stop; i++ {
+		rs = append(rs, []byte(ms[i]))
+		if withScores {
+			rs = append(rs, FormatScore(z[ms[i]]))
+		}
+	}
+	return rs
+}
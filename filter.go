@@ -2,8 +2,9 @@ package archer
 
 import (
 	"errors"
+	"strings"
+
 	"github.com/dongzerun/archer/hack"
-	"github.com/dongzerun/archer/util"
 )
 
 var (
@@ -22,7 +23,13 @@ type Filter interface {
 	Inspect(Resp) (string, error)
 }
 
+// StrFilter 按命令名查表，policies 来自配置文件，可以为空
 type StrFilter struct {
+	policies map[string]*CommandPolicy
+}
+
+func NewStrFilter(policies map[string]*CommandPolicy) *StrFilter {
+	return &StrFilter{policies: policies}
 }
 
 func (s *StrFilter) Inspect(r Resp) (string, error) {
@@ -31,41 +38,143 @@ func (s *StrFilter) Inspect(r Resp) (string, error) {
 		return "", InspectArgWrong
 	}
 
-	cmd := hack.String(util.UpperSlice(ar.Args[0].Args[0]))
+	// 命令必须是 BulkResp 数组
+	if !ar.IsCommand() {
+		return "", BadCommandError
+	}
 
-	l := ar.Length() + 1
+	// 大小写不敏感查表，不修改请求
+	ci := LookupCommand(ar.Arg(0))
+	if ci == nil {
+		return "", BadCommandError
+	}
 
-	// 黑名单
-	if _, ok := blackList[cmd]; ok {
-		return "", CommandForbidden
+	if err := inspect(ar, ci, s.policies[ci.Name], blackList[ci.Name]); err != nil {
+		return "", err
 	}
+	return ci.Name, nil
+}
 
-	// 规则检查，参数数量
-	rule, exists := reqrules[cmd]
-	if !exists {
-		return "", BadCommandError
+// inspect 是 StrFilter 和 TrieFilter 共用的检查，不修改请求
+// 依次检查参数个数、配置中的 deny、子命令或者黑名单、key 的位置
+// subcommands 中的命令只允许列出的子命令，优先于黑名单
+func inspect(ar *ArrayResp, ci *CommandInfo, pol *CommandPolicy, black bool) error {
+	if !pol.CheckArity(ci, ar.Length()+1) {
+		return WrongArgumentCount
 	}
 
-	for i, count := 0, len(rule); i < count; i++ {
-		switch i {
-		case RI_MinCount:
-			if val := rule[i].(int); val != -1 && l < val {
-				return "", WrongArgumentCount
-			}
-		case RI_MaxCount:
-			if val := rule[i].(int); val != -1 && l > val {
-				return "", WrongArgumentCount
-			}
+	if subs, ok := subcommands[ci.Name]; ok && (pol == nil || !pol.Deny) {
+		if !allowSubcommand(subs, ar.Arg(1)) {
+			return CommandForbidden
 		}
+	} else if err := pol.check(black); err != nil {
+		return err
 	}
 
-	return cmd, nil
+	// key 位置无法解析的命令无法路由
+	if _, err := ci.KeyIndexes(ar); err != nil {
+		return WrongCommandKey
+	}
+	return nil
+}
+
+// allowSubcommand 大小写不敏感匹配子命令
+func allowSubcommand(subs []string, sub []byte) bool {
+	for _, s := range subs {
+		if strings.EqualFold(s, hack.String(sub)) {
+			return true
+		}
+	}
+	return false
 }
 
+// TrieFilter 用 trie 匹配命令名，大小写不敏感，不修改客户端的请求
+// 返回的命令名是命令表中的大写名字，不引用请求的 []byte
 type TrieFilter struct {
+	root *trieNode
+}
+
+type trieNode struct {
+	labels   []byte
+	children []*trieNode
+
+	info   *CommandInfo
+	black  bool           // 黑名单
+	policy *CommandPolicy // 配置中的策略
+}
+
+func NewTrieFilter(commands map[string]*CommandInfo, black map[string]bool, policies map[string]*CommandPolicy) *TrieFilter {
+	root := &trieNode{}
+	for name, ci := range commands {
+		n := root.insert(name)
+		n.info = ci
+		n.black = black[name]
+		n.policy = policies[name]
+	}
+	return &TrieFilter{root: root}
+}
+
+func (n *trieNode) insert(key string) *trieNode {
+	for i := 0; i < len(key); i++ {
+		b := upper(key[i])
+		next := n.child(b)
+		if next == nil {
+			next = &trieNode{}
+			n.labels = append(n.labels, b)
+			n.children = append(n.children, next)
+		}
+		n = next
+	}
+	return n
 }
 
-func (t *TrieFilter) Inspect(r Resp) error {
-	panic("currently Trie Not Implemented")
+func (n *trieNode) child(b byte) *trieNode {
+	for i, l := range n.labels {
+		if l == b {
+			return n.children[i]
+		}
+	}
 	return nil
 }
+
+// lookup 大小写不敏感查找，不存在返回 nil
+func (n *trieNode) lookup(key []byte) *trieNode {
+	for _, b := range key {
+		if n = n.child(upper(b)); n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+func (t *TrieFilter) Inspect(r Resp) (string, error) {
+	ar, ok := r.(*ArrayResp)
+	if !ok {
+		return "", InspectArgWrong
+	}
+
+	// 命令必须是 BulkResp 数组
+	if !ar.IsCommand() {
+		return "", BadCommandError
+	}
+
+	n := t.root.lookup(ar.Arg(0))
+	if n == nil || n.info == nil {
+		return "", BadCommandError
+	}
+
+	if err := inspect(ar, n.info, n.policy, n.black); err != nil {
+		return "", err
+	}
+	return n.info.Name, nil
+}
+
+// NewFilter 按配置选择过滤器，str 或者 trie
+func NewFilter(name string, policies map[string]*CommandPolicy) Filter {
+	switch name {
+	case "trie":
+		return NewTrieFilter(commandTable, blackList, policies)
+	default:
+		return NewStrFilter(policies)
+	}
+}
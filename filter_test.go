@@ -0,0 +1,54 @@
+package archer
+
+import (
+	"testing"
+)
+
+var filterCases = map[string]error{
+	"get foo":              nil,
+	"GeT foo":              nil,
+	"GET":                  WrongArgumentCount,
+	"GETX foo":             BadCommandError,
+	"GE foo":               BadCommandError,
+	"KEYS *":               CommandForbidden,
+	"client setname conn1": nil,
+	"CLIENT GETNAME":       nil,
+	"CLIENT KILL 1.1.1.1":  CommandForbidden,
+	"CLIENT":               WrongArgumentCount,
+	"OBJECT encoding foo":  nil,
+	"OBJECT HELP":          CommandForbidden,
+	"EVAL s 1":             WrongCommandKey,
+}
+
+func testFilter(t *testing.T, f Filter) {
+	for line, want := range filterCases {
+		if _, err := f.Inspect(newTestCommand(line)); err != want {
+			t.Fatalf("%s got %v want %v", line, err, want)
+		}
+	}
+
+	// 返回大写的命令名，不修改请求
+	req := newTestCommand("hgetall h")
+	cmd, err := f.Inspect(req)
+	if err != nil || cmd != "HGETALL" || string(req.Arg(0)) != "hgetall" {
+		t.Fatalf("got %s %v arg %s", cmd, err, req.Arg(0))
+	}
+}
+
+func Test_TrieFilter(t *testing.T) {
+	testFilter(t, NewFilter("trie", nil))
+}
+
+// 两种过滤器的子命令规则和结果相同
+func Test_StrFilter(t *testing.T) {
+	testFilter(t, NewFilter("str", nil))
+}
+
+func Benchmark_TrieFilter(b *testing.B) {
+	f := NewFilter("trie", nil)
+	req := newTestCommand("zrangebyscore key 0 1")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		f.Inspect(req)
+	}
+}
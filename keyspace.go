@@ -0,0 +1,95 @@
+package archer
+
+import (
+	"bytes"
+	"math/rand"
+	"strconv"
+
+	"github.com/dongzerun/archer/hack"
+	log "github.com/ngaut/logging"
+)
+
+// Keyspace 把 KEYS DBSIZE RANDOMKEY FLUSHDB FLUSHALL 发给所有主库并合并回复
+// 这些命令默认在 blackList 中，需要在 [commands] 中单独配置 allow，例如 dbsize=allow
+// 也可以用 ACL 的 -@dangerous 禁止普通用户执行 KEYS FLUSHDB FLUSHALL
+func (s *Session) Keyspace(req *ArrayResp, seq int64) {
+	defer func() {
+		s.conCurrency <- 1
+	}()
+
+	masters := s.p.cluster.topo.Masters()
+	ids := make([]string, len(masters))
+	for i, m := range masters {
+		ids[i] = m.id
+	}
+
+	name := commandOf(req).Name
+	if name == "RANDOMKEY" {
+		s.resps <- WrappedResp(s.randomKey(ids, req), seq)
+		return
+	}
+
+	resps := s.broadcast(ids, req)
+	for _, r := range resps {
+		if er, ok := r.(*ErrorResp); ok {
+			s.resps <- WrappedResp(er, seq)
+			return
+		}
+	}
+
+	switch name {
+	case "KEYS":
+		keys := NewArrayResp()
+		for _, r := range resps {
+			ar, ok := r.(*ArrayResp)
+			if !ok {
+				s.keyspaceFailed(name, r, seq)
+				return
+			}
+			keys.Args = append(keys.Args, ar.Args...)
+		}
+		s.resps <- WrappedResp(keys, seq)
+	case "DBSIZE":
+		var sum int64
+		for _, r := range resps {
+			ir, ok := r.(*IntResp)
+			if !ok {
+				s.keyspaceFailed(name, r, seq)
+				return
+			}
+			n, err := strconv.ParseInt(hack.String(ir.Args[0]), 10, 64)
+			if err != nil {
+				s.keyspaceFailed(name, r, seq)
+				return
+			}
+			sum += n
+		}
+		s.resps <- WrappedResp(NewIntResp(int(sum)), seq)
+	default:
+		for _, r := range resps {
+			if sr, ok := r.(*SimpleResp); !ok || !bytes.Equal(sr.Args[0], OK) {
+				s.keyspaceFailed(name, r, seq)
+				return
+			}
+		}
+		s.resps <- WrappedOKResp(seq)
+	}
+}
+
+func (s *Session) keyspaceFailed(name string, r Resp, seq int64) {
+	log.Warning("Session ", name, " wrong reply ", r.String())
+	s.resps <- WrappedErrorResp([]byte("proxy internal "+name+" failed"), seq)
+}
+
+// randomKey 按随机顺序询问主库，返回第一个不为空的结果，所有主库都为空时返回 nil
+func (s *Session) randomKey(ids []string, req *ArrayResp) Resp {
+	resp := Resp(NewBulkResp(nil))
+	for _, i := range rand.Perm(len(ids)) {
+		resp = s.broadcast(ids[i:i+1], req)[0]
+		if br, ok := resp.(*BulkResp); ok && br.Empty {
+			continue
+		}
+		return resp
+	}
+	return resp
+}
@@ -0,0 +1,296 @@
+package archer
+
+import (
+	"bytes"
+
+	"github.com/dongzerun/archer/util"
+	log "github.com/ngaut/logging"
+)
+
+var (
+	NestedMultiError    = []byte("ERR MULTI calls can not be nested")
+	ExecNoMultiError    = []byte("ERR EXEC without MULTI")
+	DiscardNoMultiError = []byte("ERR DISCARD without MULTI")
+	WatchInMultiError   = []byte("ERR WATCH inside MULTI is not allowed")
+	ExecAbortError      = []byte("EXECABORT Transaction discarded because of previous errors.")
+	NotInMultiError     = []byte("ERR command not allowed inside MULTI through proxy")
+)
+
+// 事务相关的命令，总是由 Transaction 处理
+var txCommands = map[string]bool{
+	"MULTI":   true,
+	"EXEC":    true,
+	"DISCARD": true,
+	"WATCH":   true,
+	"UNWATCH": true,
+}
+
+// transaction 是 Session 的事务状态，只在 Dispatch 中读写
+// 事务中所有的 key 必须在同一个 slot，第一个 key 确定 slot 之后固定一个后端连接
+// 之后的命令在 Dispatch 中同步转发到这个连接，EXEC DISCARD UNWATCH 或者出错之后释放
+type transaction struct {
+	conn    *RedisConn   // 固定的后端连接
+	slot    int          // 事务中 key 所在的 slot，-1 表示还没有 key
+	multi   bool         // 已经收到 MULTI
+	sent    bool         // MULTI 已经发给后端
+	dirty   bool         // proxy 拒绝了入队的命令，EXEC 回复 EXECABORT
+	pending []*ArrayResp // 固定连接之前入队的无 key 命令
+}
+
+// Transaction 处理事务命令和 MULTI 之后的命令，返回 false 表示请求需要按正常流程处理
+func (s *Session) Transaction(command string, req *ArrayResp, seq int64) bool {
+	if !txCommands[command] && (s.tx == nil || !s.tx.multi) {
+		return false
+	}
+	if command == "QUIT" {
+		return false
+	}
+	if err := req.Materialize(); err != nil {
+		if s.tx != nil && s.tx.multi {
+			s.tx.dirty = true
+		}
+		Release(req)
+		s.resps <- WrappedErrorResp([]byte(err.Error()), seq)
+		return true
+	}
+	if !txCommands[command] || command == "UNWATCH" && s.tx.multi {
+		s.queueTx(command, req, seq)
+		return true
+	}
+
+	var resp Resp
+	switch command {
+	case "MULTI":
+		resp = s.multi()
+	case "EXEC":
+		resp = s.exec()
+	case "DISCARD":
+		resp = s.discard()
+	case "WATCH":
+		resp = s.watch(req)
+	case "UNWATCH":
+		resp = s.unwatch()
+	}
+	Release(req)
+	s.resps <- WrappedResp(resp, seq)
+	return true
+}
+
+func (s *Session) multi() Resp {
+	if s.tx == nil {
+		s.tx = &transaction{slot: -1}
+	}
+	if s.tx.multi {
+		return NewErrorResp(NestedMultiError)
+	}
+	s.tx.multi = true
+	// WATCH 之后已经固定了连接，直接发送 MULTI
+	if s.tx.conn != nil {
+		resp := s.txCall(NewCommand([]byte("MULTI")))
+		if s.tx != nil {
+			s.tx.sent = true
+		}
+		return resp
+	}
+	return NewSimpleResp(OK)
+}
+
+func (s *Session) exec() Resp {
+	tx := s.tx
+	if tx == nil || !tx.multi {
+		return NewErrorResp(ExecNoMultiError)
+	}
+	if tx.dirty {
+		if tx.sent {
+			s.txCall(NewCommand([]byte("DISCARD")))
+		}
+		s.releaseTx(tx.sent || tx.conn == nil)
+		return NewErrorResp(ExecAbortError)
+	}
+	// 没有 key 的事务发到 slot 0 所在的节点
+	if tx.conn == nil {
+		if er := s.pinTx(nil); er != nil {
+			return er
+		}
+	}
+	resp := s.txCall(NewCommand([]byte("EXEC")))
+	if s.tx != nil {
+		s.releaseTx(true)
+	}
+	return resp
+}
+
+func (s *Session) discard() Resp {
+	tx := s.tx
+	if tx == nil || !tx.multi {
+		return NewErrorResp(DiscardNoMultiError)
+	}
+	if tx.sent {
+		// DISCARD 同时取消 WATCH
+		s.txCall(NewCommand([]byte("DISCARD")))
+	} else if tx.conn != nil {
+		s.txCall(NewCommand([]byte("UNWATCH")))
+	}
+	if s.tx != nil {
+		s.releaseTx(true)
+	}
+	return NewSimpleResp(OK)
+}
+
+func (s *Session) watch(req *ArrayResp) Resp {
+	if s.tx == nil {
+		s.tx = &transaction{slot: -1}
+	}
+	if s.tx.multi {
+		s.tx.dirty = true
+		return NewErrorResp(WatchInMultiError)
+	}
+	if er := s.checkTxSlot(commandTable["WATCH"], req); er != nil {
+		if s.tx != nil && s.tx.conn == nil {
+			s.tx = nil
+		}
+		return er
+	}
+	return s.txCall(req)
+}
+
+func (s *Session) unwatch() Resp {
+	if s.tx == nil {
+		return NewSimpleResp(OK)
+	}
+	if s.tx.conn != nil {
+		if resp := s.txCall(NewCommand([]byte("UNWATCH"))); s.tx == nil {
+			return resp
+		}
+	}
+	s.releaseTx(true)
+	return NewSimpleResp(OK)
+}
+
+// queueTx MULTI 之后的命令，proxy 拒绝的命令回复错误并且让 EXEC 失败
+func (s *Session) queueTx(command string, req *ArrayResp, seq int64) {
+	reply := func(resp Resp) {
+		Release(req)
+		s.resps <- WrappedResp(resp, seq)
+	}
+
+	ci := commandTable[command]
+	idx, _ := ci.KeyIndexes(req)
+	// 需要 proxy 拆分或者发给所有节点的无 key 命令不能放在事务中
+	if len(idx) == 0 && specList[command] && command != "PING" || ci.Has(FlagPubSub) {
+		s.tx.dirty = true
+		reply(NewErrorResp(NotInMultiError))
+		return
+	}
+	if er := s.checkTxSlot(ci, req); er != nil {
+		// 获取连接失败时事务已经结束
+		if s.tx != nil {
+			s.tx.dirty = true
+		}
+		reply(er)
+		return
+	}
+
+	// 还没有固定连接，先在 proxy 中排队，请求在发给后端之后回收
+	if s.tx.conn == nil {
+		s.tx.pending = append(s.tx.pending, req)
+		s.resps <- WrappedResp(NewSimpleResp([]byte("QUEUED")), seq)
+		return
+	}
+	reply(s.txCall(req))
+}
+
+// checkTxSlot 检查 key 和事务的 slot 一致，第一个 key 确定 slot 并固定连接
+func (s *Session) checkTxSlot(ci *CommandInfo, req *ArrayResp) *ErrorResp {
+	idx, err := ci.KeyIndexes(req)
+	if err != nil {
+		return NewErrorResp([]byte(err.Error()))
+	}
+	if len(idx) == 0 {
+		return nil
+	}
+	if !sameSlot(ci, req) {
+		return NewErrorResp([]byte(CrossSlotError.Error()))
+	}
+	key := req.Arg(idx[0])
+	slot := int(util.Crc16sum(key) % 16384)
+	if s.tx.slot >= 0 && s.tx.slot != slot {
+		return NewErrorResp([]byte(CrossSlotError.Error()))
+	}
+	if s.tx.conn == nil {
+		s.tx.slot = slot
+		return s.pinTx(key)
+	}
+	return nil
+}
+
+// pinTx 从事务连接池获取 key 所在主库的连接，已经收到 MULTI 时把 MULTI 和排队的命令一起发送
+// 事务连接池和普通连接池分开，客户端 WATCH 之后空闲不会占满普通连接池
+func (s *Session) pinTx(key []byte) *ErrorResp {
+	conn, err := s.p.cluster.GetTxConn(key)
+	if err != nil {
+		s.releaseTx(false)
+		return NewErrorResp([]byte("proxy internal error " + err.Error()))
+	}
+	rc, ok := conn.(*RedisConn)
+	if !ok {
+		s.p.cluster.RemoveTxConn(conn)
+		s.releaseTx(false)
+		return NewErrorResp([]byte("proxy internal error GetTxConn failed"))
+	}
+	s.tx.conn = rc
+	if !s.tx.multi {
+		return nil
+	}
+
+	reqs := append([]*ArrayResp{NewCommand([]byte("MULTI"))}, s.tx.pending...)
+	resps, err := s.ExecPipeline(rc, reqs)
+	for _, req := range s.tx.pending {
+		Release(req)
+	}
+	s.tx.pending = nil
+	if err != nil {
+		log.Warning("Session transaction MULTI failed ", err)
+		s.releaseTx(false)
+		return NewErrorResp([]byte("proxy internal error " + err.Error()))
+	}
+	s.tx.sent = true
+	if sr, ok := resps[0].(*SimpleResp); !ok || !bytes.Equal(sr.Args[0], OK) {
+		s.tx.dirty = true
+	}
+	return nil
+}
+
+// txCall 在固定的连接上执行一个命令，连接出错时结束事务
+func (s *Session) txCall(req *ArrayResp) Resp {
+	resp, err := s.ExecOnce(s.tx.conn, req)
+	if err != nil {
+		log.Warning("Session transaction conn failed ", err)
+		s.releaseTx(false)
+		return NewErrorResp([]byte("proxy internal error " + err.Error()))
+	}
+	if er, ok := resp.(*ErrorResp); ok && bytes.HasPrefix(er.Args[0], MOVED) {
+		s.p.cluster.topo.Reload()
+	}
+	return resp
+}
+
+// releaseTx 结束事务，clean 为 false 时连接上可能还有事务状态，直接关闭
+func (s *Session) releaseTx(clean bool) {
+	tx := s.tx
+	s.tx = nil
+	if tx == nil {
+		return
+	}
+	for _, req := range tx.pending {
+		Release(req)
+	}
+	if tx.conn == nil {
+		return
+	}
+	if clean {
+		s.p.cluster.PutTxConn(tx.conn)
+	} else {
+		s.p.cluster.RemoveTxConn(tx.conn)
+	}
+}
@@ -22,6 +22,15 @@ var (
 	_ Resp = (*ErrorResp)(nil)
 	_ Resp = (*BulkResp)(nil)
 	_ Resp = (*ArrayResp)(nil)
+	_ Resp = (*MapResp)(nil)
+	_ Resp = (*SetResp)(nil)
+	_ Resp = (*PushResp)(nil)
+	_ Resp = (*AttrResp)(nil)
+	_ Resp = (*DoubleResp)(nil)
+	_ Resp = (*BoolResp)(nil)
+	_ Resp = (*BigNumResp)(nil)
+	_ Resp = (*VerbatimResp)(nil)
+	_ Resp = (*NullResp)(nil)
 
 	SimpleType = "simple"
 	ErrorType  = "error"
@@ -29,6 +38,17 @@ var (
 	BulkType   = "bulk"
 	ArrayType  = "array"
 
+	// RESP3
+	MapType      = "map"
+	SetType      = "set"
+	PushType     = "push"
+	AttrType     = "attribute"
+	DoubleType   = "double"
+	BoolType     = "boolean"
+	BigNumType   = "bignumber"
+	VerbatimType = "verbatim"
+	NullType     = "null"
+
 	Space   = byte(' ')
 	SimpSep = byte('+')
 	ErrSep  = byte('-')
@@ -37,18 +57,35 @@ var (
 	ArrSep  = byte('*')
 	CRLF    = []byte("\r\n")
 
-	PING      = []byte("PING")
-	PONG      = []byte("PONG")
-	SELECT    = []byte("SELECT")
-	OK        = []byte("OK")
-	QUIT      = []byte("QUIT")
-	MOVED     = []byte("MOVED")
-	ASK       = []byte("ASK")
-	ASKING    = []byte("ASKING")
-	EmptyBulk = []byte("$-1\r\n")
-
-	ArrSepReadError         = errors.New("In  ReadResp ArrSep, must read BulkResp")
-	RawCmdError             = errors.New("raw command must be quit or ping")
+	// RESP3
+	MapSep      = byte('%')
+	SetSep      = byte('~')
+	PushSep     = byte('>')
+	AttrSep     = byte('|')
+	DoubleSep   = byte(',')
+	BoolSep     = byte('#')
+	BigNumSep   = byte('(')
+	VerbatimSep = byte('=')
+	NullSep     = byte('_')
+
+	PING       = []byte("PING")
+	PONG       = []byte("PONG")
+	SELECT     = []byte("SELECT")
+	OK         = []byte("OK")
+	QUIT       = []byte("QUIT")
+	MOVED      = []byte("MOVED")
+	ASK        = []byte("ASK")
+	ASKING     = []byte("ASKING")
+	WITHSCORES = []byte("WITHSCORES")
+	EmptyBulk  = []byte("$-1\r\n")
+	EmptyArray = []byte("*-1\r\n")
+	Null       = []byte("_\r\n")
+
+	InlineQuotesError       = errors.New("ERR Protocol error: unbalanced quotes in request")
+	ProtoBulkLenError       = errors.New("ERR Protocol error: invalid bulk length")
+	ProtoMultiBulkError     = errors.New("ERR Protocol error: invalid multibulk length")
+	ProtoInlineError        = errors.New("ERR Protocol error: too big inline request")
+	ProtoRequestError       = errors.New("ERR Protocol error: too big request")
 	ReadRespUnexpectedError = errors.New("ReadResp error, unexpected")
 	RespTypeError           = errors.New("Encode Type error")
 )
@@ -61,11 +98,18 @@ var (
 // For Integers the first byte of the reply is ":"
 // For Bulk Strings the first byte of the reply is "$"
 // For Arrays the first byte of the reply is "*"
+// RESP3 adds more types
+// https://github.com/redis/redis-specifications/blob/master/protocol/RESP3.md
+// Map "%", Set "~", Push ">", Attribute "|", Double ",", Boolean "#"
+// Big Number "(", Verbatim String "=", Null "_"
 type Resp interface {
 	Encode(w *bufio.Writer) error
 	String() string
 	Type() string
 	Length() int //只给ArrayResp使用，检测命令参数的个数，其它均为0
+
+	encode(b *bytes.Buffer) // 序列化到 b，ArrayResp 嵌套时递归调用
+	base() *BaseResp
 }
 
 // 现在看，没必要分成 Cmd Args，直接全都是Args就好了
@@ -74,6 +118,12 @@ type Resp interface {
 type BaseResp struct {
 	Rtype string
 	Args  [][]byte
+
+	arena *respArena // 对象池分配的 payload 内存，只挂在最外层 Resp 上
+}
+
+func (br *BaseResp) base() *BaseResp {
+	return br
 }
 
 func (br *BaseResp) String() string {
@@ -93,21 +143,16 @@ type SimpleResp struct {
 }
 
 func (sr *SimpleResp) Encode(w *bufio.Writer) error {
+	return encodeResp(w, sr)
+}
+
+func (sr *SimpleResp) encode(b *bytes.Buffer) {
 	if sr.Rtype != SimpleType {
 		panic(RespTypeError)
 	}
-
-	// var b bytes.Buffer
-	b := bPool.Get().(*bytes.Buffer)
-	b.Reset()
-	defer bPool.Put(b)
 	b.WriteByte(SimpSep)
 	b.Write(sr.Args[0])
 	b.Write(CRLF)
-	// bufpool.Put(b)
-	// return b.Bytes()
-	err := WriteRawByte(w, b.Bytes())
-	return err
 }
 
 type ErrorResp struct {
@@ -115,20 +160,16 @@ type ErrorResp struct {
 }
 
 func (er *ErrorResp) Encode(w *bufio.Writer) error {
+	return encodeResp(w, er)
+}
+
+func (er *ErrorResp) encode(b *bytes.Buffer) {
 	if er.Rtype != ErrorType {
 		panic(RespTypeError)
 	}
-
-	// var b bytes.Buffer
-	b := bPool.Get().(*bytes.Buffer)
-	b.Reset()
-	defer bPool.Put(b)
 	b.WriteByte(ErrSep)
 	b.Write(er.Args[0])
 	b.Write(CRLF)
-	// return b.Bytes()
-	err := WriteRawByte(w, b.Bytes())
-	return err
 }
 
 type IntResp struct {
@@ -136,20 +177,16 @@ type IntResp struct {
 }
 
 func (ir *IntResp) Encode(w *bufio.Writer) error {
+	return encodeResp(w, ir)
+}
+
+func (ir *IntResp) encode(b *bytes.Buffer) {
 	if ir.Rtype != IntType {
 		panic(RespTypeError)
 	}
-
-	// var b bytes.Buffer
-	b := bPool.Get().(*bytes.Buffer)
-	b.Reset()
-	defer bPool.Put(b)
 	b.WriteByte(IntSep)
 	b.Write(ir.Args[0])
 	b.Write(CRLF)
-	// return b.Bytes()
-	err := WriteRawByte(w, b.Bytes())
-	return err
 }
 
 type BulkResp struct {
@@ -158,194 +195,794 @@ type BulkResp struct {
 }
 
 func (br *BulkResp) Bytes() []byte {
+	b := new(bytes.Buffer)
+	br.encode(b)
+	return b.Bytes()
+}
+
+func (br *BulkResp) Encode(w *bufio.Writer) error {
+	return encodeResp(w, br)
+}
+
+func (br *BulkResp) encode(b *bytes.Buffer) {
 	if br.Rtype != BulkType {
 		panic(RespTypeError)
 	}
 
 	if br.Empty {
-		return EmptyBulk
+		b.Write(EmptyBulk)
+		return
 	}
 
-	b := new(bytes.Buffer)
 	b.WriteByte(BulkSep)
-	// b.Write(util.Iu32tob2(len(br.Args[0])))
 	util.WriteLength(b, len(br.Args[0]))
 	b.Write(CRLF)
 	b.Write(br.Args[0])
 	b.Write(CRLF)
-	return b.Bytes()
 }
 
-func (br *BulkResp) Encode(w *bufio.Writer) error {
-	if br.Rtype != BulkType {
+// ArrayResp 的元素可以是任意 Resp，包括嵌套的 ArrayResp、IntResp、ErrorResp
+// 客户端发来的命令一定是 BulkResp 组成的数组，由 Filter 保证
+// Empty 表示 *-1 nil array
+type ArrayResp struct {
+	BaseResp
+	Args  []Resp
+	Empty bool
+}
+
+func (ar *ArrayResp) String() string {
+	return joinResp(ar.Args)
+}
+
+func (ar *ArrayResp) Encode(w *bufio.Writer) error {
+	if sb := ar.Stream(); sb != nil {
+		return ar.encodeStream(w, sb)
+	}
+	return encodeResp(w, ar)
+}
+
+func (ar *ArrayResp) encode(b *bytes.Buffer) {
+	if ar.Rtype != ArrayType {
 		panic(RespTypeError)
 	}
 
-	if br.Empty {
-		return WriteRawByte(w, EmptyBulk)
+	if ar.Empty {
+		b.Write(EmptyArray)
+		return
 	}
 
-	// var b bytes.Buffer
-	b := bPool.Get().(*bytes.Buffer)
-	b.Reset()
-	defer bPool.Put(b)
-	b.WriteByte(BulkSep)
-	// b.Write(util.Iu32tob2(len(br.Args[0])))
-	util.WriteLength(b, len(br.Args[0]))
+	encodeAggregate(b, ArrSep, len(ar.Args), ar.Args)
+}
+
+func (ar *ArrayResp) Length() int {
+	return len(ar.Args) - 1
+}
+
+// Arg 返回第 i 个元素的 BulkResp 内容，不是 BulkResp 或者越界返回 nil
+// 命令解析路径上用 req.Arg(1) 取 key
+// 还没有转发的流式参数先读到内存，已经转发的返回 nil
+func (ar *ArrayResp) Arg(i int) []byte {
+	if i < 0 || i >= len(ar.Args) {
+		return nil
+	}
+	if sb, ok := ar.Args[i].(*StreamBulkResp); ok {
+		if sb.consumed() || ar.Materialize() != nil {
+			return nil
+		}
+	}
+	br, ok := ar.Args[i].(*BulkResp)
+	if !ok || br.Empty || len(br.Args) == 0 {
+		return nil
+	}
+	return br.Args[0]
+}
+
+// IsCommand 检查是否是全部由非空 BulkResp 组成的数组，即客户端命令
+// 最后一个参数可以是流式读取的 StreamBulkResp
+func (ar *ArrayResp) IsCommand() bool {
+	if ar.Empty || len(ar.Args) == 0 {
+		return false
+	}
+	for i, arg := range ar.Args {
+		if _, ok := arg.(*StreamBulkResp); ok && i == len(ar.Args)-1 {
+			continue
+		}
+		br, ok := arg.(*BulkResp)
+		if !ok || br.Empty {
+			return false
+		}
+	}
+	return true
+}
+
+// RESP3 的简单类型，和 IntResp 一样只有一行内容
+type DoubleResp struct {
+	BaseResp
+}
+
+func (dr *DoubleResp) Encode(w *bufio.Writer) error {
+	return encodeResp(w, dr)
+}
+
+func (dr *DoubleResp) encode(b *bytes.Buffer) {
+	encodeLine(b, DoubleSep, dr.Args[0])
+}
+
+type BoolResp struct {
+	BaseResp
+}
+
+func (br *BoolResp) Encode(w *bufio.Writer) error {
+	return encodeResp(w, br)
+}
+
+func (br *BoolResp) encode(b *bytes.Buffer) {
+	encodeLine(b, BoolSep, br.Args[0])
+}
+
+type BigNumResp struct {
+	BaseResp
+}
+
+func (br *BigNumResp) Encode(w *bufio.Writer) error {
+	return encodeResp(w, br)
+}
+
+func (br *BigNumResp) encode(b *bytes.Buffer) {
+	encodeLine(b, BigNumSep, br.Args[0])
+}
+
+type NullResp struct {
+	BaseResp
+}
+
+func (nr *NullResp) Encode(w *bufio.Writer) error {
+	return encodeResp(w, nr)
+}
+
+func (nr *NullResp) encode(b *bytes.Buffer) {
+	b.Write(Null)
+}
+
+// Verbatim String, Args[0] 包含 "txt:" 这样的三字节格式前缀
+type VerbatimResp struct {
+	BaseResp
+}
+
+func (vr *VerbatimResp) Encode(w *bufio.Writer) error {
+	return encodeResp(w, vr)
+}
+
+func (vr *VerbatimResp) encode(b *bytes.Buffer) {
+	b.WriteByte(VerbatimSep)
+	util.WriteLength(b, len(vr.Args[0]))
 	b.Write(CRLF)
-	b.Write(br.Args[0])
+	b.Write(vr.Args[0])
 	b.Write(CRLF)
-	err := WriteRawByte(w, b.Bytes())
-	return err
 }
 
-type ArrayResp struct {
+// Map 的 Args 是 key value 交替排列，长度是 2n
+type MapResp struct {
 	BaseResp
-	Args []*BulkResp
+	Args []Resp
 }
 
-func (ar *ArrayResp) String() string {
+func (mr *MapResp) String() string {
+	return joinResp(mr.Args)
+}
+
+func (mr *MapResp) Encode(w *bufio.Writer) error {
+	return encodeResp(w, mr)
+}
+
+func (mr *MapResp) encode(b *bytes.Buffer) {
+	encodeAggregate(b, MapSep, len(mr.Args)/2, mr.Args)
+}
+
+type SetResp struct {
+	BaseResp
+	Args []Resp
+}
+
+func (sr *SetResp) String() string {
+	return joinResp(sr.Args)
+}
+
+func (sr *SetResp) Encode(w *bufio.Writer) error {
+	return encodeResp(w, sr)
+}
+
+func (sr *SetResp) encode(b *bytes.Buffer) {
+	encodeAggregate(b, SetSep, len(sr.Args), sr.Args)
+}
+
+type PushResp struct {
+	BaseResp
+	Args []Resp
+}
+
+func (pr *PushResp) String() string {
+	return joinResp(pr.Args)
+}
+
+func (pr *PushResp) Encode(w *bufio.Writer) error {
+	return encodeResp(w, pr)
+}
+
+func (pr *PushResp) encode(b *bytes.Buffer) {
+	encodeAggregate(b, PushSep, len(pr.Args), pr.Args)
+}
+
+// Attribute 是附加在真正回复之前的 key value 对，Value 是紧跟着的回复
+type AttrResp struct {
+	BaseResp
+	Args  []Resp
+	Value Resp
+}
+
+func (ar *AttrResp) String() string {
+	return ar.Value.String()
+}
+
+func (ar *AttrResp) Encode(w *bufio.Writer) error {
+	return encodeResp(w, ar)
+}
+
+func (ar *AttrResp) encode(b *bytes.Buffer) {
+	encodeAggregate(b, AttrSep, len(ar.Args)/2, ar.Args)
+	ar.Value.encode(b)
+}
+
+func joinResp(args []Resp) string {
 	var str []string
-	for _, i := range ar.Args {
+	for _, i := range args {
 		str = append(str, i.String())
 	}
 	return strings.Join(str, " ")
 }
 
-func (ar *ArrayResp) Encode(w *bufio.Writer) error {
-	if ar.Rtype != ArrayType {
-		panic(RespTypeError)
-	}
+func encodeLine(b *bytes.Buffer, sep byte, line []byte) {
+	b.WriteByte(sep)
+	b.Write(line)
+	b.Write(CRLF)
+}
 
-	// var b bytes.Buffer
-	b := bPool.Get().(*bytes.Buffer)
-	b.Reset()
-	defer bPool.Put(b)
-	b.WriteByte(ArrSep)
-	// b.Write(util.Iu32tob2(len(ar.Args)))
-	util.WriteLength(b, len(ar.Args))
+func encodeAggregate(b *bytes.Buffer, sep byte, n int, args []Resp) {
+	b.WriteByte(sep)
+	util.WriteLength(b, n)
 	b.Write(CRLF)
+	for _, arg := range args {
+		arg.encode(b)
+	}
+}
+
+func NewSimpleResp(s []byte) *SimpleResp {
+	sr := &SimpleResp{}
+	sr.Rtype = SimpleType
+	sr.Args = append(sr.Args, s)
+	return sr
+}
+
+func NewErrorResp(reason []byte) *ErrorResp {
+	er := &ErrorResp{}
+	er.Rtype = ErrorType
+	er.Args = append(er.Args, reason)
+	return er
+}
 
-	for _, arg := range ar.Args {
-		b.Write(arg.Bytes())
+func NewIntResp(i int) *IntResp {
+	ir := &IntResp{}
+	ir.Rtype = IntType
+	ir.Args = append(ir.Args, util.Itob(i))
+	return ir
+}
+
+func NewBulkResp(b []byte) *BulkResp {
+	br := &BulkResp{}
+	br.Rtype = BulkType
+	if b == nil {
+		br.Empty = true
+		return br
 	}
-	// return b.Bytes()
-	err := WriteRawByte(w, b.Bytes())
-	return err
+	br.Args = append(br.Args, b)
+	return br
 }
 
-func (ar *ArrayResp) Length() int {
-	return len(ar.Args) - 1
+func NewArrayResp(args ...Resp) *ArrayResp {
+	ar := &ArrayResp{}
+	ar.Rtype = ArrayType
+	ar.Args = args
+	return ar
+}
+
+// NewCommand 构造发往后端的命令，每个参数都是 BulkResp
+func NewCommand(args ...[]byte) *ArrayResp {
+	ar := &ArrayResp{}
+	ar.Rtype = ArrayType
+	ar.Args = make([]Resp, 0, len(args))
+	for _, arg := range args {
+		ar.Args = append(ar.Args, NewBulkResp(arg))
+	}
+	return ar
+}
+
+func NewNullResp() *NullResp {
+	nr := &NullResp{}
+	nr.Rtype = NullType
+	return nr
+}
+
+func NewDoubleResp(d []byte) *DoubleResp {
+	dr := &DoubleResp{}
+	dr.Rtype = DoubleType
+	dr.Args = append(dr.Args, d)
+	return dr
+}
+
+func NewMapResp(args ...Resp) *MapResp {
+	mr := &MapResp{}
+	mr.Rtype = MapType
+	mr.Args = args
+	return mr
+}
+
+func NewSetResp(args ...Resp) *SetResp {
+	sr := &SetResp{}
+	sr.Rtype = SetType
+	sr.Args = args
+	return sr
+}
+
+func encodeResp(w *bufio.Writer, r Resp) error {
+	b := bPool.Get().(*bytes.Buffer)
+	b.Reset()
+	defer bPool.Put(b)
+	r.encode(b)
+	return WriteRawByte(w, b.Bytes())
 }
 
+// WriteRawByte 只写入 w 的缓冲区，由调用方决定什么时候 Flush
+// 这样 pipeline 的多个回复可以合并成一次系统调用
 func WriteRawByte(w *bufio.Writer, data []byte) error {
 	_, err := w.Write(data)
+	return err
+}
+
+// WriteProtocol 写入一个完整的 Resp 并立即 Flush
+func WriteProtocol(w *bufio.Writer, r Resp) error {
+	err := r.Encode(w)
 	if err != nil {
 		return err
 	}
-	err = w.Flush()
+	return w.Flush()
+}
+
+// ProtoLimit 限制客户端请求的大小，防止恶意请求耗尽 proxy 内存
+// 后端回复不做限制，0 表示不限制
+type ProtoLimit struct {
+	MaxBulkLen     int // 单个 bulk 的最大长度
+	MaxMultiBulk   int // 数组的最大元素个数
+	MaxInlineLen   int // 单行的最大长度，包括 inline command 和协议头
+	MaxRequestSize int // 一个完整请求的最大字节数
+}
+
+// protoReader 记录单个请求已经读取的字节数
+type protoReader struct {
+	r     *bufio.Reader
+	limit *ProtoLimit
+	size  int
+
+	// 不小于 stream 字节的 bulk 不读取 payload，返回 StreamBulkResp
+	// 只有位于报文末尾的 bulk 才能流式读取，tail 标记当前元素是否在末尾
+	stream int
+	tail   bool
+	depth  int
+
+	// 从对象池分配 Resp，小 payload 从 arena 分配
+	pooled bool
+	arena  *respArena
+}
+
+// ReadProtocol 读取一个完整的请求或回复，不做大小限制
+func ReadProtocol(r *bufio.Reader) (Resp, error) {
+	return ReadProtocolStream(r, nil, 0)
+}
+
+// ReadProtocolLimit 读取一个完整的请求，按 limit 做大小限制
+func ReadProtocolLimit(r *bufio.Reader, limit *ProtoLimit) (Resp, error) {
+	return ReadProtocolStream(r, limit, 0)
+}
+
+// ReadProtocolStream 读取一个完整的请求或回复
+// 不以 RESP 类型前缀开头的行当作 inline command 处理，比如 telnet 发来的
+// set foo "hello world"，转换成和 multibulk 一样的 ArrayResp
+// inline 只在最外层出现，数组内的元素由 readResp 读取
+// stream 大于 0 时，最外层的 bulk 回复或者命令的最后一个参数(非 key)
+// 超过 stream 字节时返回 StreamBulkResp，调用方必须消费掉 payload 才能继续读取
+func ReadProtocolStream(r *bufio.Reader, limit *ProtoLimit, stream int) (Resp, error) {
+	pr := protoReader{r: r, limit: limit, stream: stream, tail: true}
+	return pr.read()
+}
+
+// ReadProtocolPooled 和 ReadProtocolStream 一样，但是 Resp 从对象池分配
+// 使用完之后调用 Release 回收，Release 之后不能再引用其中的 []byte
+func ReadProtocolPooled(r *bufio.Reader, limit *ProtoLimit, stream int) (Resp, error) {
+	pr := protoReader{r: r, limit: limit, stream: stream, tail: true, pooled: true}
+	resp, err := pr.read()
 	if err != nil {
-		return err
+		if pr.arena != nil {
+			pr.arena.release()
+		}
+		return nil, err
+	}
+	resp.base().arena = pr.arena
+	return resp, nil
+}
+
+func (pr *protoReader) read() (Resp, error) {
+	for {
+		res, err := pr.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if isRespPrefix(res[0]) {
+			return pr.parseResp(res)
+		}
+
+		args, err := util.SplitArgs(bytes.TrimRight(res, "\r\n"))
+		if err != nil {
+			return nil, InlineQuotesError
+		}
+		// 空行直接忽略，和 redis 一致
+		if len(args) == 0 {
+			continue
+		}
+		return NewCommand(args...), nil
+	}
+}
+
+// IsProtocolError 判断是否是客户端发来了非法的协议
+// 出现这类错误后流已经无法同步，只能回复错误并关闭连接
+func IsProtocolError(err error) bool {
+	switch err {
+	case InlineQuotesError, ProtoBulkLenError, ProtoMultiBulkError,
+		ProtoInlineError, ProtoRequestError, ReadRespUnexpectedError:
+		return true
+	}
+	return false
+}
+
+func isRespPrefix(b byte) bool {
+	switch b {
+	case SimpSep, ErrSep, IntSep, BulkSep, ArrSep,
+		MapSep, SetSep, PushSep, AttrSep, DoubleSep, BoolSep, BigNumSep, VerbatimSep, NullSep:
+		return true
+	}
+	return false
+}
+
+// readLine 读取以 \n 结尾的一行，超过 MaxInlineLen 立即返回错误，不会无限制的缓存
+// 整行都在 bufio 的缓冲区中时直接返回，不拷贝，只在下一次读取之前有效
+func (pr *protoReader) readLine() ([]byte, error) {
+	var line []byte
+	for {
+		b, err := pr.r.ReadSlice(byte('\n'))
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, err
+		}
+		if err == nil && line == nil {
+			line = b
+		} else {
+			line = append(line, b...)
+		}
+		if pr.limit != nil && pr.limit.MaxInlineLen > 0 && len(line) > pr.limit.MaxInlineLen {
+			return nil, ProtoInlineError
+		}
+		if err == nil {
+			break
+		}
+	}
+	return line, pr.grow(len(line))
+}
+
+// grow 累加当前请求的字节数
+func (pr *protoReader) grow(n int) error {
+	pr.size += n
+	if pr.limit != nil && pr.limit.MaxRequestSize > 0 && pr.size > pr.limit.MaxRequestSize {
+		return ProtoRequestError
 	}
 	return nil
 }
 
-func WriteProtocol(w *bufio.Writer, r Resp) error {
-	return r.Encode(w)
+// readBulk 读取 l 字节内容和结尾的 \r\n
+func (pr *protoReader) readBulk(l int) ([]byte, error) {
+	if pr.limit != nil && pr.limit.MaxBulkLen > 0 && l > pr.limit.MaxBulkLen {
+		return nil, ProtoBulkLenError
+	}
+	// 先检查总大小再分配内存
+	if err := pr.grow(l + 2); err != nil {
+		return nil, err
+	}
+
+	// 把\r\n也读出来，扔掉
+	buf := pr.alloc(l + 2)
+	_, err := io.ReadFull(pr.r, buf)
+	if err != nil {
+		return nil, err
+	}
+	if buf[l] != '\r' || buf[l+1] != '\n' {
+		return nil, ReadRespUnexpectedError
+	}
+	return buf[:l], nil
 }
 
-// binary data  may contain \r\n
-// so ,we must read fixed-length data by io.ReadFull
-func ReadProtocol(r *bufio.Reader) (Resp, error) {
-	res, err := r.ReadBytes(byte('\n'))
+func (pr *protoReader) alloc(n int) []byte {
+	if !pr.pooled {
+		return make([]byte, n)
+	}
+	if pr.arena == nil {
+		pr.arena = newArena()
+	}
+	return pr.arena.alloc(n)
+}
+
+// line 返回去掉类型前缀和 \r\n 的内容，拷贝一份，readLine 的结果不能保存
+func (pr *protoReader) line(res []byte) []byte {
+	b := pr.alloc(len(res) - 3)
+	copy(b, res[1:len(res)-2])
+	return b
+}
+
+func (pr *protoReader) readResp() (Resp, error) {
+	res, err := pr.readLine()
 	if err != nil {
 		return nil, err
 	}
+	return pr.parseResp(res)
+}
+
+// binary data  may contain \r\n
+// so ,we must read fixed-length data by io.ReadFull
+func (pr *protoReader) parseResp(res []byte) (Resp, error) {
+	if len(res) < 3 || res[len(res)-2] != '\r' {
+		return nil, ReadRespUnexpectedError
+	}
 
 	switch res[0] {
 	case SimpSep:
 		sr := &SimpleResp{}
 		sr.Rtype = SimpleType
-		sr.Args = append(sr.Args, res[1:len(res)-2])
+		sr.Args = append(sr.Args, pr.line(res))
 		return sr, nil
 	case ErrSep:
 		er := &ErrorResp{}
 		er.Rtype = ErrorType
-		er.Args = append(er.Args, res[1:len(res)-2])
+		er.Args = append(er.Args, pr.line(res))
 		return er, nil
 	case IntSep:
 		ir := &IntResp{}
 		ir.Rtype = IntType
-		ir.Args = append(ir.Args, res[1:len(res)-2])
+		ir.Args = append(ir.Args, pr.line(res))
 		return ir, nil
 	case BulkSep:
-		br := &BulkResp{}
-		br.Rtype = BulkType
+		br := pr.newBulk()
 		l, err := util.ParseLen(res[1 : len(res)-2])
 		if err != nil {
-			return nil, err
+			return nil, ProtoBulkLenError
 		}
 		if l == -1 {
 			br.Empty = true
 			return br, nil
 		}
+		if pr.stream > 0 && pr.tail && l >= pr.stream {
+			if pr.limit != nil && pr.limit.MaxBulkLen > 0 && l > pr.limit.MaxBulkLen {
+				return nil, ProtoBulkLenError
+			}
+			if err := pr.grow(l + 2); err != nil {
+				return nil, err
+			}
+			return newStreamBulkResp(pr.r, l), nil
+		}
 
-		// 把\r\n也读出来，扔掉
-		buf := make([]byte, l+2)
-		n, e := io.ReadFull(r, buf)
-		if e != nil || n != l+2 {
+		buf, err := pr.readBulk(l)
+		if err != nil {
 			return nil, err
 		}
-		br.Args = append(br.Args, buf[:len(buf)-2])
+		br.Args = append(br.Args, buf)
 		return br, nil
 	case ArrSep:
-		ar := &ArrayResp{}
-		ar.Rtype = ArrayType
-		n, err := util.ParseLen(res[1 : len(res)-2])
+		ar := pr.newArray()
+		n, err := pr.parseCount(res)
 		if err != nil {
 			return nil, err
 		}
+		if n == -1 {
+			ar.Empty = true
+			return ar, nil
+		}
 
-		// must followed by n BulkResp
-		for i := 0; i < n; i++ {
-			rsp, err := ReadProtocol(r)
-			if err != nil {
-				return nil, err
-			}
-			br, ok := rsp.(*BulkResp)
-			if !ok {
-				return nil, ArrSepReadError
-			}
-			ar.Args = append(ar.Args, br)
+		// 元素可以是任意类型，递归读取
+		// 只有命令的最后一个参数可以流式读取，前两个是命令名和 key
+		tail := pr.tail && pr.depth == 0 && n > 2
+		ar.Args, err = pr.readAggregateTo(ar.Args, n, tail)
+		if err != nil {
+			return nil, err
 		}
 		return ar, nil
-	case byte('Q'):
-		fallthrough
-	case byte('q'):
-		if len(res) != 6 {
-			return nil, RawCmdError
-		}
-		ar := &ArrayResp{}
-		ar.Rtype = ArrayType
-		br := &BulkResp{}
-		br.Rtype = BulkType
-		br.Args = [][]byte{QUIT}
-		ar.Args = append(ar.Args, br)
-		return ar, nil
-	case byte('p'):
-		fallthrough
-	case byte('P'):
-		if len(res) != 6 {
-			return nil, RawCmdError
-		}
-		ar := &ArrayResp{}
-		ar.Rtype = ArrayType
-		br := &BulkResp{}
-		br.Rtype = BulkType
-		br.Args = [][]byte{PING}
-		ar.Args = append(ar.Args, br)
+	case DoubleSep:
+		dr := &DoubleResp{}
+		dr.Rtype = DoubleType
+		dr.Args = append(dr.Args, pr.line(res))
+		return dr, nil
+	case BoolSep:
+		br := &BoolResp{}
+		br.Rtype = BoolType
+		br.Args = append(br.Args, pr.line(res))
+		return br, nil
+	case BigNumSep:
+		br := &BigNumResp{}
+		br.Rtype = BigNumType
+		br.Args = append(br.Args, pr.line(res))
+		return br, nil
+	case NullSep:
+		return NewNullResp(), nil
+	case VerbatimSep:
+		vr := &VerbatimResp{}
+		vr.Rtype = VerbatimType
+		l, err := util.ParseLen(res[1 : len(res)-2])
+		if err != nil || l < 0 {
+			return nil, ProtoBulkLenError
+		}
+		buf, err := pr.readBulk(l)
+		if err != nil {
+			return nil, err
+		}
+		vr.Args = append(vr.Args, buf)
+		return vr, nil
+	case MapSep, AttrSep:
+		n, err := pr.parseCount(res)
+		if err != nil || n < 0 {
+			return nil, ProtoMultiBulkError
+		}
+		args, err := pr.readAggregate(2*n, false)
+		if err != nil {
+			return nil, err
+		}
+		if res[0] == MapSep {
+			return NewMapResp(args...), nil
+		}
+
+		// attribute 后面紧跟真正的回复
+		ar := &AttrResp{}
+		ar.Rtype = AttrType
+		ar.Args = args
+		pr.tail = false
+		ar.Value, err = pr.readResp()
+		if err != nil {
+			return nil, err
+		}
 		return ar, nil
+	case SetSep, PushSep:
+		n, err := pr.parseCount(res)
+		if err != nil || n < 0 {
+			return nil, ProtoMultiBulkError
+		}
+		args, err := pr.readAggregate(n, false)
+		if err != nil {
+			return nil, err
+		}
+		if res[0] == SetSep {
+			return NewSetResp(args...), nil
+		}
+		push := &PushResp{}
+		push.Rtype = PushType
+		push.Args = args
+		return push, nil
 	}
 
 	return nil, ReadRespUnexpectedError
 }
+
+// parseCount 解析聚合类型的元素个数，并检查 MaxMultiBulk
+func (pr *protoReader) parseCount(res []byte) (int, error) {
+	n, err := util.ParseLen(res[1 : len(res)-2])
+	if err != nil {
+		return -1, ProtoMultiBulkError
+	}
+	if pr.limit != nil && pr.limit.MaxMultiBulk > 0 && n > pr.limit.MaxMultiBulk {
+		return -1, ProtoMultiBulkError
+	}
+	return n, nil
+}
+
+func (pr *protoReader) newBulk() *BulkResp {
+	if pr.pooled {
+		return getBulkResp()
+	}
+	br := &BulkResp{}
+	br.Rtype = BulkType
+	return br
+}
+
+func (pr *protoReader) newArray() *ArrayResp {
+	if pr.pooled {
+		return getArrayResp()
+	}
+	ar := &ArrayResp{}
+	ar.Rtype = ArrayType
+	return ar
+}
+
+func (pr *protoReader) readAggregate(n int, tail bool) ([]Resp, error) {
+	return pr.readAggregateTo(nil, n, tail)
+}
+
+// readAggregateTo 读取 n 个元素追加到 args，对象池中的 ArrayResp 可以复用 args 的容量
+func (pr *protoReader) readAggregateTo(args []Resp, n int, tail bool) ([]Resp, error) {
+	// 不能相信对端声明的元素个数，预分配设置上限
+	if cap(args) < n {
+		c := n
+		if c > 1024 {
+			c = 1024
+		}
+		args = make([]Resp, 0, c)
+	}
+	pr.depth++
+	defer func() { pr.depth-- }()
+	for i := 0; i < n; i++ {
+		pr.tail = tail && i == n-1
+		rsp, err := pr.readResp()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, rsp)
+	}
+	return args, nil
+}
+
+// ToRESP3 把后端返回的 RESP2 回复转换成 RESP3 类型
+// kind 来自 rules.go 的 resp3Replies，为空时只把 $-1 *-1 转换成 Null
+// 转换后原来的 ArrayResp 不再使用，arena 转移给新的回复
+func ToRESP3(r Resp, kind string) Resp {
+	switch v := r.(type) {
+	case *BulkResp:
+		if v.Empty {
+			return NewNullResp()
+		}
+		if kind == Reply3Double {
+			dr := NewDoubleResp(v.Args[0])
+			dr.arena, v.arena = v.arena, nil
+			return dr
+		}
+	case *ArrayResp:
+		if v.Empty {
+			return NewNullResp()
+		}
+		args := make([]Resp, 0, len(v.Args))
+		for _, arg := range v.Args {
+			args = append(args, ToRESP3(arg, ""))
+		}
+
+		var res Resp = NewArrayResp(args...)
+		switch kind {
+		case Reply3Map:
+			if len(args)%2 == 0 {
+				res = NewMapResp(args...)
+			}
+		case Reply3Set:
+			res = NewSetResp(args...)
+		case Reply3ScorePairs:
+			// member score member score => [[member score] [member score]]
+			if len(args)%2 == 0 {
+				pairs := make([]Resp, 0, len(args)/2)
+				for i := 0; i < len(args); i += 2 {
+					pairs = append(pairs, NewArrayResp(args[i], ToRESP3(args[i+1], Reply3Double)))
+				}
+				res = NewArrayResp(pairs...)
+			}
+		}
+		res.base().arena, v.arena = v.arena, nil
+		return res
+	}
+	return r
+}
@@ -8,8 +8,258 @@ import (
 
 func Benchmark_ReadProtocol(b *testing.B) {
 	res := []byte("*4\r\n$5\r\nhello\r\n$5\r\nworld\r\n$12\r\nwocao\r\nzhaha\r\n$-1\r\n")
-	r := bytes.NewBuffer(res)
+	r := bytes.NewReader(res)
+	br := bufio.NewReader(r)
+	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
-		ReadProtocol(bufio.NewReader(r))
+		r.Reset(res)
+		br.Reset(r)
+		ReadProtocol(br)
+	}
+}
+
+func Benchmark_ReadProtocolPooled(b *testing.B) {
+	res := []byte("*4\r\n$5\r\nhello\r\n$5\r\nworld\r\n$12\r\nwocao\r\nzhaha\r\n$-1\r\n")
+	r := bytes.NewReader(res)
+	br := bufio.NewReader(r)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Reset(res)
+		br.Reset(r)
+		resp, err := ReadProtocolPooled(br, nil, 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		Release(resp)
+	}
+}
+
+func Test_ReadProtocolNested(t *testing.T) {
+	cases := []string{
+		"*-1\r\n",
+		"*0\r\n",
+		"*2\r\n$1\r\n0\r\n*2\r\n$3\r\nfoo\r\n$3\r\nbar\r\n",
+		"*3\r\n:0\r\n:5460\r\n*2\r\n$9\r\n127.0.0.1\r\n:7000\r\n",
+		"*3\r\n+OK\r\n-ERR wrong\r\n*-1\r\n",
+		"*2\r\n$-1\r\n$0\r\n\r\n",
+	}
+	for _, c := range cases {
+		r, err := ReadProtocol(bufio.NewReader(bytes.NewBufferString(c)))
+		if err != nil {
+			t.Fatalf("ReadProtocol %q failed %s", c, err)
+		}
+		var b bytes.Buffer
+		w := bufio.NewWriter(&b)
+		if err := WriteProtocol(w, r); err != nil {
+			t.Fatalf("WriteProtocol %q failed %s", c, err)
+		}
+		if b.String() != c {
+			t.Fatalf("round trip got %q expected %q", b.String(), c)
+		}
+	}
+}
+
+func Test_ArrayRespArg(t *testing.T) {
+	r, err := ReadProtocol(bufio.NewReader(bytes.NewBufferString("*3\r\n$3\r\nGET\r\n$3\r\nkey\r\n:1\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ar := r.(*ArrayResp)
+	if string(ar.Arg(1)) != "key" || ar.Arg(2) != nil || ar.Arg(3) != nil {
+		t.Fatal("ArrayResp Arg wrong ", ar.String())
+	}
+	if ar.IsCommand() {
+		t.Fatal("ArrayResp with IntResp must not be a command")
+	}
+}
+
+func Test_ReadProtocolRESP3(t *testing.T) {
+	cases := []string{
+		"%2\r\n+first\r\n:1\r\n$6\r\nsecond\r\n*2\r\n:2\r\n_\r\n",
+		"~2\r\n$1\r\na\r\n$1\r\nb\r\n",
+		">3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$5\r\nhello\r\n",
+		"|1\r\n+ttl\r\n:3600\r\n$5\r\nvalue\r\n",
+		",3.14\r\n",
+		"#t\r\n",
+		"(3492890328409238509324850943850943825024385\r\n",
+		"=15\r\ntxt:Some string\r\n",
+		"_\r\n",
+	}
+	for _, c := range cases {
+		r, err := ReadProtocol(bufio.NewReader(bytes.NewBufferString(c)))
+		if err != nil {
+			t.Fatalf("ReadProtocol %q failed %s", c, err)
+		}
+		var b bytes.Buffer
+		w := bufio.NewWriter(&b)
+		if err := WriteProtocol(w, r); err != nil {
+			t.Fatalf("WriteProtocol %q failed %s", c, err)
+		}
+		if b.String() != c {
+			t.Fatalf("round trip got %q expected %q", b.String(), c)
+		}
+	}
+}
+
+func Test_ToRESP3(t *testing.T) {
+	cases := []struct {
+		in   string
+		kind string
+		out  string
+	}{
+		{"*4\r\n$1\r\nf\r\n$1\r\nv\r\n$2\r\nf2\r\n$2\r\nv2\r\n", Reply3Map, "%2\r\n$1\r\nf\r\n$1\r\nv\r\n$2\r\nf2\r\n$2\r\nv2\r\n"},
+		{"*1\r\n$1\r\na\r\n", Reply3Set, "~1\r\n$1\r\na\r\n"},
+		{"$3\r\n1.5\r\n", Reply3Double, ",1.5\r\n"},
+		{"*2\r\n$1\r\nm\r\n$1\r\n2\r\n", Reply3ScorePairs, "*1\r\n*2\r\n$1\r\nm\r\n,2\r\n"},
+		{"*2\r\n$-1\r\n$1\r\nv\r\n", "", "*2\r\n_\r\n$1\r\nv\r\n"},
+		{"$-1\r\n", "", "_\r\n"},
+	}
+	for _, c := range cases {
+		r, err := ReadProtocol(bufio.NewReader(bytes.NewBufferString(c.in)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		w := bufio.NewWriter(&b)
+		WriteProtocol(w, ToRESP3(r, c.kind))
+		if b.String() != c.out {
+			t.Fatalf("ToRESP3 %q got %q expected %q", c.in, b.String(), c.out)
+		}
+	}
+}
+
+func Test_ReadProtocolInline(t *testing.T) {
+	r := bufio.NewReader(bytes.NewBufferString("\r\nping\nset foo \"hello world\"\r\n*1\r\n$4\r\nQUIT\r\n"))
+	for _, expected := range []string{"ping", "set foo hello world", "QUIT"} {
+		resp, err := ReadProtocol(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ar, ok := resp.(*ArrayResp)
+		if !ok || !ar.IsCommand() || ar.String() != expected {
+			t.Fatalf("ReadProtocol inline got %q expected %q", resp.String(), expected)
+		}
+	}
+
+	_, err := ReadProtocol(bufio.NewReader(bytes.NewBufferString("set foo \"bar\r\n")))
+	if err != InlineQuotesError {
+		t.Fatal("ReadProtocol unbalanced quotes must fail ", err)
+	}
+}
+
+func Test_ReadProtocolLimit(t *testing.T) {
+	limit := &ProtoLimit{
+		MaxBulkLen:     8,
+		MaxMultiBulk:   3,
+		MaxInlineLen:   24,
+		MaxRequestSize: 32,
+	}
+	cases := []struct {
+		in  string
+		err error
+	}{
+		{"*1\r\n$9\r\n123456789\r\n", ProtoBulkLenError},
+		{"*4\r\n$1\r\na\r\n$1\r\na\r\n$1\r\na\r\n$1\r\na\r\n", ProtoMultiBulkError},
+		{"set foo 12345678901234567890\r\n", ProtoInlineError},
+		{"*3\r\n$8\r\n12345678\r\n$8\r\n12345678\r\n$8\r\n12345678\r\n", ProtoRequestError},
+		{"*1\r\n$99999999999999999999\r\n", ProtoBulkLenError},
+		{"*1\r\n$-5\r\n", ProtoBulkLenError},
+		{"*1\r\n$3\r\nfoobar\r\n", ReadRespUnexpectedError},
+	}
+	for _, c := range cases {
+		_, err := ReadProtocolLimit(bufio.NewReader(bytes.NewBufferString(c.in)), limit)
+		if err != c.err {
+			t.Fatalf("ReadProtocolLimit %q got %v expected %v", c.in, err, c.err)
+		}
+		if !IsProtocolError(err) {
+			t.Fatalf("%v must be protocol error", err)
+		}
+	}
+
+	r, err := ReadProtocolLimit(bufio.NewReader(bytes.NewBufferString("*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n")), limit)
+	if err != nil || r.String() != "GET foo" {
+		t.Fatal("ReadProtocolLimit failed ", err)
+	}
+}
+
+func Test_ReadProtocolStream(t *testing.T) {
+	r := bufio.NewReader(bytes.NewBufferString("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$10\r\n0123456789\r\n*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n"))
+	resp, err := ReadProtocolStream(r, nil, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ar := resp.(*ArrayResp)
+	sb := ar.Stream()
+	if sb == nil || sb.Len != 10 {
+		t.Fatal("last argument must be streamed ", ar.String())
+	}
+
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	if err := WriteProtocol(w, ar); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$10\r\n0123456789\r\n" {
+		t.Fatalf("stream encode got %q", b.String())
+	}
+	select {
+	case <-sb.Done():
+	default:
+		t.Fatal("stream must be done after encode")
+	}
+
+	// 读取下一个请求，key 不会被流式读取
+	resp, err = ReadProtocolStream(r, nil, 2)
+	if err != nil || resp.String() != "GET key" {
+		t.Fatal("ReadProtocolStream next command failed ", err)
+	}
+
+	// 最外层的 bulk 回复
+	r = bufio.NewReader(bytes.NewBufferString("$10\r\n0123456789\r\n+OK\r\n"))
+	resp, err = ReadProtocolStream(r, nil, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var released bool
+	sb = resp.(*StreamBulkResp)
+	sb.release = func(err error) { released = err == nil }
+	br, err := sb.Materialize()
+	if err != nil || string(br.Args[0]) != "0123456789" || !released {
+		t.Fatal("StreamBulkResp Materialize failed ", err)
+	}
+	resp, err = ReadProtocol(r)
+	if err != nil || resp.String() != "OK" {
+		t.Fatal("ReadProtocol after stream failed ", err)
+	}
+
+	// 命令的最后一个参数是 key 时读到内存
+	r = bufio.NewReader(bytes.NewBufferString("*3\r\n$6\r\nSINTER\r\n$1\r\na\r\n$10\r\n0123456789\r\n"))
+	resp, err = ReadProtocolStream(r, nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ar = resp.(*ArrayResp)
+	if !ar.IsCommand() || ar.Stream() == nil {
+		t.Fatal("stream arg should be accepted as command")
+	}
+	if err := ar.materializeKeys(commandTable["SINTER"]); err != nil || ar.Stream() != nil || string(ar.Arg(2)) != "0123456789" {
+		t.Fatal("materializeKeys failed ", err)
+	}
+}
+
+func Test_ReadProtocolPooled(t *testing.T) {
+	in := "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n*2\r\n:1\r\n+OK\r\n"
+	for i := 0; i < 3; i++ {
+		resp, err := ReadProtocolPooled(bufio.NewReader(bytes.NewBufferString(in)), nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		w := bufio.NewWriter(&b)
+		WriteProtocol(w, resp)
+		if b.String() != in {
+			t.Fatalf("pooled round trip got %q", b.String())
+		}
+		Release(resp)
 	}
 }
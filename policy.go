@@ -0,0 +1,159 @@
+package archer
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/astaxie/beego/config"
+)
+
+// CommandPolicy 单个命令的访问策略，来自配置文件的 [commands] section
+// 每行一个命令，值由下面几个子句组成，deny 必须放在最后
+//
+//	allow          允许 blackList 中的命令
+//	arity N        覆盖命令表中的 arity，含义和 Redis 一致
+//	maxargs N      参数个数上限，包含命令名
+//	deny [message] 禁止命令，message 是返回给客户端的错误，默认 command forbidden
+//
+// 例如
+//
+//	keys=deny ERR KEYS is disabled, use SCAN
+//	scan=allow
+//	del=maxargs 1001
+//
+// file 指定外部文件，格式相同，同名命令以主配置为准
+type CommandPolicy struct {
+	Deny    bool
+	Allow   bool
+	Arity   int // 0 表示使用命令表
+	MaxArgs int // 0 表示不限制
+
+	err error
+}
+
+// Err 禁止时返回给客户端的错误
+func (p *CommandPolicy) Err() error {
+	if p.err != nil {
+		return p.err
+	}
+	return CommandForbidden
+}
+
+// CheckArity 检查参数个数，n 包含命令名
+func (p *CommandPolicy) CheckArity(ci *CommandInfo, n int) bool {
+	if p == nil {
+		return ci.CheckArity(n)
+	}
+	if p.MaxArgs > 0 && n > p.MaxArgs {
+		return false
+	}
+	if p.Arity != 0 {
+		return (&CommandInfo{Arity: p.Arity}).CheckArity(n)
+	}
+	return ci.CheckArity(n)
+}
+
+// check 结合 blackList 判断命令是否被禁止，配置中的策略优先
+func (p *CommandPolicy) check(black bool) error {
+	switch {
+	case p != nil && p.Deny:
+		return p.Err()
+	case p != nil && p.Allow:
+		return nil
+	case black:
+		return CommandForbidden
+	}
+	return nil
+}
+
+// ParseCommandPolicies 解析 name=policy，name 必须在命令表中
+func ParseCommandPolicies(section map[string]string) (map[string]*CommandPolicy, error) {
+	policies := make(map[string]*CommandPolicy, len(section))
+	for name, value := range section {
+		name = strings.ToUpper(name)
+		if _, ok := commandTable[name]; !ok {
+			return nil, fmt.Errorf("command policy unknown command %s", name)
+		}
+		p, err := parseCommandPolicy(value)
+		if err != nil {
+			return nil, fmt.Errorf("command policy %s: %s", name, err.Error())
+		}
+		policies[name] = p
+	}
+	return policies, nil
+}
+
+func parseCommandPolicy(value string) (*CommandPolicy, error) {
+	p := &CommandPolicy{}
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return nil, errors.New("empty policy")
+	}
+	for i := 0; i < len(fields); i++ {
+		switch strings.ToLower(fields[i]) {
+		case "allow":
+			p.Allow = true
+		case "deny":
+			p.Deny = true
+			if i+1 < len(fields) {
+				p.err = errors.New(strings.Join(fields[i+1:], " "))
+			}
+			i = len(fields)
+		case "arity", "maxargs":
+			if i+1 >= len(fields) {
+				return nil, fmt.Errorf("%s needs a number", fields[i])
+			}
+			n, err := strconv.Atoi(fields[i+1])
+			if err != nil || n == 0 {
+				return nil, fmt.Errorf("%s wrong number %s", fields[i], fields[i+1])
+			}
+			if strings.EqualFold(fields[i], "arity") {
+				p.Arity = n
+			} else if n < 0 {
+				return nil, fmt.Errorf("maxargs wrong number %s", fields[i+1])
+			} else {
+				p.MaxArgs = n
+			}
+			i++
+		default:
+			return nil, fmt.Errorf("unknown clause %s", fields[i])
+		}
+	}
+	if p.Allow && p.Deny {
+		return nil, errors.New("allow and deny at the same time")
+	}
+	return p, nil
+}
+
+// loadCommandPolicies 读取 [commands] section 和 file 指定的外部文件
+func loadCommandPolicies(c config.Configer) (map[string]*CommandPolicy, error) {
+	merged := make(map[string]string)
+	section, err := c.GetSection("commands")
+	if err != nil {
+		// 没有 [commands] section
+		section = nil
+	}
+
+	if file := section["file"]; file != "" {
+		fc, err := config.NewConfig("ini", file)
+		if err != nil {
+			return nil, fmt.Errorf("read commands file %s failed %s", file, err.Error())
+		}
+		fs, err := fc.GetSection("commands")
+		if err != nil {
+			return nil, fmt.Errorf("commands file %s has no [commands] section", file)
+		}
+		for k, v := range fs {
+			merged[k] = v
+		}
+	}
+	for k, v := range section {
+		if k == "file" {
+			continue
+		}
+		merged[k] = v
+	}
+	return ParseCommandPolicies(merged)
+}
@@ -0,0 +1,113 @@
+package archer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/astaxie/beego/config"
+)
+
+func Test_ParseCommandPolicies(t *testing.T) {
+	ps, err := ParseCommandPolicies(map[string]string{
+		"keys": "deny ERR KEYS is disabled, use SCAN",
+		"scan": "allow",
+		"mget": "arity -2 maxargs 3",
+		"get":  "deny",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := ps["KEYS"]; !p.Deny || p.Err().Error() != "ERR KEYS is disabled, use SCAN" {
+		t.Fatalf("KEYS %+v", p)
+	}
+	if p := ps["GET"]; p.Err() != CommandForbidden {
+		t.Fatalf("GET %+v", p)
+	}
+	if p := ps["MGET"]; p.Arity != -2 || p.MaxArgs != 3 {
+		t.Fatalf("MGET %+v", p)
+	}
+
+	for _, bad := range []map[string]string{
+		{"nosuchcommand": "deny"},
+		{"get": "arity"},
+		{"get": "arity x"},
+		{"get": "maxargs -1"},
+		{"get": "allow deny"},
+		{"get": "permit"},
+		{"get": ""},
+	} {
+		if _, err := ParseCommandPolicies(bad); err == nil {
+			t.Fatalf("%v expect error", bad)
+		}
+	}
+}
+
+func Test_FilterPolicies(t *testing.T) {
+	ps, err := ParseCommandPolicies(map[string]string{
+		"keys":   "deny ERR KEYS is disabled, use SCAN",
+		"scan":   "allow",
+		"mget":   "maxargs 3",
+		"set":    "arity 3",
+		"client": "deny",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]string{
+		"KEYS *":         "ERR KEYS is disabled, use SCAN",
+		"SCAN 0":         "",
+		"MGET a b":       "",
+		"MGET a b c":     WrongArgumentCount.Error(),
+		"SET a b":        "",
+		"SET a b NX":     WrongArgumentCount.Error(),
+		"CLIENT GETNAME": CommandForbidden.Error(),
+		"FLUSHALL":       CommandForbidden.Error(),
+		"GET a":          "",
+	}
+	for _, f := range []Filter{NewFilter("str", ps), NewFilter("trie", ps)} {
+		for line, want := range cases {
+			_, err := f.Inspect(newTestCommand(line))
+			got := ""
+			if err != nil {
+				got = err.Error()
+			}
+			if got != want {
+				t.Fatalf("%T %s got %q want %q", f, line, got, want)
+			}
+		}
+	}
+}
+
+func Test_LoadCommandPolicies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "commands.conf")
+	ioutil.WriteFile(file, []byte("[commands]\nkeys=deny\nscan=allow\n"), 0644)
+	main := filepath.Join(dir, "proxy.conf")
+	ioutil.WriteFile(main, []byte("[proxy]\nname=test\n[commands]\nfile="+file+"\nKEYS=deny ERR no keys\n"), 0644)
+
+	c, err := config.NewConfig("ini", main)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps, err := loadCommandPolicies(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 2 || !ps["SCAN"].Allow || ps["KEYS"].Err().Error() != "ERR no keys" {
+		t.Fatalf("got %+v", ps)
+	}
+
+	// 没有 [commands] section
+	ioutil.WriteFile(main, []byte("[proxy]\nname=test\n"), 0644)
+	c, _ = config.NewConfig("ini", main)
+	if ps, err := loadCommandPolicies(c); err != nil || len(ps) != 0 {
+		t.Fatalf("got %v %v", ps, err)
+	}
+}
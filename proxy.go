@@ -9,24 +9,45 @@ import (
 	log "github.com/ngaut/logging"
 )
 
+// HELLO 回复中的 version
+const Version = "0.1.0"
+
 type Proxy struct {
 	l net.Listener // 监听 Listener
 
 	filter Filter // Redis 有效协议检测过滤器
 
+	limit *ProtoLimit // 客户端请求大小限制
+
+	acl *ACL // 客户端认证和权限
+
 	pc *ProxyConfig // 全局配置文件
 
 	sm *SessMana // Session 管理
 
 	cluster *Cluster // 集群实现
+
+	scripts *scriptCache // EVAL 和 SCRIPT LOAD 的脚本
 }
 
 func NewProxy(pc *ProxyConfig) *Proxy {
 	p := &Proxy{
 		sm:      newSessMana(pc.idleTimeout),
 		cluster: NewCluster(pc),
-		filter:  &StrFilter{},
+		filter:  NewFilter(pc.filter, pc.commands),
+		acl:     pc.acl,
 		pc:      pc,
+		scripts: newScriptCache(pc.maxScripts),
+		limit: &ProtoLimit{
+			MaxBulkLen:     pc.maxBulkLen,
+			MaxMultiBulk:   pc.maxMultiBulk,
+			MaxInlineLen:   pc.maxInlineLen,
+			MaxRequestSize: pc.maxRequestSize,
+		},
+	}
+
+	if p.acl == nil {
+		p.acl, _ = NewACL("", nil)
 	}
 
 	// listen 放到最后
@@ -59,6 +80,11 @@ func (p *Proxy) Start() {
 	}
 }
 
+// Close 停止接受新连接，已有的 Session 不受影响
+func (p *Proxy) Close() error {
+	return p.l.Close()
+}
+
 func HandleConn(p *Proxy, c net.Conn) {
 	s := NewSession(p, c)
 	p.sm.Put(c.RemoteAddr().String(), s)
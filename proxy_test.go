@@ -0,0 +1,1129 @@
+package archer
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dongzerun/archer/fakeredis"
+)
+
+// 集成测试: 真实的 Proxy 连接 fakeredis 启动的内存集群
+
+func newTestConfig(nodes []string) *ProxyConfig {
+	return &ProxyConfig{
+		name:            "test",
+		conCurrency:     5,
+		pipeLength:      4096,
+		maxBulkLen:      512 * 1024 * 1024,
+		maxMultiBulk:    1024 * 1024,
+		maxInlineLen:    64 * 1024,
+		maxRequestSize:  1024 * 1024 * 1024,
+		flushBytes:      64 * 1024,
+		flushDelay:      time.Millisecond,
+		nodes:           nodes,
+		poolSize:        4,
+		blockPoolSize:   8,
+		txPoolSize:      4,
+		reloadSlot:      time.Minute,
+		readTimeout:     5 * time.Second,
+		writeTimeout:    5 * time.Second,
+		dialTimeout:     time.Second,
+		streamThreshold: 0,
+		msetPolicy:      MSetError,
+		maxScripts:      100,
+	}
+}
+
+// opts 用来修改默认配置
+func newTestProxy(t *testing.T, masters, replicas int, opts ...func(*ProxyConfig)) (*Proxy, *fakeredis.Cluster) {
+	fc, err := fakeredis.NewCluster(masters, replicas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc := newTestConfig(fc.Addrs())
+	for _, opt := range opts {
+		opt(pc)
+	}
+	p := NewProxy(pc)
+	go p.Start()
+	t.Cleanup(func() {
+		p.Close()
+		fc.Close()
+	})
+	return p, fc
+}
+
+type testClient struct {
+	t *testing.T
+	c net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func dialProxy(t *testing.T, p *Proxy) *testClient {
+	c, err := net.Dial("tcp4", p.l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	t.Cleanup(func() { c.Close() })
+	return &testClient{t: t, c: c, r: bufio.NewReader(c), w: bufio.NewWriter(c)}
+}
+
+func (tc *testClient) send(args ...string) {
+	bs := make([][]byte, len(args))
+	for i, a := range args {
+		bs[i] = []byte(a)
+	}
+	if err := NewCommand(bs...).Encode(tc.w); err != nil {
+		tc.t.Fatal(err)
+	}
+}
+
+func (tc *testClient) read() Resp {
+	tc.w.Flush()
+	r, err := ReadProtocol(tc.r)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	return r
+}
+
+func (tc *testClient) do(args ...string) Resp {
+	tc.send(args...)
+	return tc.read()
+}
+
+func (tc *testClient) expect(want string, args ...string) {
+	tc.t.Helper()
+	if got := tc.do(args...).String(); got != want {
+		tc.t.Fatalf("%v got %q want %q", args, got, want)
+	}
+}
+
+func Test_ProxyCommands(t *testing.T) {
+	p, _ := newTestProxy(t, 3, 1)
+	c := dialProxy(t, p)
+
+	c.expect("PONG", "PING")
+	for i := 0; i < 50; i++ {
+		c.expect("OK", "SET", fmt.Sprintf("key:%d", i), fmt.Sprintf("v%d", i))
+	}
+	for i := 0; i < 50; i++ {
+		c.expect(fmt.Sprintf("v%d", i), "GET", fmt.Sprintf("key:%d", i))
+	}
+	c.expect("1", "INCR", "{key}:counter")
+	c.expect("2", "INCR", "{key}:counter")
+	c.expect("OK", "MSET", "a", "1", "b", "2", "c", "3")
+	c.expect("1 2 3", "MGET", "a", "b", "c")
+	c.expect("3", "DEL", "a", "b", "c")
+	c.expect("", "MGET", "a")
+
+	// inline command
+	c.w.WriteString("GET key:1\r\n")
+	if got := c.read().String(); got != "v1" {
+		t.Fatalf("inline got %q", got)
+	}
+}
+
+func Test_ProxyPipeline(t *testing.T) {
+	p, _ := newTestProxy(t, 3, 0)
+	c := dialProxy(t, p)
+
+	// 同一个 pipeline 中的命令并发执行，只保证回复顺序
+	n := 200
+	for i := 0; i < n; i++ {
+		c.send("SET", fmt.Sprintf("pipe:%d", i), fmt.Sprint(i))
+	}
+	for i := 0; i < n; i++ {
+		if got := c.read().String(); got != "OK" {
+			t.Fatalf("SET %d got %q", i, got)
+		}
+	}
+	for i := 0; i < n; i++ {
+		c.send("GET", fmt.Sprintf("pipe:%d", i))
+	}
+	for i := 0; i < n; i++ {
+		if got := c.read().String(); got != fmt.Sprint(i) {
+			t.Fatalf("GET %d got %q", i, got)
+		}
+	}
+}
+
+func Test_ProxyTopology(t *testing.T) {
+	p, fc := newTestProxy(t, 3, 2)
+
+	nodes := fc.Nodes()
+	ids := make(map[string]bool)
+	for _, s := range p.cluster.topo.slots {
+		if s == nil {
+			t.Fatal("slot not covered")
+		}
+		if len(s.slaves) != 2 {
+			t.Fatalf("slot %d slaves %d", s.id, len(s.slaves))
+		}
+		ids[s.master.id] = true
+	}
+	if len(ids) != 3 || len(nodes) != 9 {
+		t.Fatalf("masters %d nodes %d", len(ids), len(nodes))
+	}
+
+	slot := fakeredis.Slot("foo")
+	if got, want := p.cluster.topo.GetNodeID([]byte("foo"), false), fc.Owner(slot).Addr; got != want {
+		t.Fatalf("GetNodeID got %s want %s", got, want)
+	}
+	replica := p.cluster.topo.GetNodeID([]byte("foo"), true)
+	if n := fc.Replicas(fc.Owner(slot)); replica != n[0].Addr && replica != n[1].Addr {
+		t.Fatalf("GetNodeID slave got %s", replica)
+	}
+}
+
+func Test_ProxyMoved(t *testing.T) {
+	p, fc := newTestProxy(t, 3, 0)
+	c := dialProxy(t, p)
+
+	c.expect("OK", "SET", "foo", "bar")
+
+	slot := fakeredis.Slot("foo")
+	from := fc.Owner(slot)
+	var to *fakeredis.Node
+	for _, m := range fc.Masters() {
+		if m != from {
+			to = m
+			break
+		}
+	}
+	fc.MoveSlot(slot, to)
+
+	c.expect("bar", "GET", "foo")
+
+	// MOVED 触发拓扑重新加载
+	deadline := time.Now().Add(3 * time.Second)
+	for p.cluster.topo.GetNodeID([]byte("foo"), false) != to.Addr {
+		if time.Now().After(deadline) {
+			t.Fatal("topology not reloaded after MOVED")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.expect("bar", "GET", "foo")
+}
+
+func Test_ProxyAsk(t *testing.T) {
+	p, fc := newTestProxy(t, 2, 0)
+	c := dialProxy(t, p)
+
+	slot := fakeredis.Slot("foo")
+	from := fc.Owner(slot)
+	to := fc.Masters()[0]
+	if to == from {
+		to = fc.Masters()[1]
+	}
+	fc.SetMigrating(slot, to)
+
+	// 不存在的 key 回复 ASK，在目标节点 ASKING 之后执行
+	c.expect("OK", "SET", "foo", "bar")
+	c.expect("bar", "GET", "foo")
+	if got := p.cluster.topo.GetNodeID([]byte("foo"), false); got != from.Addr {
+		t.Fatalf("ASK should not change topology, got %s", got)
+	}
+}
+
+func Test_ProxyRedirectBrokenConn(t *testing.T) {
+	p, fc := newTestProxy(t, 2, 0)
+	c := dialProxy(t, p)
+
+	slot := fakeredis.Slot("foo")
+	to := fc.Masters()[0]
+	if to == fc.Owner(slot) {
+		to = fc.Masters()[1]
+	}
+	fc.SetMigrating(slot, to)
+
+	// 重定向的连接断开之后不能放回连接池
+	var calls int32
+	fc.Handle("GET", &fakeredis.Command{
+		Func: func(ctx *fakeredis.Ctx) fakeredis.Reply {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				ctx.CloseConn()
+			}
+			return []byte("bar")
+		},
+		Arity: 2, FirstKey: 1, LastKey: 1, Step: 1, ReadOnly: true,
+	})
+	if resp := c.do("GET", "foo"); resp.Type() != ErrorType {
+		t.Fatalf("broken redirect got %s", resp.String())
+	}
+	c.expect("bar", "GET", "foo")
+}
+
+func Test_ProxyInjectedError(t *testing.T) {
+	p, fc := newTestProxy(t, 3, 0)
+	c := dialProxy(t, p)
+
+	n := fc.NodeForKey("foo")
+	n.InjectError("GET", "ERR injected", 1)
+	c.expect("ERR injected", "GET", "foo")
+	c.expect("", "GET", "foo")
+
+	// 节点宕机之后回复错误，不影响其它节点
+	n.Stop()
+	if r := c.do("GET", "foo"); r.Type() != ErrorType {
+		t.Fatalf("stopped node got %s", r.String())
+	}
+	for i := 0; ; i++ {
+		key := fmt.Sprintf("other:%d", i)
+		if fc.NodeForKey(key) != n {
+			c.expect("OK", "SET", key, "v")
+			break
+		}
+	}
+}
+
+func Test_ProxyHello(t *testing.T) {
+	p, _ := newTestProxy(t, 3, 0)
+	c := dialProxy(t, p)
+
+	c.expect("1", "HSET", "h", "f", "v")
+	if r := c.do("HELLO", "3"); r.Type() != MapType {
+		t.Fatalf("HELLO 3 got %s", r.Type())
+	}
+	if r := c.do("HGETALL", "h"); r.Type() != MapType || r.String() != "f v" {
+		t.Fatalf("HGETALL got %s %q", r.Type(), r.String())
+	}
+	if r := c.do("GET", "nokey"); r.Type() != NullType {
+		t.Fatalf("nil bulk got %s", r.Type())
+	}
+}
+
+func Test_ProxyProtocolError(t *testing.T) {
+	p, _ := newTestProxy(t, 1, 0)
+	c := dialProxy(t, p)
+
+	c.w.WriteString("*1\r\n$abc\r\n")
+	r := c.read()
+	if r.Type() != ErrorType || !bytes.HasPrefix(r.base().Args[0], []byte("ERR Protocol error")) {
+		t.Fatalf("got %s", r.String())
+	}
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Fatal("connection should be closed after protocol error")
+	}
+}
+
+func Test_ProxyStream(t *testing.T) {
+	for _, filter := range []string{"str", "trie"} {
+		p, _ := newTestProxy(t, 3, 0, func(pc *ProxyConfig) {
+			pc.filter = filter
+			pc.streamThreshold = 1024
+		})
+		c := dialProxy(t, p)
+
+		// 超过阈值的 value 流式转发，回复也流式返回
+		big := strings.Repeat("v", 4096)
+		c.expect("OK", "SET", "foo", big)
+		c.expect(big, "GET", "foo")
+		c.expect("OK", "SET", "bar", "small")
+		c.expect("small", "GET", "bar")
+
+		// key 在最后一个参数时不流式读取，按完整的 key 计算 slot
+		key := "{s}" + strings.Repeat("k", 2048)
+		c.expect("OK", "SET", key, "v")
+		c.expect("1", "EXISTS", "{s}a", key)
+	}
+}
+
+func Test_ProxyPartialRequest(t *testing.T) {
+	p, _ := newTestProxy(t, 1, 0, func(pc *ProxyConfig) { pc.readTimeout = 200 * time.Millisecond })
+	c := dialProxy(t, p)
+
+	// 请求之间的读超时不关闭连接
+	time.Sleep(300 * time.Millisecond)
+	c.expect("OK", "SET", "foo", "bar")
+
+	// 请求读到一半超时，回复错误后关闭连接，不会把剩下的部分当作新的请求
+	c.w.WriteString("*2\r\n$3\r\nGET\r\n")
+	r := c.read()
+	if r.Type() != ErrorType || !bytes.HasPrefix(r.base().Args[0], []byte("ERR read request failed")) {
+		t.Fatalf("got %s", r.String())
+	}
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Fatal("connection should be closed after partial request")
+	}
+}
+
+func Test_ProxyQuit(t *testing.T) {
+	p, _ := newTestProxy(t, 1, 0)
+	c := dialProxy(t, p)
+
+	// QUIT 之后的请求不再处理
+	c.send("SET", "foo", "bar")
+	c.send("QUIT")
+	c.send("GET", "foo")
+	for _, want := range []string{"OK", "OK"} {
+		if got := c.read().String(); got != want {
+			t.Fatalf("got %q want %q", got, want)
+		}
+	}
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Fatal("connection should be closed after QUIT")
+	}
+}
+
+func Test_ProxySlaveOk(t *testing.T) {
+	p, fc := newTestProxy(t, 3, 1, func(pc *ProxyConfig) { pc.slaveOk = true })
+	c := dialProxy(t, p)
+
+	c.expect("OK", "SET", "foo", "bar")
+	c.expect("bar", "GET", "foo")
+
+	// 只读命令发到从库，写命令发到主库
+	replica := fc.Replicas(fc.NodeForKey("foo"))[0]
+	replica.InjectError("*", "ERR from replica", -1)
+	c.expect("ERR from replica", "GET", "foo")
+	c.expect("OK", "SET", "foo", "baz")
+
+	// 只有从库连接发送 READONLY
+	if n := replica.ReadOnlyClients(); n == 0 {
+		t.Fatal("replica connections without READONLY")
+	}
+	if n := fc.NodeForKey("foo").ReadOnlyClients(); n != 0 {
+		t.Fatalf("master got READONLY on %d connections", n)
+	}
+}
+
+func Test_ProxyTrieFilter(t *testing.T) {
+	for _, filter := range []string{"trie", "str"} {
+		p, _ := newTestProxy(t, 3, 0, func(pc *ProxyConfig) { pc.filter = filter })
+		c := dialProxy(t, p)
+
+		c.expect("OK", "set", "foo", "bar")
+		c.expect("bar", "get", "foo")
+		c.expect("", "client", "getname")
+		c.expect("OK", "client", "setname", "conn1")
+		c.expect("conn1", "CLIENT", "GETNAME")
+		c.expect(CommandForbidden.Error(), "CLIENT", "KILL", "1.1.1.1:1")
+		c.expect("1", "HSET", "h", "f", "v")
+		if r := c.do("HELLO", "3", "SETNAME", "conn2"); r.Type() != MapType {
+			t.Fatalf("HELLO got %s", r.String())
+		}
+		c.expect("conn2", "client", "getname")
+		// 命令没有被转换成大写，RESP3 转换仍然生效
+		if r := c.do("hgetall", "h"); r.Type() != MapType {
+			t.Fatalf("hgetall got %s", r.Type())
+		}
+	}
+}
+
+func Test_ProxyAuth(t *testing.T) {
+	p, _ := newTestProxy(t, 3, 0, func(pc *ProxyConfig) {
+		pc.acl, _ = NewACL("secret", map[string]string{
+			"reader": "on >pw +@read +@connection ~app:*",
+		})
+	})
+	c := dialProxy(t, p)
+
+	c.expect(NoAuthError.Error(), "GET", "foo")
+	c.expect(NoAuthError.Error(), "PING")
+	c.expect(string(HelloNoAuthError), "HELLO", "3")
+	c.expect(WrongPassError.Error(), "AUTH", "wrong")
+	c.expect("OK", "AUTH", "secret")
+	c.expect("OK", "SET", "app:1", "v")
+	c.expect("OK", "AUTH", "default", "secret")
+
+	r := dialProxy(t, p)
+	if resp := r.do("HELLO", "3", "AUTH", "reader", "pw"); resp.Type() != MapType {
+		t.Fatalf("HELLO AUTH got %s", resp.String())
+	}
+	r.expect("v", "GET", "app:1")
+	r.expect(NoPermKeyError.Error(), "GET", "foo")
+	r.expect("NOPERM User reader has no permissions to run the 'set' command", "SET", "app:1", "x")
+	r.expect("PONG", "PING")
+}
+
+func Test_ProxyBackendAuth(t *testing.T) {
+	fc, err := fakeredis.NewCluster(3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fc.Close()
+	fc.SetUser("archer", "secret")
+
+	pc := newTestConfig(fc.Addrs())
+	pc.redisUser = "wrong"
+	pc.redisPassword = "secret"
+	host, port, _ := net.SplitHostPort(fc.Masters()[0].Addr)
+	portNum, _ := strconv.Atoi(port)
+	if _, err := GetClusterNodes(host, portNum, pc); err == nil || strings.Contains(err.Error(), "secret") {
+		t.Fatalf("GetClusterNodes with wrong user got %v", err)
+	}
+
+	pc.redisUser = "archer"
+	pc.clientName = "archer-test"
+	pc.slaveOk = true
+	p := NewProxy(pc)
+	go p.Start()
+	defer p.Close()
+
+	c := dialProxy(t, p)
+	c.expect("OK", "SET", "foo", "bar")
+	c.expect("bar", "GET", "foo")
+
+	n := fc.NodeForKey("foo")
+	names := n.ClientNames()
+	if len(names) == 0 {
+		t.Fatal("no backend connections")
+	}
+	for _, name := range names {
+		if name != "archer-test" {
+			t.Fatalf("backend client name %q", name)
+		}
+	}
+}
+
+func Test_ProxyMGET(t *testing.T) {
+	p, fc := newTestProxy(t, 3, 0)
+	c := dialProxy(t, p)
+
+	n := 100
+	args := []string{"MGET"}
+	want := make([]string, 0, n+1)
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("mget:%d", i)
+		c.expect("OK", "SET", key, fmt.Sprint(i))
+		args = append(args, key)
+		want = append(want, fmt.Sprint(i))
+	}
+	args = append(args, "mget:missing")
+	want = append(want, "")
+
+	// MGET 不能退化成逐个 GET
+	for _, m := range fc.Masters() {
+		m.InjectError("GET", "ERR GET called", -1)
+	}
+
+	// 一个 slot 已经迁移，一个 slot 正在迁移，对应的子请求单独重定向
+	moved := fc.NodeForKey("mget:1")
+	for _, m := range fc.Masters() {
+		if m != moved {
+			fc.MoveSlot(fakeredis.Slot("mget:1"), m)
+			break
+		}
+	}
+	ask := fakeredis.Slot("mget:missing")
+	for _, m := range fc.Masters() {
+		if m != fc.Owner(ask) {
+			fc.SetMigrating(ask, m)
+			break
+		}
+	}
+
+	c.expect(strings.Join(want, " "), args...)
+}
+
+func Test_ProxyMSET(t *testing.T) {
+	p, fc := newTestProxy(t, 3, 0)
+	c := dialProxy(t, p)
+
+	args := []string{"MSET"}
+	for i := 0; i < 50; i++ {
+		args = append(args, fmt.Sprintf("mset:%d", i), fmt.Sprint(i))
+	}
+	for _, m := range fc.Masters() {
+		m.InjectError("SET", "ERR SET called", -1)
+	}
+	fc.MoveSlot(fakeredis.Slot("mset:0"), fc.Masters()[0])
+	c.expect("OK", args...)
+	c.expect("0 1 49", "MGET", "mset:0", "mset:1", "mset:49")
+
+	// 一个节点失败，其它节点的 key 已经写入
+	bad := fc.NodeForKey("mset:2")
+	bad.InjectError("MSET", "ERR injected", 1)
+	r := c.do("MSET", "mset:2", "x", "mset:0", "y")
+	if r.Type() != ErrorType || !strings.Contains(r.String(), "keys not set: mset:2") {
+		t.Fatalf("partial MSET got %s", r.String())
+	}
+	if bad != fc.NodeForKey("mset:0") {
+		c.expect("y", "GET", "mset:0")
+	}
+
+	p.pc.msetPolicy = MSetBestEffort
+	bad.InjectError("MSET", "ERR injected", 1)
+	c.expect("OK", "MSET", "mset:2", "x", "mset:0", "z")
+
+	c.expect("1", "MSETNX", "{nx}a", "1", "{nx}b", "2")
+	c.expect("0", "MSETNX", "{nx}a", "3", "{nx}c", "4")
+	c.expect(CrossSlotError.Error(), "MSETNX", "nx:a", "1", "nx:b", "2")
+}
+
+func Test_ProxySumKeys(t *testing.T) {
+	p, fc := newTestProxy(t, 3, 0)
+	c := dialProxy(t, p)
+
+	args := []string{"MSET"}
+	keys := []string{}
+	for i := 0; i < 30; i++ {
+		args = append(args, fmt.Sprintf("sum:%d", i), "v")
+		keys = append(keys, fmt.Sprintf("sum:%d", i))
+	}
+	c.expect("OK", args...)
+
+	c.expect("30", append([]string{"EXISTS", "sum:missing"}, keys...)...)
+	c.expect("2", "EXISTS", "sum:0", "sum:0")
+	c.expect("30", append([]string{"TOUCH"}, keys...)...)
+	c.expect("10", append([]string{"UNLINK"}, keys[:10]...)...)
+
+	// 任何一个子请求失败都回复错误，而不是少算，其它子请求已经执行
+	a := keys[10]
+	b := keys[11]
+	for _, k := range keys[12:] {
+		if fc.NodeForKey(k) != fc.NodeForKey(a) {
+			b = k
+			break
+		}
+	}
+	fc.NodeForKey(a).InjectError("DEL", "ERR injected", 1)
+	c.expect("ERR injected", "DEL", a, b)
+	c.expect("1", "DEL", a, b)
+}
+
+func Test_ProxySetOp(t *testing.T) {
+	p, fc := newTestProxy(t, 3, 0)
+	c := dialProxy(t, p)
+
+	// 三个 key 分布在不同节点
+	keys := []string{"set:a"}
+	for i := 0; len(keys) < 3; i++ {
+		k := fmt.Sprintf("set:%d", i)
+		dup := false
+		for _, o := range keys {
+			dup = dup || fc.NodeForKey(o) == fc.NodeForKey(k)
+		}
+		if !dup {
+			keys = append(keys, k)
+		}
+	}
+	a, b, d := keys[0], keys[1], keys[2]
+	c.expect("4", "SADD", a, "1", "2", "3", "4")
+	c.expect("3", "SADD", b, "3", "4", "5")
+	c.expect("2", "SADD", d, "4", "6")
+
+	c.expect("4", "SINTER", a, b, d)
+	c.expect("3 4", "SINTER", a, b)
+	c.expect("1 2 3 4 5 6", "SUNION", a, b, d)
+	c.expect("1 2", "SDIFF", a, b, d)
+	c.expect("", "SINTER", a, "set:missing")
+
+	c.expect("6", "SUNIONSTORE", b, a, b, d)
+	c.expect("1 2 3 4 5 6", "SMEMBERS", b)
+	c.expect("0", "SINTERSTORE", d, a, "set:missing")
+	c.expect("0", "EXISTS", d)
+
+	// DEL 和 SADD 在一个事务中执行，SADD 失败时 destination 保持原样
+	fc.NodeForKey(b).InjectError("SADD", "ERR injected", 1)
+	c.expect("ERR injected", "SUNIONSTORE", b, a, "set:missing")
+	c.expect("1 2 3 4 5 6", "SMEMBERS", b)
+
+	// destination 的 slot 迁走之后回复 MOVED，在新的节点重试
+	fc.MoveSlot(fakeredis.Slot(b), fc.NodeForKey(a))
+	c.expect("6", "SUNIONSTORE", b, a, b)
+	c.expect("1 2 3 4 5 6", "SMEMBERS", b)
+
+	// 同一个 slot 直接转发
+	c.expect("2", "SADD", "{s}x", "1", "2")
+	c.expect("1", "SADD", "{s}y", "2")
+	c.expect("2", "SINTER", "{s}x", "{s}y")
+
+	c.expect("OK", "SET", "set:str", "v")
+	c.expect("WRONGTYPE Operation against a key holding the wrong kind of value", "SUNION", a, "set:str")
+
+	p.pc.maxSetMembers = 5
+	c.expect("ERR SUNION on 10 members exceeds maxsetmembers 5", "SUNION", a, b)
+}
+
+func Test_ProxyZSetOp(t *testing.T) {
+	p, fc := newTestProxy(t, 3, 0)
+	c := dialProxy(t, p)
+
+	a, b := "zset:a", "zset:b"
+	for i := 0; fc.NodeForKey(a) == fc.NodeForKey(b); i++ {
+		b = fmt.Sprintf("zset:%d", i)
+	}
+	c.expect("3", "ZADD", a, "1", "x", "2", "y", "3", "z")
+	c.expect("2", "ZADD", b, "10", "y", "inf", "w")
+
+	c.expect("x 1 z 3 y 12 w inf", "ZUNION", "2", a, b, "WITHSCORES")
+	c.expect("y 22", "ZINTER", "2", a, b, "WEIGHTS", "1", "2", "WITHSCORES")
+	c.expect("y 2", "ZINTER", "2", a, b, "AGGREGATE", "MIN", "WITHSCORES")
+	c.expect("x z", "ZDIFF", "2", a, b)
+	c.expect("w x y z", "ZUNION", "2", a, b, "WEIGHTS", "1", "0", "AGGREGATE", "MAX")
+
+	dest := "zset:dest"
+	c.expect("4", "ZUNIONSTORE", dest, "2", a, b, "AGGREGATE", "MAX")
+	c.expect("x 1 z 3 y 10 w inf", "ZRANGE", dest, "0", "-1", "WITHSCORES")
+	c.expect("1", "ZINTERSTORE", dest, "2", a, b, "WEIGHTS", "2", "0.5")
+	c.expect("9", "ZSCORE", dest, "y")
+	c.expect("0", "ZINTERSTORE", dest, "2", a, "zset:missing")
+	c.expect("0", "EXISTS", dest)
+
+	// DEL 和 ZADD 在一个事务中执行，ZADD 失败时 destination 保持原样
+	c.expect("1", "ZADD", dest, "5", "keep")
+	fc.NodeForKey(dest).InjectError("ZADD", "ERR injected", 1)
+	c.expect("ERR injected", "ZUNIONSTORE", dest, "2", a, b)
+	c.expect("keep 5", "ZRANGE", dest, "0", "-1", "WITHSCORES")
+
+	// set 类型的输入成员分数为 1，乘以权重
+	set := "zset:set"
+	for i := 0; fc.NodeForKey(set) == fc.NodeForKey(a); i++ {
+		set = fmt.Sprintf("zset:set:%d", i)
+	}
+	c.expect("2", "SADD", set, "x", "v")
+	c.expect("y 2 v 3 z 3 x 4", "ZUNION", "2", a, set, "WEIGHTS", "1", "3", "WITHSCORES")
+	c.expect("1", "ZINTERSTORE", dest, "2", a, set, "WEIGHTS", "1", "3")
+	c.expect("4", "ZSCORE", dest, "x")
+	c.expect("z", "ZDIFF", "3", a, b, set)
+	c.expect("OK", "SET", "zset:str", "v")
+	c.expect("WRONGTYPE Operation against a key holding the wrong kind of value", "ZUNIONSTORE", dest, "2", a, "zset:str")
+
+	c.expect(SyntaxError.Error(), "ZUNION", "2", a, b, "AGGREGATE", "AVG")
+	c.expect(WeightNotFloatError.Error(), "ZUNION", "2", a, b, "WEIGHTS", "1", "x")
+	c.expect(SyntaxError.Error(), "ZDIFF", "2", a, b, "WEIGHTS", "1", "1")
+
+	// 同一个 slot 直接转发
+	fc.Handle("ZUNIONSTORE", &fakeredis.Command{
+		Func:  func(ctx *fakeredis.Ctx) fakeredis.Reply { return 42 },
+		Arity: -4, FirstKey: 1, LastKey: 1, Step: 1,
+	})
+	c.expect("42", "ZUNIONSTORE", "{z}d", "2", "{z}a", "{z}b")
+}
+
+func Test_ProxyRename(t *testing.T) {
+	p, fc := newTestProxy(t, 3, 0)
+	c := dialProxy(t, p)
+
+	src, dst := "rename:src", "rename:dst"
+	for i := 0; fc.NodeForKey(src) == fc.NodeForKey(dst); i++ {
+		dst = fmt.Sprintf("rename:%d", i)
+	}
+
+	c.expect("3", "SADD", src, "a", "b", "c")
+	c.expect("1", "PEXPIRE", src, "100000")
+	c.expect("OK", "RENAME", src, dst)
+	c.expect("0", "EXISTS", src)
+	c.expect("a b c", "SMEMBERS", dst)
+	c.expect("100000", "PTTL", dst)
+	c.expect(string(NoSuchKeyError), "RENAME", src, dst)
+
+	// RENAMENX 目标存在时不覆盖
+	c.expect("OK", "SET", src, "v")
+	c.expect("0", "RENAMENX", src, dst)
+	c.expect("v", "GET", src)
+	c.expect("1", "DEL", dst)
+	c.expect("1", "RENAMENX", src, dst)
+	c.expect("v", "GET", dst)
+	c.expect("-1", "PTTL", dst)
+
+	// RESTORE 失败时不删除源 key
+	c.expect("OK", "SET", src, "w")
+	fc.NodeForKey(dst).InjectError("RESTORE", "ERR injected", 1)
+	c.expect("ERR injected", "RENAME", src, dst)
+	c.expect("w", "GET", src)
+
+	// 同一个 slot 直接转发
+	fc.Handle("RENAME", &fakeredis.Command{
+		Func:  func(ctx *fakeredis.Ctx) fakeredis.Reply { return fakeredis.Status("PASSED") },
+		Arity: 3, FirstKey: 1, LastKey: 2, Step: 1,
+	})
+	c.expect("PASSED", "RENAME", "{r}a", "{r}b")
+}
+
+// scanAll 用 SCAN 遍历所有 key，返回 key 的集合和调用次数
+func (tc *testClient) scanAll(opts ...string) (map[string]int, int) {
+	tc.t.Helper()
+	keys := make(map[string]int)
+	cursor, calls := "0", 0
+	for {
+		r := tc.do(append([]string{"SCAN", cursor}, opts...)...)
+		ar, ok := r.(*ArrayResp)
+		if !ok || len(ar.Args) != 2 {
+			tc.t.Fatalf("SCAN got %s", r.String())
+		}
+		calls++
+		for _, k := range ar.Args[1].(*ArrayResp).Args {
+			keys[k.String()]++
+		}
+		cursor = ar.Args[0].String()
+		if cursor == "0" {
+			return keys, calls
+		}
+	}
+}
+
+func Test_ProxyScan(t *testing.T) {
+	p, _ := newTestProxy(t, 3, 0)
+	c := dialProxy(t, p)
+
+	for i := 0; i < 40; i++ {
+		c.expect("OK", "SET", fmt.Sprintf("scan:%d", i), "v")
+	}
+	c.expect("1", "HSET", "scan:h", "f", "v")
+	c.expect("2", "SADD", "scan:s", "a", "b")
+
+	keys, calls := c.scanAll("COUNT", "5")
+	if len(keys) != 42 || calls < 9 {
+		t.Fatalf("SCAN got %d keys in %d calls", len(keys), calls)
+	}
+	for k, n := range keys {
+		if n != 1 {
+			t.Fatalf("SCAN returned %s %d times", k, n)
+		}
+	}
+	if keys, _ := c.scanAll("MATCH", "scan:1*"); len(keys) != 11 {
+		t.Fatalf("SCAN MATCH got %v", keys)
+	}
+	if keys, _ := c.scanAll("TYPE", "hash"); len(keys) != 1 || keys["scan:h"] != 1 {
+		t.Fatalf("SCAN TYPE got %v", keys)
+	}
+	c.expect(string(InvalidCursorError), "SCAN", fmt.Sprint(uint64(3)<<scanNodeShift))
+	c.expect(string(InvalidCursorError), "SCAN", "x")
+
+	// HSCAN SSCAN 按 key 路由，回复是嵌套数组
+	r := c.do("HSCAN", "scan:h", "0")
+	if ar, ok := r.(*ArrayResp); !ok || len(ar.Args) != 2 || ar.Args[0].String() != "0" || ar.Args[1].String() != "f v" {
+		t.Fatalf("HSCAN got %s", r.String())
+	}
+	r = c.do("SSCAN", "scan:s", "0", "MATCH", "a")
+	if ar, ok := r.(*ArrayResp); !ok || len(ar.Args) != 2 || ar.Args[1].String() != "a" {
+		t.Fatalf("SSCAN got %s", r.String())
+	}
+}
+
+func Test_ProxyKeyspace(t *testing.T) {
+	p, _ := newTestProxy(t, 3, 0)
+	c := dialProxy(t, p)
+
+	// 默认禁止
+	c.expect(CommandForbidden.Error(), "DBSIZE")
+	c.expect(CommandForbidden.Error(), "FLUSHALL")
+
+	policies, _ := ParseCommandPolicies(map[string]string{
+		"keys": "allow", "dbsize": "allow", "randomkey": "allow", "flushdb": "allow",
+	})
+	p.filter = NewFilter("trie", policies)
+
+	c.expect("", "RANDOMKEY")
+	for i := 0; i < 30; i++ {
+		c.expect("OK", "SET", fmt.Sprintf("ks:%d", i), "v")
+	}
+	c.expect("30", "DBSIZE")
+	r := c.do("KEYS", "ks:1*")
+	if ar, ok := r.(*ArrayResp); !ok || len(ar.Args) != 11 {
+		t.Fatalf("KEYS got %s", r.String())
+	}
+	if r := c.do("RANDOMKEY").String(); !strings.HasPrefix(r, "ks:") {
+		t.Fatalf("RANDOMKEY got %s", r)
+	}
+	c.expect(CommandForbidden.Error(), "FLUSHALL")
+	c.expect("OK", "FLUSHDB")
+	c.expect("0", "DBSIZE")
+	c.expect("", "RANDOMKEY")
+
+	acl, _ := NewACL("", map[string]string{"app": "on >pw allcommands -@dangerous allkeys"})
+	p.acl = acl
+	c.expect("OK", "AUTH", "app", "pw")
+	c.expect("NOPERM User app has no permissions to run the 'flushdb' command", "FLUSHDB")
+	c.expect("0", "DBSIZE")
+}
+
+func Test_ProxyTransaction(t *testing.T) {
+	p, fc := newTestProxy(t, 3, 0)
+	c := dialProxy(t, p)
+
+	c.expect("OK", "MULTI")
+	c.expect("QUEUED", "SET", "{tx}a", "1")
+	c.expect("QUEUED", "INCR", "{tx}a")
+	c.expect("QUEUED", "GET", "{tx}a")
+	c.expect("OK 2 2", "EXEC")
+	c.expect(string(ExecNoMultiError), "EXEC")
+	c.expect(string(DiscardNoMultiError), "DISCARD")
+
+	// 无 key 的命令先在 proxy 中排队
+	c.expect("OK", "MULTI")
+	c.expect("QUEUED", "PING")
+	c.expect(string(NestedMultiError), "MULTI")
+	c.expect("QUEUED", "GET", "{tx}a")
+	c.expect("PONG 2", "EXEC")
+
+	// 跨 slot 的命令让 EXEC 失败
+	other := "tx:other"
+	for i := 0; fc.NodeForKey(other) == fc.NodeForKey("{tx}a"); i++ {
+		other = fmt.Sprintf("tx:%d", i)
+	}
+	c.expect("OK", "MULTI")
+	c.expect("QUEUED", "SET", "{tx}a", "3")
+	c.expect(CrossSlotError.Error(), "SET", other, "3")
+	c.expect(string(ExecAbortError), "EXEC")
+	c.expect("2", "GET", "{tx}a")
+
+	c.expect("OK", "MULTI")
+	c.expect(CrossSlotError.Error(), "MSET", "{tx}a", "1", other, "1")
+	c.expect("OK", "DISCARD")
+	c.expect("2", "GET", "{tx}a")
+
+	// WATCH 的 key 被其它客户端修改时 EXEC 返回 nil
+	c2 := dialProxy(t, p)
+	c.expect("OK", "WATCH", "{tx}a")
+	c2.expect("OK", "SET", "{tx}a", "5")
+	c.expect("OK", "MULTI")
+	c.expect("QUEUED", "SET", "{tx}a", "6")
+	if r := c.do("EXEC"); r.String() != "" {
+		t.Fatalf("EXEC after WATCH conflict got %s", r.String())
+	}
+	c.expect("5", "GET", "{tx}a")
+
+	c.expect("OK", "WATCH", "{tx}a")
+	c.expect(CrossSlotError.Error(), "WATCH", other)
+	c.expect("OK", "MULTI")
+	c.expect(string(WatchInMultiError), "WATCH", "{tx}a")
+	c.expect(string(ExecAbortError), "EXEC")
+
+	c.expect("OK", "WATCH", "{tx}a")
+	c.expect("OK", "UNWATCH")
+	c2.expect("OK", "SET", "{tx}a", "7")
+	c.expect("OK", "MULTI")
+	c.expect("QUEUED", "INCR", "{tx}a")
+	c.expect("8", "EXEC")
+}
+
+func Test_ProxyTxPool(t *testing.T) {
+	p, _ := newTestProxy(t, 3, 0, func(pc *ProxyConfig) { pc.txPoolSize = 1 })
+	a := dialProxy(t, p)
+	b := dialProxy(t, p)
+	other := dialProxy(t, p)
+
+	// 事务连接池用完之后新的事务回复错误，普通请求不受影响
+	a.expect("OK", "WATCH", "{tx}a")
+	if resp := b.do("WATCH", "{tx}b"); resp.Type() != ErrorType {
+		t.Fatalf("WATCH with exhausted tx pool got %s", resp.String())
+	}
+	other.expect("OK", "SET", "{tx}a", "v")
+	other.expect("v", "GET", "{tx}a")
+
+	// EXEC 之后连接回到事务连接池
+	a.expect("OK", "MULTI")
+	a.expect("QUEUED", "GET", "{tx}a")
+	a.expect("", "EXEC")
+	b.expect("OK", "WATCH", "{tx}b")
+	b.expect("OK", "UNWATCH")
+}
+
+func Test_ProxyScript(t *testing.T) {
+	p, fc := newTestProxy(t, 3, 0)
+	c := dialProxy(t, p)
+
+	other := "script:other"
+	for i := 0; fc.NodeForKey(other) == fc.NodeForKey("script:a"); i++ {
+		other = fmt.Sprintf("script:%d", i)
+	}
+	c.expect("return 1", "EVAL", "return 1", "1", "script:a")
+	c.expect(CrossSlotError.Error(), "EVAL", "return 1", "2", "script:a", other)
+	c.expect("return 1", "EVAL", "return 1", "0")
+
+	// SCRIPT LOAD 发给所有主库
+	body := "return 2"
+	sha := c.do("SCRIPT", "LOAD", body).String()
+	for _, m := range fc.Masters() {
+		if !m.HasScript(sha) {
+			t.Fatalf("node %s has no script %s", m.Addr, sha)
+		}
+	}
+	missing := strings.Repeat("0", 40)
+	c.expect("1 0", "SCRIPT", "EXISTS", sha, missing)
+
+	// 节点丢失脚本之后用 proxy 的缓存重新加载
+	fc.NodeForKey(other).FlushScripts()
+	c.expect("0 0", "SCRIPT", "EXISTS", missing, sha)
+	c.expect(body, "EVALSHA", sha, "1", other)
+	c.expect(body, "EVALSHA", strings.ToUpper(sha), "1", other)
+	c.expect("NOSCRIPT No matching script. Please use EVAL.", "EVALSHA", missing, "1", other)
+	c.expect(CrossSlotError.Error(), "EVALSHA", sha, "2", "script:a", other)
+
+	// 迁移中的 slot 回复 ASK，脚本加载到回复 NOSCRIPT 的目标节点
+	slot := fakeredis.Slot(other)
+	to := fc.Masters()[0]
+	if to == fc.Owner(slot) {
+		to = fc.Masters()[1]
+	}
+	fc.SetMigrating(slot, to)
+	to.FlushScripts()
+	c.expect(body, "EVALSHA", sha, "1", other)
+	if !to.HasScript(sha) {
+		t.Fatalf("script not loaded on migrating target %s", to.Addr)
+	}
+
+	// SCRIPT FLUSH 之后不再重新加载
+	c.expect("OK", "SCRIPT", "FLUSH")
+	c.expect("0", "SCRIPT", "EXISTS", sha)
+	c.expect("NOSCRIPT No matching script. Please use EVAL.", "EVALSHA", sha, "1", other)
+	// 不支持的子命令在 Filter 中拒绝，参数个数不对的由 Script 拒绝
+	c.expect(CommandForbidden.Error(), "SCRIPT", "KILL")
+	c.expect(string(ScriptSubcommandError), "SCRIPT", "LOAD")
+}
+
+func Test_ProxyPubSub(t *testing.T) {
+	p, fc := newTestProxy(t, 3, 0)
+	c := dialProxy(t, p)
+	pub := dialProxy(t, p)
+
+	expectRead := func(want string) {
+		t.Helper()
+		if got := c.read().String(); got != want {
+			t.Fatalf("got %q want %q", got, want)
+		}
+	}
+
+	// 之前的回复先于订阅回复
+	c.send("SET", "{ps}k", "v")
+	c.send("SUBSCRIBE", "ch1", "ch2")
+	expectRead("OK")
+	expectRead("subscribe ch1 1")
+	expectRead("subscribe ch2 2")
+
+	pub.expect("1", "PUBLISH", "ch1", "hello")
+	expectRead("message ch1 hello")
+
+	// 订阅模式下只能执行订阅命令和 PING
+	c.expect("ERR Can't execute 'get': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT are allowed in this context", "GET", "{ps}k")
+	c.expect("pong ", "PING")
+
+	c.expect("psubscribe ch* 3", "PSUBSCRIBE", "ch*")
+	pub.expect("2", "PUBLISH", "ch1", "hi")
+	expectRead("message ch1 hi")
+	expectRead("pmessage ch* ch1 hi")
+
+	// sharded channel 按 slot 发到对应的节点
+	other := "shard:other"
+	for i := 0; fc.NodeForKey(other) == fc.NodeForKey("{s}a"); i++ {
+		other = fmt.Sprintf("shard:%d", i)
+	}
+	c.expect(CrossSlotError.Error(), "SSUBSCRIBE", "{s}a", other)
+	c.expect("ssubscribe {s}a 1", "SSUBSCRIBE", "{s}a")
+	c.expect("ssubscribe "+other+" 1", "SSUBSCRIBE", other)
+	pub.expect("1", "SPUBLISH", "{s}a", "m")
+	expectRead("smessage {s}a m")
+	pub.expect("0", "SPUBLISH", "{s}b", "m")
+
+	// 取消所有订阅之后回到普通模式
+	c.send("UNSUBSCRIBE")
+	expectRead("unsubscribe ch1 2")
+	expectRead("unsubscribe ch2 1")
+	c.expect("punsubscribe ch* 0", "PUNSUBSCRIBE")
+	c.send("SUNSUBSCRIBE")
+	got := []string{c.read().String(), c.read().String()}
+	sort.Strings(got)
+	if want := "sunsubscribe " + other + " 0,sunsubscribe {s}a 0"; strings.Join(got, ",") != want {
+		t.Fatalf("SUNSUBSCRIBE got %q want %q", got, want)
+	}
+	c.expect("v", "GET", "{ps}k")
+	c.expect("PONG", "PING")
+	pub.expect("0", "PUBLISH", "ch1", "bye")
+	c.expect("unsubscribe ch1 0", "UNSUBSCRIBE", "ch1")
+	c.expect("v", "GET", "{ps}k")
+}
+
+func Test_ProxyPubSubBarrierTimeout(t *testing.T) {
+	p, fc := newTestProxy(t, 1, 0, func(pc *ProxyConfig) { pc.readTimeout = 200 * time.Millisecond })
+	c := dialProxy(t, p)
+
+	// 后端不回复作为 barrier 的 PING 时关闭 Session
+	fc.Handle("PING", &fakeredis.Command{
+		Func: func(ctx *fakeredis.Ctx) fakeredis.Reply {
+			time.Sleep(time.Second)
+			return fakeredis.Status("PONG")
+		},
+		Arity: -1,
+	})
+	c.send("SUBSCRIBE", "ch")
+	c.w.Flush()
+	// PING 的回复到达之前连接已经关闭，订阅回复可能来不及写给客户端
+	c.c.SetReadDeadline(time.Now().Add(800 * time.Millisecond))
+	if _, err := io.Copy(io.Discard, c.r); err != nil {
+		t.Fatalf("connection should be closed after barrier timeout, got %v", err)
+	}
+}
+
+func Test_ProxyBlocking(t *testing.T) {
+	p, _ := newTestProxy(t, 3, 0)
+	c := dialProxy(t, p)
+	other := dialProxy(t, p)
+
+	expectRead := func(want string) {
+		t.Helper()
+		if got := c.read().String(); got != want {
+			t.Fatalf("got %q want %q", got, want)
+		}
+	}
+
+	// 超时之后回复 nil
+	c.expect("", "BLPOP", "{bl}a", "0.1")
+	c.expect(CrossSlotError.Error(), "BLPOP", "{bl}a", "{x}b", "1")
+
+	// 阻塞期间其它客户端写入
+	c.send("BLPOP", "{bl}a", "{bl}b", "5")
+	c.w.Flush()
+	time.Sleep(50 * time.Millisecond)
+	other.expect("1", "RPUSH", "{bl}b", "v1")
+	expectRead("{bl}b v1")
+
+	other.expect("2", "RPUSH", "{bl}a", "x", "y")
+	c.expect("y", "BLMOVE", "{bl}a", "{bl}c", "RIGHT", "LEFT", "1")
+	c.expect("x", "BRPOPLPUSH", "{bl}a", "{bl}c", "1")
+	c.expect("x y", "LRANGE", "{bl}c", "0", "-1")
+
+	other.expect("1", "ZADD", "{bl}z", "1", "m")
+	c.expect("{bl}z m 1", "BZPOPMIN", "{bl}z", "1")
+
+	// 客户端断开之后取消后端的阻塞，之后写入的元素不会被弹出
+	gone := dialProxy(t, p)
+	gone.send("BLPOP", "{bl}q", "0")
+	gone.w.Flush()
+	time.Sleep(50 * time.Millisecond)
+	gone.c.Close()
+	time.Sleep(100 * time.Millisecond)
+	other.expect("1", "LPUSH", "{bl}q", "v")
+	time.Sleep(50 * time.Millisecond)
+	other.expect("1", "LLEN", "{bl}q")
+}
+
+func Test_ProxyXReadBlock(t *testing.T) {
+	p, fc := newTestProxy(t, 3, 0)
+	c := dialProxy(t, p)
+
+	fc.Handle("XREAD", &fakeredis.Command{
+		Func:  func(ctx *fakeredis.Ctx) fakeredis.Reply { return []byte(nil) },
+		Arity: -4,
+	})
+	blockPools := func() int {
+		p.cluster.mu.RLock()
+		defer p.cluster.mu.RUnlock()
+		return len(p.cluster.blockPools)
+	}
+
+	// 只有带 BLOCK 的使用阻塞命令的连接池
+	c.expect("", "XREAD", "COUNT", "1", "STREAMS", "{xr}a", "0")
+	if n := blockPools(); n != 0 {
+		t.Fatalf("XREAD without BLOCK used %d block pools", n)
+	}
+	c.expect("", "XREAD", "COUNT", "1", "block", "100", "STREAMS", "{xr}a", "0")
+	if n := blockPools(); n != 1 {
+		t.Fatalf("XREAD BLOCK used %d block pools", n)
+	}
+	c.expect(CrossSlotError.Error(), "XREAD", "BLOCK", "10", "STREAMS", "{xr}a", "{x}b", "0", "0")
+}
@@ -0,0 +1,367 @@
+package archer
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dongzerun/archer/hack"
+	log "github.com/ngaut/logging"
+)
+
+// pushSeq 订阅推送的消息没有 seq，WriteLoop 按到达顺序直接写给客户端
+const pushSeq int64 = -1
+
+// 进入或者退出订阅的命令，回复是推送消息
+var subscribeCommands = map[string]bool{
+	"SUBSCRIBE":    true,
+	"PSUBSCRIBE":   true,
+	"SSUBSCRIBE":   true,
+	"UNSUBSCRIBE":  true,
+	"PUNSUBSCRIBE": true,
+	"SUNSUBSCRIBE": true,
+}
+
+// pubsubConn 是订阅专用的后端连接，不在连接池中
+// Dispatch 写命令，readPubSub 读取回复和消息推送给客户端
+type pubsubConn struct {
+	rc      *RedisConn
+	count   int64         // 最近一次订阅回复中的订阅数，atomic 读写
+	closing int32         // Session 主动关闭连接，atomic 读写
+	barrier chan struct{} // 收到 PING 的回复，之前命令的回复都已经推送
+}
+
+func (pc *pubsubConn) close() {
+	atomic.StoreInt32(&pc.closing, 1)
+	pc.rc.Close()
+}
+
+// pubsub 是 Session 的订阅状态，只在 Dispatch 中读写
+// SUBSCRIBE PSUBSCRIBE 使用一个连接，SSUBSCRIBE 按 channel 所在的节点各使用一个连接
+// 所有连接的订阅数都是 0 时退出订阅模式并关闭连接
+type pubsub struct {
+	conn   *pubsubConn
+	shards map[string]*pubsubConn // 节点 id => 连接
+}
+
+func (ps *pubsub) conns() []*pubsubConn {
+	var pcs []*pubsubConn
+	if ps.conn != nil {
+		pcs = append(pcs, ps.conn)
+	}
+	for _, pc := range ps.shards {
+		pcs = append(pcs, pc)
+	}
+	return pcs
+}
+
+func (ps *pubsub) idle() bool {
+	for _, pc := range ps.conns() {
+		if atomic.LoadInt64(&pc.count) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// PubSub 处理订阅命令和订阅模式下的命令，返回 false 表示请求需要按正常流程处理
+// 订阅模式下所有命令在 Dispatch 中同步处理，每个转发的命令后面跟一个 PING，
+// 等到 PING 的回复之后再处理下一个命令，保证回复和推送消息的顺序
+func (s *Session) PubSub(command string, req *ArrayResp, seq int64) bool {
+	// 后端取消了所有订阅，比如 sharded channel 的 slot 迁移
+	if s.ps != nil && s.ps.idle() {
+		s.leavePubSub()
+	}
+	first := s.ps == nil
+	if !subscribeCommands[command] {
+		if first || command == "QUIT" {
+			return false
+		}
+		if command == "PING" {
+			resp := s.pubsubPong(req)
+			Release(req)
+			s.resps <- WrappedResp(resp, seq)
+			return true
+		}
+		s.reject(&wrappedResp{resp: req, seq: seq}, fmt.Errorf("ERR Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT are allowed in this context", strings.ToLower(command)))
+		return true
+	}
+
+	if err := req.Materialize(); err != nil {
+		Release(req)
+		s.resps <- WrappedErrorResp([]byte(err.Error()), seq)
+		return true
+	}
+	defer Release(req)
+
+	var pcs []*pubsubConn
+	switch command {
+	case "SUBSCRIBE", "PSUBSCRIBE":
+		pc, err := s.mainPubSubConn()
+		if err != nil {
+			s.resps <- WrappedErrorResp([]byte("proxy internal error "+err.Error()), seq)
+			return true
+		}
+		pcs = append(pcs, pc)
+	case "UNSUBSCRIBE", "PUNSUBSCRIBE":
+		if s.ps != nil && s.ps.conn != nil {
+			pcs = append(pcs, s.ps.conn)
+		}
+	case "SSUBSCRIBE", "SUNSUBSCRIBE":
+		// sharded channel 按 slot 路由，一个命令中的 channel 必须在同一个 slot
+		if !sameSlot(commandTable[command], req) {
+			s.resps <- WrappedErrorResp([]byte(CrossSlotError.Error()), seq)
+			return true
+		}
+		if len(req.Args) == 1 {
+			if s.ps != nil {
+				for _, pc := range s.ps.shards {
+					pcs = append(pcs, pc)
+				}
+			}
+			break
+		}
+		id := s.p.cluster.topo.GetNodeID(req.Arg(1), false)
+		if command == "SUNSUBSCRIBE" {
+			if s.ps != nil && s.ps.shards[id] != nil {
+				pcs = append(pcs, s.ps.shards[id])
+			}
+			break
+		}
+		pc, err := s.shardPubSubConn(id)
+		if err != nil {
+			s.resps <- WrappedErrorResp([]byte("proxy internal error "+err.Error()), seq)
+			return true
+		}
+		pcs = append(pcs, pc)
+	}
+
+	// 第一次推送之前等待已经发出的请求全部回复，推送消息不能插到这些回复前面
+	if first {
+		s.waitRoutes()
+	}
+	// 回复以推送消息的形式发给客户端，seq 只占位
+	s.resps <- WrappedResp(nil, seq)
+	if len(pcs) == 0 {
+		// 没有订阅时取消订阅，和 Redis 一样每个 channel 回复订阅数 0
+		s.pushUnsubscribed(command, req)
+	}
+	for _, pc := range pcs {
+		if err := s.writePubSub(pc, req); err != nil {
+			log.Warning("Session pubsub write failed ", err)
+			s.Close()
+			return true
+		}
+	}
+	// 订阅连接不设置读超时，后端一直不回复 PING 时按 readTimeout 关闭 Session
+	var timeout <-chan time.Time
+	if s.p.pc.readTimeout > 0 {
+		t := time.NewTimer(s.p.pc.readTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	for _, pc := range pcs {
+		select {
+		case <-pc.barrier:
+		case <-timeout:
+			log.Warning("Session pubsub barrier timeout ", pc.rc.ID())
+			s.Close()
+			return true
+		case <-s.quitChan:
+			return true
+		}
+	}
+	if s.ps != nil && s.ps.idle() {
+		s.leavePubSub()
+	}
+	return true
+}
+
+// waitRoutes 取回所有并发配额，也就是等待 Route 中的请求全部回复
+func (s *Session) waitRoutes() {
+	for i := 0; i < s.p.pc.conCurrency; i++ {
+		<-s.conCurrency
+	}
+	for i := 0; i < s.p.pc.conCurrency; i++ {
+		s.conCurrency <- 1
+	}
+}
+
+func (s *Session) pushUnsubscribed(command string, req *ArrayResp) {
+	kind := []byte(strings.ToLower(command))
+	reply := func(ch Resp) {
+		ar := NewArrayResp(NewBulkResp(kind), ch, NewIntResp(0))
+		s.resps <- WrappedResp(s.pushResp(ar), pushSeq)
+	}
+	if len(req.Args) == 1 {
+		reply(NewBulkResp(nil))
+		return
+	}
+	for i := 1; i < len(req.Args); i++ {
+		reply(NewBulkResp(append([]byte(nil), req.Arg(i)...)))
+	}
+}
+
+// pubsubPong 订阅模式下 RESP2 的 PING 回复 pong 和参数组成的数组
+func (s *Session) pubsubPong(req *ArrayResp) Resp {
+	msg := []byte{}
+	if len(req.Args) > 1 {
+		msg = append(msg, req.Arg(1)...)
+	}
+	if atomic.LoadInt32(&s.proto) == 3 {
+		if len(req.Args) > 1 {
+			return NewBulkResp(msg)
+		}
+		return NewSimpleResp(PONG)
+	}
+	return NewArrayResp(NewBulkResp([]byte("pong")), NewBulkResp(msg))
+}
+
+// pushResp RESP3 客户端的订阅回复和消息使用推送类型
+func (s *Session) pushResp(resp Resp) Resp {
+	ar, ok := resp.(*ArrayResp)
+	if !ok || atomic.LoadInt32(&s.proto) != 3 {
+		return resp
+	}
+	push := &PushResp{}
+	push.Rtype = PushType
+	push.Args = ar.Args
+	return push
+}
+
+func (s *Session) mainPubSubConn() (*pubsubConn, error) {
+	if s.ps != nil && s.ps.conn != nil {
+		return s.ps.conn, nil
+	}
+	// 普通 channel 的消息会广播到所有节点，随机选择一个主库分散连接
+	masters := s.p.cluster.topo.Masters()
+	if len(masters) == 0 {
+		return nil, fmt.Errorf("no master available")
+	}
+	pc, err := s.dialPubSub(masters[rand.Intn(len(masters))].id)
+	if err != nil {
+		return nil, err
+	}
+	s.ensurePubSub()
+	s.ps.conn = pc
+	return pc, nil
+}
+
+func (s *Session) shardPubSubConn(id string) (*pubsubConn, error) {
+	if s.ps != nil && s.ps.shards[id] != nil {
+		return s.ps.shards[id], nil
+	}
+	pc, err := s.dialPubSub(id)
+	if err != nil {
+		return nil, err
+	}
+	s.ensurePubSub()
+	s.ps.shards[id] = pc
+	return pc, nil
+}
+
+// ensurePubSub 进入订阅模式，订阅模式下 Session 不会因为 idle 超时被关闭
+func (s *Session) ensurePubSub() {
+	if s.ps != nil {
+		return
+	}
+	s.ps = &pubsub{shards: make(map[string]*pubsubConn)}
+	atomic.StoreInt32(&s.subscribed, 1)
+}
+
+// dialPubSub 建立连接池之外的后端连接并启动读取的 goroutine
+func (s *Session) dialPubSub(id string) (*pubsubConn, error) {
+	n := s.p.cluster.topo.GetNode(id)
+	if n == nil {
+		return nil, fmt.Errorf("node %s not found", id)
+	}
+	rc, err := NewRedisConn(n.host, n.port, s.p.pc)
+	if err != nil {
+		return nil, err
+	}
+	pc := &pubsubConn{rc: rc, barrier: make(chan struct{}, 1)}
+	go s.readPubSub(pc)
+	return pc, nil
+}
+
+// writePubSub 命令和作为 barrier 的 PING 一起发送
+func (s *Session) writePubSub(pc *pubsubConn, req *ArrayResp) error {
+	if err := req.Encode(pc.rc.w); err != nil {
+		return err
+	}
+	if err := NewCommand(PING).Encode(pc.rc.w); err != nil {
+		return err
+	}
+	return pc.rc.w.Flush()
+}
+
+// readPubSub 把订阅连接上的回复和消息推送给客户端，连接断开时关闭 Session，客户端重连之后重新订阅
+func (s *Session) readPubSub(pc *pubsubConn) {
+	for {
+		resp, err := ReadProtocol(pc.rc.r)
+		if err != nil {
+			if atomic.LoadInt32(&pc.closing) == 0 {
+				log.Warning("Session pubsub conn failed ", pc.rc.ID(), err)
+				s.Close()
+			}
+			return
+		}
+		if isPubSubPong(resp) {
+			pc.barrier <- struct{}{}
+			continue
+		}
+		if ar, ok := resp.(*ArrayResp); ok && len(ar.Args) == 3 && subscribeCommands[strings.ToUpper(hack.String(ar.Arg(0)))] {
+			if n, err := strconv.ParseInt(ar.Args[2].String(), 10, 64); err == nil {
+				atomic.StoreInt64(&pc.count, n)
+			}
+		}
+		select {
+		case s.resps <- WrappedResp(s.pushResp(resp), pushSeq):
+		case <-s.quitChan:
+			return
+		}
+	}
+}
+
+// isPubSubPong 订阅模式下 PING 回复 pong 数组，没有订阅时回复 PONG
+func isPubSubPong(resp Resp) bool {
+	switch r := resp.(type) {
+	case *SimpleResp:
+		return bytes.Equal(r.Args[0], PONG)
+	case *ArrayResp:
+		return len(r.Args) == 2 && bytes.Equal(r.Arg(0), []byte("pong"))
+	}
+	return false
+}
+
+// leavePubSub 退出订阅模式，关闭所有订阅连接
+func (s *Session) leavePubSub() {
+	if s.ps == nil {
+		return
+	}
+	for _, pc := range s.ps.conns() {
+		pc.close()
+	}
+	s.ps = nil
+	atomic.StoreInt32(&s.subscribed, 0)
+}
+
+// Publish 普通 channel 的消息会广播到所有节点，随机选择一个主库发送
+func (s *Session) Publish(req *ArrayResp, seq int64) {
+	defer func() {
+		s.conCurrency <- 1
+	}()
+
+	masters := s.p.cluster.topo.Masters()
+	if len(masters) == 0 {
+		s.resps <- WrappedErrorResp([]byte("proxy internal error no master available"), seq)
+		return
+	}
+	subs := []*subRequest{{req: req}}
+	s.execGroup(masters[rand.Intn(len(masters))].id, subs)
+	s.resps <- WrappedResp(subs[0].resp, seq)
+}
@@ -0,0 +1,86 @@
+package archer
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/dongzerun/archer/hack"
+	log "github.com/ngaut/logging"
+)
+
+var NoSuchKeyError = []byte("ERR no such key")
+
+// Rename 处理 key 和 newkey 不在同一个 slot 的 RENAME RENAMENX
+// 在 key 所在的节点 DUMP 和 PTTL，在 newkey 所在的节点 RESTORE，成功之后再 DEL key
+// 整个过程不是原子的，DUMP 和 DEL 之间对 key 的修改会丢失
+func (s *Session) Rename(req *ArrayResp, seq int64) {
+	defer func() {
+		s.conCurrency <- 1
+	}()
+
+	nx := strings.EqualFold(hack.String(req.Arg(0)), "RENAMENX")
+	src, dst := req.Arg(1), req.Arg(2)
+
+	// DUMP 和 PTTL 在同一个连接上 pipeline 发送
+	reads := []*subRequest{
+		{req: NewCommand([]byte("DUMP"), src)},
+		{req: NewCommand([]byte("PTTL"), src)},
+	}
+	s.scatter(reads, false)
+	if er := firstError(reads); er != nil {
+		s.resps <- WrappedResp(er, seq)
+		return
+	}
+	payload, ok := reads[0].resp.(*BulkResp)
+	if !ok {
+		s.resps <- WrappedErrorResp([]byte("proxy internal RENAME failed"), seq)
+		return
+	}
+	if payload.Empty || len(payload.Args) == 0 {
+		s.resps <- WrappedErrorResp(NoSuchKeyError, seq)
+		return
+	}
+	ir, ok := reads[1].resp.(*IntResp)
+	if !ok {
+		s.resps <- WrappedErrorResp([]byte("proxy internal RENAME failed"), seq)
+		return
+	}
+	ttl, err := strconv.ParseInt(hack.String(ir.Args[0]), 10, 64)
+	if err != nil || ttl == -2 {
+		// DUMP 之后 key 过期或者被删除
+		s.resps <- WrappedErrorResp(NoSuchKeyError, seq)
+		return
+	}
+	if ttl < 0 {
+		ttl = 0
+	}
+
+	restore := NewCommand([]byte("RESTORE"), dst, []byte(strconv.FormatInt(ttl, 10)), payload.Args[0])
+	if !nx {
+		restore.Args = append(restore.Args, NewBulkResp([]byte("REPLACE")))
+	}
+	writes := []*subRequest{{req: restore}}
+	s.scatter(writes, false)
+	if er, ok := writes[0].resp.(*ErrorResp); ok {
+		if nx && strings.HasPrefix(hack.String(er.Args[0]), "BUSYKEY") {
+			s.resps <- WrappedResp(NewIntResp(0), seq)
+			return
+		}
+		s.resps <- WrappedResp(er, seq)
+		return
+	}
+
+	dels := []*subRequest{{req: NewCommand([]byte("DEL"), src)}}
+	s.scatter(dels, false)
+	if er := firstError(dels); er != nil {
+		log.Warningf("Session RENAME %s restored but DEL source failed %s", dst, er.Args[0])
+		s.resps <- WrappedErrorResp([]byte("ERR RENAME restored destination but failed to delete source: "+string(er.Args[0])), seq)
+		return
+	}
+
+	if nx {
+		s.resps <- WrappedResp(NewIntResp(1), seq)
+		return
+	}
+	s.resps <- WrappedOKResp(seq)
+}
@@ -0,0 +1,136 @@
+package archer
+
+import (
+	"sync"
+)
+
+// Resp 对象池，高 QPS 下每个命令都要分配 ArrayResp、BulkResp、[][]byte 和 payload
+// GC 成为最大的 CPU 开销，所以 ReadLoop 和后端回复都从对象池分配
+// 生命周期和 Session 中的 wrappedResp 一致:
+//   cmds 中的请求在处理命令的 goroutine 结束后 Release
+//   resps 中的回复在 WriteLoop Encode 之后 Release
+// Release 之后不能再引用其中的任何 []byte，需要保存的数据必须拷贝
+
+const (
+	arenaChunkSize = 4096
+	// 超过这个大小的 payload 单独分配，不占用 arena
+	arenaMaxAlloc = 512
+)
+
+var (
+	bulkPool = sync.Pool{
+		New: func() interface{} { return new(BulkResp) },
+	}
+	arrayPool = sync.Pool{
+		New: func() interface{} { return new(ArrayResp) },
+	}
+	arenaPool = sync.Pool{
+		New: func() interface{} { return new(respArena) },
+	}
+	chunkPool = sync.Pool{
+		New: func() interface{} {
+			b := make([]byte, 0, arenaChunkSize)
+			return &b
+		},
+	}
+)
+
+// respArena 为一个请求或回复中的小 payload 分配内存，Release 时整体回收
+type respArena struct {
+	chunks []*[]byte
+}
+
+func newArena() *respArena {
+	return arenaPool.Get().(*respArena)
+}
+
+func (a *respArena) alloc(n int) []byte {
+	if n > arenaMaxAlloc {
+		return make([]byte, n)
+	}
+
+	var cur *[]byte
+	if len(a.chunks) > 0 {
+		cur = a.chunks[len(a.chunks)-1]
+	}
+	if cur == nil || cap(*cur)-len(*cur) < n {
+		cur = chunkPool.Get().(*[]byte)
+		*cur = (*cur)[:0]
+		a.chunks = append(a.chunks, cur)
+	}
+
+	l := len(*cur)
+	*cur = (*cur)[:l+n]
+	return (*cur)[l : l+n : l+n]
+}
+
+func (a *respArena) release() {
+	for i, c := range a.chunks {
+		chunkPool.Put(c)
+		a.chunks[i] = nil
+	}
+	a.chunks = a.chunks[:0]
+	arenaPool.Put(a)
+}
+
+func getBulkResp() *BulkResp {
+	br := bulkPool.Get().(*BulkResp)
+	br.Rtype = BulkType
+	return br
+}
+
+func getArrayResp() *ArrayResp {
+	ar := arrayPool.Get().(*ArrayResp)
+	ar.Rtype = ArrayType
+	return ar
+}
+
+// Release 把 Resp 树中的对象和 arena 放回对象池
+// 不是从对象池分配的对象也可以 Release，只要之后没有其它引用
+func Release(r Resp) {
+	if r == nil {
+		return
+	}
+	base := r.base()
+	if base.arena != nil {
+		base.arena.release()
+		base.arena = nil
+	}
+
+	switch v := r.(type) {
+	case *BulkResp:
+		for i := range v.Args {
+			v.Args[i] = nil
+		}
+		v.Args = v.Args[:0]
+		v.Empty = false
+		bulkPool.Put(v)
+	case *ArrayResp:
+		for i, arg := range v.Args {
+			Release(arg)
+			v.Args[i] = nil
+		}
+		v.Args = v.Args[:0]
+		// 超大的数组不放回对象池，避免长期占用内存
+		if cap(v.Args) > 1024 {
+			v.Args = nil
+		}
+		v.Empty = false
+		arrayPool.Put(v)
+	case *MapResp:
+		releaseAll(v.Args)
+	case *SetResp:
+		releaseAll(v.Args)
+	case *PushResp:
+		releaseAll(v.Args)
+	case *AttrResp:
+		releaseAll(v.Args)
+		Release(v.Value)
+	}
+}
+
+func releaseAll(args []Resp) {
+	for _, arg := range args {
+		Release(arg)
+	}
+}
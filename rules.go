@@ -1,192 +1,304 @@
 package archer
 
-const (
-	RI_MinCount = iota
-	RI_MaxCount
-)
+// cmd 参数依次是 arity flags firstkey lastkey step
+func cmd(arity int, flags CommandFlag, first, last, step int) *CommandInfo {
+	return &CommandInfo{Arity: arity, Flags: flags, FirstKey: first, LastKey: last, Step: step}
+}
+
+// cmdKeys 用于 key 位置取决于参数的命令
+func cmdKeys(arity int, flags CommandFlag, keys func(*ArrayResp) ([]int, error)) *CommandInfo {
+	return &CommandInfo{Arity: arity, Flags: flags, keys: keys}
+}
 
-var reqrules = map[string][]interface{}{
+// commandTable 命令表，不在表中的命令会被 Filter 拒绝
+// limit 是原来 reqrules 中的参数个数上限，限制单个请求拆分出的子请求数
+var commandTable = map[string]*CommandInfo{
 	// proxy special command
-	"PROXY":  []interface{}{2, 5},
-	"SELECT": []interface{}{2, 2},
-	"PING":   []interface{}{1, 1},
-	"QUIT":   []interface{}{1, 1},
+	"PROXY":  cmd(-2, FlagAdmin, 0, 0, 0).limit(5),
+	"SELECT": cmd(2, 0, 0, 0, 0),
+	"PING":   cmd(1, 0, 0, 0, 0),
+	"AUTH":   cmd(-2, 0, 0, 0, 0).limit(3),
+	"HELLO":  cmd(-1, 0, 0, 0, 0).limit(7),
+	"QUIT":   cmd(1, 0, 0, 0, 0),
+	"CLIENT": cmd(-2, FlagAdmin, 0, 0, 0).limit(3),
 	// key
-	"DEL":       []interface{}{2, 2001},
-	"TYPE":      []interface{}{2, 2},
-	"EXISTS":    []interface{}{2, 2},
-	"EXPIRE":    []interface{}{3, 3},
-	"EXPIREAT":  []interface{}{3, 3},
-	"TTL":       []interface{}{2, 2},
-	"PTTL":      []interface{}{2, 2},
-	"PERSIST":   []interface{}{2, 2},
-	"PEXPIRE":   []interface{}{3, 3},
-	"PEXPIREAT": []interface{}{3, 3},
-	"RENAME":    []interface{}{3, 3},
-	"RENAMENX":  []interface{}{3, 3},
-	"DUMP":      []interface{}{2, 2},
-	"RESTORE":   []interface{}{4, 4},
+	"DEL":       cmd(-2, FlagWrite|FlagMultiKey, 1, -1, 1).limit(2001),
+	"UNLINK":    cmd(-2, FlagWrite|FlagMultiKey, 1, -1, 1).limit(2001),
+	"TOUCH":     cmd(-2, FlagRead|FlagMultiKey, 1, -1, 1).limit(2001),
+	"EXISTS":    cmd(-2, FlagRead|FlagMultiKey, 1, -1, 1).limit(2001),
+	"TYPE":      cmd(2, FlagRead, 1, 1, 1),
+	"EXPIRE":    cmd(3, FlagWrite, 1, 1, 1),
+	"EXPIREAT":  cmd(3, FlagWrite, 1, 1, 1),
+	"TTL":       cmd(2, FlagRead, 1, 1, 1),
+	"PTTL":      cmd(2, FlagRead, 1, 1, 1),
+	"PERSIST":   cmd(2, FlagWrite, 1, 1, 1),
+	"PEXPIRE":   cmd(3, FlagWrite, 1, 1, 1),
+	"PEXPIREAT": cmd(3, FlagWrite, 1, 1, 1),
+	"RENAME":    cmd(3, FlagWrite|FlagMultiKey, 1, 2, 1),
+	"RENAMENX":  cmd(3, FlagWrite|FlagMultiKey, 1, 2, 1),
+	"DUMP":      cmd(2, FlagRead, 1, 1, 1),
+	"RESTORE":   cmd(4, FlagWrite, 1, 1, 1),
+	"OBJECT":    cmd(-2, FlagRead, 2, 2, 1).limit(3),
+	"SCAN":      cmd(-2, FlagRead, 0, 0, 0).limit(8),
+	// 需要在 [commands] 中配置 allow
+	"KEYS":      cmd(2, FlagRead, 0, 0, 0),
+	"DBSIZE":    cmd(1, FlagRead, 0, 0, 0),
+	"RANDOMKEY": cmd(1, FlagRead, 0, 0, 0),
+	"FLUSHDB":   cmd(-1, FlagWrite, 0, 0, 0).limit(2),
+	"FLUSHALL":  cmd(-1, FlagWrite, 0, 0, 0).limit(2),
 	// bit
-
-	"SETBIT":   []interface{}{4, 4},
-	"BITCOUNT": []interface{}{2, 2},
-	"GETBIT":   []interface{}{3, 3},
-
+	"SETBIT":   cmd(4, FlagWrite, 1, 1, 1),
+	"BITCOUNT": cmd(2, FlagRead, 1, 1, 1),
+	"GETBIT":   cmd(3, FlagRead, 1, 1, 1),
+	"BITOP":    cmd(-4, FlagWrite|FlagMultiKey, 2, -1, 1).limit(2003),
 	// string
-	"GET":         []interface{}{2, 2},
-	"MGET":        []interface{}{2, 2001},
-	"GETRANGE":    []interface{}{4, 4},
-	"GETSET":      []interface{}{3, 3},
-	"SET":         []interface{}{3, 6},
-	"MSET":        []interface{}{3, 4001},
-	"SETEX":       []interface{}{4, 4},
-	"SETNX":       []interface{}{3, 3},
-	"PSETEX":      []interface{}{4, 4},
-	"SETRANGE":    []interface{}{4, 4},
-	"STRLEN":      []interface{}{2, 2},
-	"INCR":        []interface{}{2, 2},
-	"DECR":        []interface{}{2, 2},
-	"INCRBY":      []interface{}{3, 3},
-	"DECRBY":      []interface{}{3, 3},
-	"INCRBYFLOAT": []interface{}{3, 3},
-	"APPEND":      []interface{}{3, 3},
+	"GET":         cmd(2, FlagRead, 1, 1, 1),
+	"MGET":        cmd(-2, FlagRead|FlagMultiKey, 1, -1, 1).limit(2001),
+	"GETRANGE":    cmd(4, FlagRead, 1, 1, 1),
+	"GETSET":      cmd(3, FlagWrite, 1, 1, 1),
+	"SET":         cmd(-3, FlagWrite, 1, 1, 1).limit(6),
+	"MSET":        cmd(-3, FlagWrite|FlagMultiKey, 1, -1, 2).limit(4001),
+	"MSETNX":      cmd(-3, FlagWrite|FlagMultiKey, 1, -1, 2).limit(4001),
+	"SETEX":       cmd(4, FlagWrite, 1, 1, 1),
+	"SETNX":       cmd(3, FlagWrite, 1, 1, 1),
+	"PSETEX":      cmd(4, FlagWrite, 1, 1, 1),
+	"SETRANGE":    cmd(4, FlagWrite, 1, 1, 1),
+	"STRLEN":      cmd(2, FlagRead, 1, 1, 1),
+	"INCR":        cmd(2, FlagWrite, 1, 1, 1),
+	"DECR":        cmd(2, FlagWrite, 1, 1, 1),
+	"INCRBY":      cmd(3, FlagWrite, 1, 1, 1),
+	"DECRBY":      cmd(3, FlagWrite, 1, 1, 1),
+	"INCRBYFLOAT": cmd(3, FlagWrite, 1, 1, 1),
+	"APPEND":      cmd(3, FlagWrite, 1, 1, 1),
 	// hash
-	"HGET":         []interface{}{3, 3},
-	"HSET":         []interface{}{4, 4},
-	"HMGET":        []interface{}{3, -1},
-	"HMSET":        []interface{}{4, -1},
-	"HGETALL":      []interface{}{2, 2},
-	"HLEN":         []interface{}{2, 2},
-	"HDEL":         []interface{}{3, -1},
-	"HEXISTS":      []interface{}{3, 3},
-	"HINCRBY":      []interface{}{4, 4},
-	"HINCRBYFLOAT": []interface{}{4, 4},
-	"HKEYS":        []interface{}{2, 2},
-	"HSETNX":       []interface{}{4, 4},
-	"HVALS":        []interface{}{2, 2},
+	"HGET":         cmd(3, FlagRead, 1, 1, 1),
+	"HSET":         cmd(4, FlagWrite, 1, 1, 1),
+	"HMGET":        cmd(-3, FlagRead, 1, 1, 1),
+	"HMSET":        cmd(-4, FlagWrite, 1, 1, 1),
+	"HGETALL":      cmd(2, FlagRead, 1, 1, 1),
+	"HLEN":         cmd(2, FlagRead, 1, 1, 1),
+	"HDEL":         cmd(-3, FlagWrite, 1, 1, 1),
+	"HEXISTS":      cmd(3, FlagRead, 1, 1, 1),
+	"HINCRBY":      cmd(4, FlagWrite, 1, 1, 1),
+	"HINCRBYFLOAT": cmd(4, FlagWrite, 1, 1, 1),
+	"HKEYS":        cmd(2, FlagRead, 1, 1, 1),
+	"HSETNX":       cmd(4, FlagWrite, 1, 1, 1),
+	"HVALS":        cmd(2, FlagRead, 1, 1, 1),
+	"HSCAN":        cmd(-3, FlagRead, 1, 1, 1).limit(7),
 	// set
-	"SADD":        []interface{}{3, -1},
-	"SCARD":       []interface{}{2, 2},
-	"SISMEMBER":   []interface{}{3, 3},
-	"SMEMBERS":    []interface{}{2, 2},
-	"SREM":        []interface{}{3, -1},
-	"SPOP":        []interface{}{2, 2},
-	"SRANDMEMBER": []interface{}{2, 3},
-	// "SMOVE":       []interface{}{4, 4},
+	"SADD":        cmd(-3, FlagWrite, 1, 1, 1),
+	"SCARD":       cmd(2, FlagRead, 1, 1, 1),
+	"SISMEMBER":   cmd(3, FlagRead, 1, 1, 1),
+	"SMEMBERS":    cmd(2, FlagRead, 1, 1, 1),
+	"SREM":        cmd(-3, FlagWrite, 1, 1, 1),
+	"SPOP":        cmd(2, FlagWrite, 1, 1, 1),
+	"SRANDMEMBER": cmd(-2, FlagRead, 1, 1, 1).limit(3),
+	"SDIFF":       cmd(-2, FlagRead|FlagMultiKey, 1, -1, 1).limit(2001),
+	"SDIFFSTORE":  cmd(-3, FlagWrite|FlagMultiKey, 1, -1, 1).limit(2002),
+	"SINTER":      cmd(-2, FlagRead|FlagMultiKey, 1, -1, 1).limit(2001),
+	"SINTERSTORE": cmd(-3, FlagWrite|FlagMultiKey, 1, -1, 1).limit(2002),
+	"SUNION":      cmd(-2, FlagRead|FlagMultiKey, 1, -1, 1).limit(2001),
+	"SUNIONSTORE": cmd(-3, FlagWrite|FlagMultiKey, 1, -1, 1).limit(2002),
+	"SSCAN":       cmd(-3, FlagRead, 1, 1, 1).limit(7),
 	// list
-	"LPUSH":   []interface{}{3, -1},
-	"RPUSH":   []interface{}{3, -1},
-	"LPOP":    []interface{}{2, 2},
-	"RPOP":    []interface{}{2, 2},
-	"LINDEX":  []interface{}{3, 3},
-	"LINSERT": []interface{}{5, 5},
-	"LTRIM":   []interface{}{4, 4},
-	"LRANGE":  []interface{}{4, 4},
-	"LLEN":    []interface{}{2, 2},
-	"LPUSHX":  []interface{}{3, 3},
-	"RPUSHX":  []interface{}{3, 3},
-	"LSET":    []interface{}{4, 4},
-	"LREM":    []interface{}{4, 4},
+	"LPUSH":      cmd(-3, FlagWrite, 1, 1, 1),
+	"RPUSH":      cmd(-3, FlagWrite, 1, 1, 1),
+	"LPOP":       cmd(2, FlagWrite, 1, 1, 1),
+	"RPOP":       cmd(2, FlagWrite, 1, 1, 1),
+	"LINDEX":     cmd(3, FlagRead, 1, 1, 1),
+	"LINSERT":    cmd(5, FlagWrite, 1, 1, 1),
+	"LTRIM":      cmd(4, FlagWrite, 1, 1, 1),
+	"LRANGE":     cmd(4, FlagRead, 1, 1, 1),
+	"LLEN":       cmd(2, FlagRead, 1, 1, 1),
+	"LPUSHX":     cmd(3, FlagWrite, 1, 1, 1),
+	"RPUSHX":     cmd(3, FlagWrite, 1, 1, 1),
+	"LSET":       cmd(4, FlagWrite, 1, 1, 1),
+	"LREM":       cmd(4, FlagWrite, 1, 1, 1),
+	"BLPOP":      cmd(-3, FlagWrite|FlagBlocking|FlagMultiKey, 1, -2, 1).limit(2002),
+	"BRPOP":      cmd(-3, FlagWrite|FlagBlocking|FlagMultiKey, 1, -2, 1).limit(2002),
+	"BRPOPLPUSH": cmd(4, FlagWrite|FlagBlocking|FlagMultiKey, 1, 2, 1),
+	"BLMOVE":     cmd(6, FlagWrite|FlagBlocking|FlagMultiKey, 1, 2, 1),
+	"BLMPOP":     cmdKeys(-5, FlagWrite|FlagBlocking|FlagMultiKey, keysNumKeys(0, 2)).limit(2006),
 	// zset
-	"ZADD":             []interface{}{4, -1},
-	"ZCARD":            []interface{}{2, 2},
-	"ZCOUNT":           []interface{}{4, 4},
-	"ZRANK":            []interface{}{3, 3},
-	"ZREVRANK":         []interface{}{3, 3},
-	"ZRANGE":           []interface{}{4, 5},
-	"ZREVRANGE":        []interface{}{4, 5},
-	"ZRANGEBYSCORE":    []interface{}{4, -1},
-	"ZREVRANGEBYSCORE": []interface{}{4, -1},
-	"ZREM":             []interface{}{3, -1},
-	"ZREMRANGEBYRANK":  []interface{}{4, 4},
-	"ZREMRANGEBYSCORE": []interface{}{4, 4},
-	"ZINCRBY":          []interface{}{4, 4},
-	"ZSCORE":           []interface{}{3, 3},
-	"ZRANGEBYLEX":      []interface{}{4, 7},
-	"ZLEXCOUNT":        []interface{}{4, 4},
-	"ZREMRANGEBYLEX":   []interface{}{4, 4},
+	"ZADD":             cmd(-4, FlagWrite, 1, 1, 1),
+	"ZCARD":            cmd(2, FlagRead, 1, 1, 1),
+	"ZCOUNT":           cmd(4, FlagRead, 1, 1, 1),
+	"ZRANK":            cmd(3, FlagRead, 1, 1, 1),
+	"ZREVRANK":         cmd(3, FlagRead, 1, 1, 1),
+	"ZRANGE":           cmd(-4, FlagRead, 1, 1, 1).limit(5),
+	"ZREVRANGE":        cmd(-4, FlagRead, 1, 1, 1).limit(5),
+	"ZRANGEBYSCORE":    cmd(-4, FlagRead, 1, 1, 1),
+	"ZREVRANGEBYSCORE": cmd(-4, FlagRead, 1, 1, 1),
+	"ZREM":             cmd(-3, FlagWrite, 1, 1, 1),
+	"ZREMRANGEBYRANK":  cmd(4, FlagWrite, 1, 1, 1),
+	"ZREMRANGEBYSCORE": cmd(4, FlagWrite, 1, 1, 1),
+	"ZINCRBY":          cmd(4, FlagWrite, 1, 1, 1),
+	"ZSCORE":           cmd(3, FlagRead, 1, 1, 1),
+	"ZRANGEBYLEX":      cmd(-4, FlagRead, 1, 1, 1).limit(7),
+	"ZLEXCOUNT":        cmd(4, FlagRead, 1, 1, 1),
+	"ZREMRANGEBYLEX":   cmd(4, FlagWrite, 1, 1, 1),
+	"ZSCAN":            cmd(-3, FlagRead, 1, 1, 1).limit(7),
+	// numkeys 个 key 和同样个数的 WEIGHTS，最多 2000 个 key
+	"ZUNIONSTORE": cmdKeys(-4, FlagWrite|FlagMultiKey, keysNumKeys(1, 2)).limit(4006),
+	"ZINTERSTORE": cmdKeys(-4, FlagWrite|FlagMultiKey, keysNumKeys(1, 2)).limit(4006),
+	"ZUNION":      cmdKeys(-3, FlagRead|FlagMultiKey, keysNumKeys(0, 1)).limit(4006),
+	"ZINTER":      cmdKeys(-3, FlagRead|FlagMultiKey, keysNumKeys(0, 1)).limit(4006),
+	"ZDIFF":       cmdKeys(-3, FlagRead|FlagMultiKey, keysNumKeys(0, 1)).limit(2003),
+	"BZPOPMIN":    cmd(-3, FlagWrite|FlagBlocking|FlagMultiKey, 1, -2, 1).limit(2002),
+	"BZPOPMAX":    cmd(-3, FlagWrite|FlagBlocking|FlagMultiKey, 1, -2, 1).limit(2002),
+	"BZMPOP":      cmdKeys(-5, FlagWrite|FlagBlocking|FlagMultiKey, keysNumKeys(0, 2)).limit(2006),
 	//finite zset
-	"XADD":        []interface{}{4, -1},
-	"XINCRBY":     []interface{}{4, 9},
-	"XRANGE":      []interface{}{4, 5},
-	"XREVRANGE":   []interface{}{4, 5},
-	"XSCORE":      []interface{}{3, 3},
-	"XREM":        []interface{}{3, -1},
-	"XCARD":       []interface{}{2, 2},
-	"XSETOPTIONS": []interface{}{3, 7},
-	"XGETFINITY":  []interface{}{2, 2},
-	"XGETPRUNING": []interface{}{2, 2},
+	"XADD":        cmd(-4, FlagWrite, 1, 1, 1),
+	"XINCRBY":     cmd(-4, FlagWrite, 1, 1, 1).limit(9),
+	"XRANGE":      cmd(-4, FlagRead, 1, 1, 1).limit(5),
+	"XREVRANGE":   cmd(-4, FlagRead, 1, 1, 1).limit(5),
+	"XSCORE":      cmd(3, FlagRead, 1, 1, 1),
+	"XREM":        cmd(-3, FlagWrite, 1, 1, 1),
+	"XCARD":       cmd(2, FlagRead, 1, 1, 1),
+	"XSETOPTIONS": cmd(-3, FlagWrite, 1, 1, 1).limit(7),
+	"XGETFINITY":  cmd(2, FlagRead, 1, 1, 1),
+	"XGETPRUNING": cmd(2, FlagRead, 1, 1, 1),
+	// stream, key 在 STREAMS 之后
+	"XREAD":      cmdKeys(-4, FlagRead|FlagBlocking|FlagMultiKey, keysStreams),
+	"XREADGROUP": cmdKeys(-7, FlagWrite|FlagBlocking|FlagMultiKey, keysStreams),
+	// transaction
+	"MULTI":   cmd(1, 0, 0, 0, 0),
+	"EXEC":    cmd(1, 0, 0, 0, 0),
+	"DISCARD": cmd(1, 0, 0, 0, 0),
+	"WATCH":   cmd(-2, FlagMultiKey, 1, -1, 1).limit(2001),
+	"UNWATCH": cmd(1, 0, 0, 0, 0),
+	// script
+	"EVAL":       cmdKeys(-3, FlagWrite|FlagMultiKey, keysNumKeys(0, 2)),
+	"EVALSHA":    cmdKeys(-3, FlagWrite|FlagMultiKey, keysNumKeys(0, 2)),
+	"EVAL_RO":    cmdKeys(-3, FlagRead|FlagMultiKey, keysNumKeys(0, 2)),
+	"EVALSHA_RO": cmdKeys(-3, FlagRead|FlagMultiKey, keysNumKeys(0, 2)),
+	"FCALL":      cmdKeys(-3, FlagWrite|FlagMultiKey, keysNumKeys(0, 2)),
+	"FCALL_RO":   cmdKeys(-3, FlagRead|FlagMultiKey, keysNumKeys(0, 2)),
+	"SCRIPT":     cmd(-2, 0, 0, 0, 0),
+	// pubsub
+	"SUBSCRIBE":    cmd(-2, FlagPubSub, 0, 0, 0),
+	"UNSUBSCRIBE":  cmd(-1, FlagPubSub, 0, 0, 0),
+	"PSUBSCRIBE":   cmd(-2, FlagPubSub, 0, 0, 0),
+	"PUNSUBSCRIBE": cmd(-1, FlagPubSub, 0, 0, 0),
+	"PUBLISH":      cmd(3, FlagPubSub, 0, 0, 0),
+	"SSUBSCRIBE":   cmd(-2, FlagPubSub, 1, -1, 1),
+	"SUNSUBSCRIBE": cmd(-1, FlagPubSub, 1, -1, 1),
+	"SPUBLISH":     cmd(3, FlagPubSub, 1, 1, 1),
+}
+
+func init() {
+	for name, ci := range commandTable {
+		ci.Name = name
+	}
 }
 
+// proxy 自己处理或者拆分执行的命令，不走 DefaultOP
 var specList = map[string]bool{
-	"INFO": true,
-	// "RENAME":   true,
-	// "RENAMENX": true,
-	"MGET": true,
-	"MSET": true,
-	"DEL":  true,
-	// "MSETNX":      true,
+	"PING":     true,
+	"QUIT":     true,
+	"SELECT":   true,
+	"HELLO":    true,
+	"AUTH":     true,
+	"INFO":     true,
+	"CLIENT":   true,
+	"RENAME":   true,
+	"RENAMENX": true,
+	"SCAN":     true,
+	// 需要在 [commands] 中配置 allow
+	"KEYS":      true,
+	"DBSIZE":    true,
+	"RANDOMKEY": true,
+	"FLUSHDB":   true,
+	"FLUSHALL":  true,
+	"MGET":      true,
+	"MSET":      true,
+	"DEL":       true,
+	"UNLINK":    true,
+	"EXISTS":    true,
+	"TOUCH":     true,
 	// "RPOPLPUSH":   true,
-	// "SDIFF":       true,
-	// "SDIFFSTORE":  true,
-	// "SINTER":      true,
-	// "SINTERSTORE": true,
+	"SDIFF":       true,
+	"SDIFFSTORE":  true,
+	"SINTER":      true,
+	"SINTERSTORE": true,
+	"SUNION":      true,
+	"SUNIONSTORE": true,
 	// "SMOVE":       true,
-	// "ZUNIONSTORE": true,
-	// "ZINTERSTORE": true,
+	"ZUNIONSTORE": true,
+	"ZINTERSTORE": true,
+	"ZUNION":      true,
+	"ZINTER":      true,
+	"ZDIFF":       true,
+	"EVAL":        true,
+	"EVAL_RO":     true,
+	"EVALSHA":     true,
+	"EVALSHA_RO":  true,
+	"SCRIPT":      true,
+	"PUBLISH":     true,
+	"BLPOP":       true,
+	"BRPOP":       true,
+	"BRPOPLPUSH":  true,
+	"BLMOVE":      true,
+	"BLMPOP":      true,
+	"BZPOPMIN":    true,
+	"BZPOPMAX":    true,
+	"BZMPOP":      true,
+}
+
+// 按子命令过滤的命令，只允许列出的子命令，优先于 blackList
+var subcommands = map[string][]string{
+	"CLIENT": {"SETNAME", "GETNAME"},
+	"OBJECT": {"ENCODING", "FREQ", "IDLETIME", "REFCOUNT"},
+	"SCRIPT": {"LOAD", "EXISTS", "FLUSH"},
 }
 
 var blackList = map[string]bool{
 	"BGREWRITEAOF": true,
 	"BGSAVE":       true,
 	"BITOP":        true,
-	"BLPOP":        true,
-	"BRPOP":        true,
-	"BRPOPLPUSH":   true,
 	"CLIENT":       true,
 	"CONFIG":       true,
 	"DBSIZE":       true,
 	"DEBUG":        true,
-	"DISCARD":      true,
-	"EXEC":         true,
 	"FLUSHALL":     true,
 	"FLUSHDB":      true,
 	"KEYS":         true,
 	"LASTSAVE":     true,
 	"MONITOR":      true,
 	"MOVE":         true,
-	"MSETNX":       true,
-	"MULTI":        true,
 	"OBJECT":       true,
-	"PSUBSCRIBE":   true,
-	"PUBLISH":      true,
-	"PUNSUBSCRIBE": true,
 	"RANDOMKEY":    true,
-	"RENAME":       true,
-	"RENAMENX":     true,
 	"SAVE":         true,
-	"SCAN":         true,
-	"SSCAN":        true,
-	"HSCAN":        true,
-	"ZSCAN":        true,
-	"SCRIPT":       true,
 	"SHUTDOWN":     true,
 	"SLAVEOF":      true,
 	"SLOWLOG":      true,
 	"SORT":         true,
-	"SUBSCRIBE":    true,
 	"SYNC":         true,
-	"SDIFF":        true,
-	"SDIFFSTORE":   true,
-	"SINTER":       true,
-	"SINTERSTORE":  true,
 	"SMOVE":        true,
-	"SUNION":       true,
-	"SUNIONSTORE":  true,
 	"TIME":         true,
-	"UNSUBSCRIBE":  true,
-	"UNWATCH":      true,
-	"WATCH":        true,
-	"ZUNIONSTORE":  true,
-	"ZINTERSTORE":  true,
+}
+
+// RESP3 客户端的回复转换方式，后端连接始终是 RESP2
+const (
+	Reply3Map        = "map"
+	Reply3Set        = "set"
+	Reply3Double     = "double"
+	Reply3ScorePairs = "scorepairs" // 只在带 WITHSCORES 时转换
+)
+
+var resp3Replies = map[string]string{
+	"HGETALL":          Reply3Map,
+	"SMEMBERS":         Reply3Set,
+	"SINTER":           Reply3Set,
+	"SUNION":           Reply3Set,
+	"SDIFF":            Reply3Set,
+	"ZSCORE":           Reply3Double,
+	"ZINCRBY":          Reply3Double,
+	"ZRANGE":           Reply3ScorePairs,
+	"ZUNION":           Reply3ScorePairs,
+	"ZINTER":           Reply3ScorePairs,
+	"ZDIFF":            Reply3ScorePairs,
+	"ZREVRANGE":        Reply3ScorePairs,
+	"ZRANGEBYSCORE":    Reply3ScorePairs,
+	"ZREVRANGEBYSCORE": Reply3ScorePairs,
 }
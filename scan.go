@@ -0,0 +1,72 @@
+package archer
+
+import (
+	"strconv"
+
+	"github.com/dongzerun/archer/hack"
+	log "github.com/ngaut/logging"
+)
+
+// SCAN 返回给客户端的 cursor 高 16 位是主库在 Topology.Masters 中的下标，低 48 位是该主库的 cursor
+// 一个主库遍历完之后从下一个主库的 0 开始，最后一个主库遍历完返回 0
+// 遍历过程中拓扑变化时主库的下标可能改变，和 Redis 的 rehash 一样可能重复或者遗漏 key
+const (
+	scanNodeShift  = 48
+	scanCursorMask = 1<<scanNodeShift - 1
+)
+
+var InvalidCursorError = []byte("ERR invalid cursor")
+
+// Scan SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]，选项原样转发给主库
+func (s *Session) Scan(req *ArrayResp, seq int64) {
+	defer func() {
+		s.conCurrency <- 1
+	}()
+
+	cursor, err := strconv.ParseUint(hack.String(req.Arg(1)), 10, 64)
+	masters := s.p.cluster.topo.Masters()
+	idx := int(cursor >> scanNodeShift)
+	if err != nil || idx >= len(masters) {
+		s.resps <- WrappedErrorResp(InvalidCursorError, seq)
+		return
+	}
+
+	scan := NewCommand([]byte("SCAN"), strconv.AppendUint(nil, cursor&scanCursorMask, 10))
+	scan.Args = append(scan.Args, req.Args[2:]...)
+	resp := s.broadcast([]string{masters[idx].id}, scan)[0]
+	if er, ok := resp.(*ErrorResp); ok {
+		s.resps <- WrappedResp(er, seq)
+		return
+	}
+
+	next, ok := scanCursor(resp)
+	if !ok || next > scanCursorMask {
+		log.Warning("Session SCAN wrong reply ", resp.String())
+		s.resps <- WrappedErrorResp([]byte("proxy internal SCAN failed"), seq)
+		return
+	}
+
+	switch {
+	case next != 0:
+		next |= uint64(idx) << scanNodeShift
+	case idx+1 < len(masters):
+		next = uint64(idx+1) << scanNodeShift
+	}
+	ar := resp.(*ArrayResp)
+	ar.Args[0] = NewBulkResp(strconv.AppendUint(nil, next, 10))
+	s.resps <- WrappedResp(ar, seq)
+}
+
+// scanCursor 返回 SCAN 回复 [cursor, [key ...]] 中的 cursor
+func scanCursor(resp Resp) (uint64, bool) {
+	ar, ok := resp.(*ArrayResp)
+	if !ok || len(ar.Args) != 2 {
+		return 0, false
+	}
+	br, ok := ar.Args[0].(*BulkResp)
+	if !ok || len(br.Args) == 0 {
+		return 0, false
+	}
+	cursor, err := strconv.ParseUint(hack.String(br.Args[0]), 10, 64)
+	return cursor, err == nil
+}
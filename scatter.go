@@ -0,0 +1,190 @@
+package archer
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dongzerun/archer/hack"
+	"github.com/dongzerun/archer/util"
+	log "github.com/ngaut/logging"
+)
+
+// subRequest 是多 key 命令拆分之后发给单个 slot 的请求
+type subRequest struct {
+	req  *ArrayResp
+	keys []int // 子请求中的 key 在原请求 key 列表中的序号
+	resp Resp
+}
+
+// splitBySlot 把 cmd key [arg...] key [arg...] 形式的请求按 slot 拆分
+// 从 first 开始每 step 个参数是一组，第一个是 key，子请求保持 key 的原始顺序
+func splitBySlot(req *ArrayResp, cmd []byte, first, step int) []*subRequest {
+	var subs []*subRequest
+	bySlot := make(map[uint16]*subRequest)
+	for i, n := first, 0; i+step <= len(req.Args); i, n = i+step, n+1 {
+		slot := util.Crc16sum(req.Arg(i)) % 16384
+		sub, ok := bySlot[slot]
+		if !ok {
+			sub = &subRequest{req: NewCommand(cmd)}
+			bySlot[slot] = sub
+			subs = append(subs, sub)
+		}
+		for j := i; j < i+step; j++ {
+			sub.req.Args = append(sub.req.Args, req.Args[j])
+		}
+		sub.keys = append(sub.keys, n)
+	}
+	return subs
+}
+
+// perKey 每个 key 一个子请求 cmd key args...
+func perKey(cmd []byte, keys [][]byte, args ...[]byte) []*subRequest {
+	subs := make([]*subRequest, len(keys))
+	for i, k := range keys {
+		subs[i] = &subRequest{req: NewCommand(append([][]byte{cmd, k}, args...)...), keys: []int{i}}
+	}
+	return subs
+}
+
+// scatter 按节点分组执行子请求，同一节点的子请求在一个连接上 pipeline 发送，节点之间并发
+// 回复 MOVED/ASK 的子请求单独重定向，连接出错时该节点所有子请求的回复都是错误
+func (s *Session) scatter(subs []*subRequest, slave bool) {
+	byNode := make(map[string][]*subRequest)
+	for _, sub := range subs {
+		id := s.p.cluster.topo.GetNodeID(sub.req.Arg(1), slave)
+		byNode[id] = append(byNode[id], sub)
+	}
+
+	var wg sync.WaitGroup
+	for id, group := range byNode {
+		wg.Add(1)
+		go func(id string, group []*subRequest) {
+			defer wg.Done()
+			s.execGroup(id, group)
+		}(id, group)
+	}
+	wg.Wait()
+}
+
+func (s *Session) execGroup(id string, group []*subRequest) {
+	fail := func(err error) {
+		for _, sub := range group {
+			sub.resp = NewErrorResp([]byte("proxy internal error " + err.Error()))
+		}
+	}
+
+	rc, err := s.GetRedisConnByID(id)
+	if err != nil {
+		log.Warning("Session scatter get conn failed ", id, err)
+		fail(err)
+		return
+	}
+	reqs := make([]*ArrayResp, len(group))
+	for i, sub := range group {
+		reqs[i] = sub.req
+	}
+	resps, err := s.ExecPipeline(rc, reqs)
+	if err != nil {
+		log.Warning("Session scatter ExecPipeline failed ", id, err)
+		s.p.cluster.RemoveConn(rc)
+		fail(err)
+		return
+	}
+	s.p.cluster.PutConn(rc)
+
+	for i, sub := range group {
+		sub.resp = resps[i]
+		er, ok := resps[i].(*ErrorResp)
+		if !ok {
+			continue
+		}
+		e := strings.Fields(hack.String(er.Args[0]))
+		if len(e) != 3 {
+			continue
+		}
+		switch e[0] {
+		case "MOVED":
+			s.p.cluster.topo.Reload()
+			sub.resp = s.Redirect("MOVED", sub.req, e[2])
+		case "ASK":
+			sub.resp = s.Redirect("ASK", sub.req, e[2])
+		}
+	}
+}
+
+// broadcast 把 req 并发发给 ids 中的每个节点，回复和 ids 一一对应
+func (s *Session) broadcast(ids []string, req *ArrayResp) []Resp {
+	subs := make([]*subRequest, len(ids))
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		subs[i] = &subRequest{req: req}
+		wg.Add(1)
+		go func(id string, sub *subRequest) {
+			defer wg.Done()
+			s.execGroup(id, []*subRequest{sub})
+		}(id, subs[i])
+	}
+	wg.Wait()
+
+	resps := make([]Resp, len(subs))
+	for i, sub := range subs {
+		resps[i] = sub.resp
+	}
+	return resps
+}
+
+// firstError 返回第一个失败的子请求的错误回复
+func firstError(subs []*subRequest) *ErrorResp {
+	for _, sub := range subs {
+		if er, ok := sub.resp.(*ErrorResp); ok {
+			return er
+		}
+	}
+	return nil
+}
+
+// sumInts 执行回复整数的子请求并求和
+func (s *Session) sumInts(subs []*subRequest, slave bool) (int64, *ErrorResp) {
+	s.scatter(subs, slave)
+	return sumReplies(subs)
+}
+
+// sumReplies 对已经执行的子请求的整数回复求和
+func sumReplies(subs []*subRequest) (int64, *ErrorResp) {
+	if er := firstError(subs); er != nil {
+		return 0, er
+	}
+	var sum int64
+	for _, sub := range subs {
+		ir, ok := sub.resp.(*IntResp)
+		if !ok {
+			log.Warning("Session sumReplies wrong reply ", sub.resp.String())
+			return 0, NewErrorResp([]byte("proxy internal error wrong reply type"))
+		}
+		n, err := strconv.ParseInt(hack.String(ir.Args[0]), 10, 64)
+		if err != nil {
+			return 0, NewErrorResp([]byte("proxy internal error wrong integer reply"))
+		}
+		sum += n
+	}
+	return sum, nil
+}
+
+// retryWrongType 把回复 WRONGTYPE 的子请求换成 cmd key 重新执行，返回的切片标记哪些子请求被重试
+func (s *Session) retryWrongType(subs []*subRequest, cmd []byte, slave bool) []bool {
+	retried := make([]bool, len(subs))
+	var again []*subRequest
+	for i, sub := range subs {
+		if er, ok := sub.resp.(*ErrorResp); ok && bytes.HasPrefix(er.Args[0], []byte("WRONGTYPE")) {
+			sub.req = NewCommand(cmd, sub.req.Arg(1))
+			retried[i] = true
+			again = append(again, sub)
+		}
+	}
+	if len(again) > 0 {
+		s.scatter(again, slave)
+	}
+	return retried
+}
@@ -0,0 +1,183 @@
+package archer
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+	"sync"
+
+	"github.com/dongzerun/archer/hack"
+	log "github.com/ngaut/logging"
+)
+
+var (
+	NoScript                = []byte("NOSCRIPT")
+	ScriptSubcommandError   = []byte("ERR SCRIPT subcommand not supported by proxy")
+	ScriptInconsistentError = []byte("ERR SCRIPT LOAD returned different sha1 on nodes")
+)
+
+// scriptCache 保存 EVAL 和 SCRIPT LOAD 见过的脚本，key 是小写的 sha1
+// 节点重启或者故障切换之后脚本丢失，EVALSHA 回复 NOSCRIPT 时用缓存重新加载
+type scriptCache struct {
+	sync.RWMutex
+	max     int
+	scripts map[string][]byte
+}
+
+func newScriptCache(max int) *scriptCache {
+	return &scriptCache{max: max, scripts: make(map[string][]byte)}
+}
+
+// add 拷贝 body，请求会被回收，超过上限时随机淘汰一个脚本
+func (c *scriptCache) add(body []byte) string {
+	sum := sha1.Sum(body)
+	sha := hex.EncodeToString(sum[:])
+	if c.max <= 0 {
+		return sha
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.scripts[sha]; ok {
+		return sha
+	}
+	if len(c.scripts) >= c.max {
+		for k := range c.scripts {
+			delete(c.scripts, k)
+			break
+		}
+	}
+	c.scripts[sha] = append([]byte(nil), body...)
+	return sha
+}
+
+func (c *scriptCache) get(sha []byte) []byte {
+	c.RLock()
+	defer c.RUnlock()
+	return c.scripts[strings.ToLower(hack.String(sha))]
+}
+
+func (c *scriptCache) flush() {
+	c.Lock()
+	c.scripts = make(map[string][]byte)
+	c.Unlock()
+}
+
+// Eval 按 numkeys 声明的 key 路由 EVAL EVALSHA，跨 slot 已经在 Dispatch 中拒绝
+// EVALSHA 回复 NOSCRIPT 并且 proxy 缓存了脚本时，在回复 NOSCRIPT 的节点 SCRIPT LOAD 之后重试一次
+func (s *Session) Eval(req *ArrayResp, seq int64) {
+	defer func() {
+		s.conCurrency <- 1
+	}()
+
+	ci := commandOf(req)
+	if ci.Name == "EVAL" || ci.Name == "EVAL_RO" {
+		s.p.scripts.add(req.Arg(1))
+	}
+
+	// 记录最后执行的节点，MOVED ASK 之后脚本要加载到重定向的目标节点
+	id := s.p.cluster.topo.GetNodeID(RouteKey(req), ci.IsRead() && s.p.pc.slaveOk)
+	asking := false
+	resp := s.Redirect("", req, id)
+	if er, ok := resp.(*ErrorResp); ok {
+		//-MOVED 15495 10.10.200.11:6481 重定向只重试一次
+		e := strings.Fields(hack.String(er.Args[0]))
+		if len(e) == 3 && (e[0] == "MOVED" || e[0] == "ASK") {
+			if e[0] == "MOVED" {
+				s.p.cluster.topo.Reload()
+			}
+			Release(resp)
+			id, asking = e[2], e[0] == "ASK"
+			resp = s.Redirect(e[0], req, id)
+		}
+	}
+	if er, ok := resp.(*ErrorResp); ok && bytes.HasPrefix(er.Args[0], NoScript) {
+		if body := s.p.scripts.get(req.Arg(1)); body != nil {
+			Release(resp)
+			resp = s.reloadScript(id, asking, req, body)
+		}
+	}
+	s.resps <- WrappedResp(s.resp3Reply(req, resp), seq)
+}
+
+// reloadScript SCRIPT LOAD 和 EVALSHA 在 id 节点的同一个连接上 pipeline 发送，asking 时 EVALSHA 之前发送 ASKING
+func (s *Session) reloadScript(id string, asking bool, req *ArrayResp, body []byte) Resp {
+	subs := []*subRequest{{req: NewCommand([]byte("SCRIPT"), []byte("LOAD"), body)}}
+	if asking {
+		subs = append(subs, &subRequest{req: NewCommand(ASKING)})
+	}
+	subs = append(subs, &subRequest{req: req})
+	s.execGroup(id, subs)
+	if er, ok := subs[0].resp.(*ErrorResp); ok {
+		log.Warning("Session reload script failed ", id, string(er.Args[0]))
+	}
+	return subs[len(subs)-1].resp
+}
+
+// Script 把 SCRIPT LOAD EXISTS FLUSH 发给所有主库并合并回复
+// 从库通过复制得到主库加载的脚本
+func (s *Session) Script(req *ArrayResp, seq int64) {
+	defer func() {
+		s.conCurrency <- 1
+	}()
+
+	sub := strings.ToUpper(hack.String(req.Arg(1)))
+	n := len(req.Args)
+	if !(sub == "LOAD" && n == 3 || sub == "EXISTS" && n > 2 || sub == "FLUSH" && n <= 3) {
+		s.resps <- WrappedErrorResp(ScriptSubcommandError, seq)
+		return
+	}
+	// FLUSH 之后不能再用缓存重新加载脚本，不管节点是否全部成功
+	if sub == "FLUSH" {
+		s.p.scripts.flush()
+	}
+
+	masters := s.p.cluster.topo.Masters()
+	ids := make([]string, len(masters))
+	for i, m := range masters {
+		ids[i] = m.id
+	}
+	resps := s.broadcast(ids, req)
+	for _, r := range resps {
+		if er, ok := r.(*ErrorResp); ok {
+			s.resps <- WrappedResp(er, seq)
+			return
+		}
+	}
+
+	switch sub {
+	case "LOAD":
+		sha := s.p.scripts.add(req.Arg(2))
+		for _, r := range resps {
+			if br, ok := r.(*BulkResp); !ok || len(br.Args) == 0 || !strings.EqualFold(hack.String(br.Args[0]), sha) {
+				log.Warning("Session SCRIPT LOAD wrong reply ", r.String())
+				s.resps <- WrappedErrorResp(ScriptInconsistentError, seq)
+				return
+			}
+		}
+		s.resps <- WrappedResp(NewBulkResp([]byte(sha)), seq)
+	case "EXISTS":
+		// 所有主库都有的脚本才算存在
+		exists := NewArrayResp()
+		for i := 2; i < n; i++ {
+			exists.Args = append(exists.Args, NewIntResp(1))
+		}
+		for _, r := range resps {
+			ar, ok := r.(*ArrayResp)
+			if !ok || len(ar.Args) != n-2 {
+				log.Warning("Session SCRIPT EXISTS wrong reply ", r.String())
+				s.resps <- WrappedErrorResp([]byte("proxy internal SCRIPT EXISTS failed"), seq)
+				return
+			}
+			for i, a := range ar.Args {
+				if ir, ok := a.(*IntResp); !ok || string(ir.Args[0]) != "1" {
+					exists.Args[i] = NewIntResp(0)
+				}
+			}
+		}
+		s.resps <- WrappedResp(exists, seq)
+	case "FLUSH":
+		s.resps <- WrappedOKResp(seq)
+	}
+}
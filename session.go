@@ -2,6 +2,7 @@ package archer
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"net"
@@ -51,7 +52,7 @@ func (sm *SessMana) CheckIdleLoop() {
 		select {
 		case <-ticker.C:
 			for id, s := range sm.pool {
-				if sm.idle > 0 && time.Since(s.lastUsed) > sm.idle {
+				if sm.idle > 0 && atomic.LoadInt32(&s.subscribed) == 0 && atomic.LoadInt32(&s.blocked) == 0 && time.Since(s.lastUsed) > sm.idle {
 					sm.l.Lock()
 					delete(sm.pool, id)
 					sm.l.Unlock()
@@ -82,16 +83,37 @@ type Session struct {
 
 	conCurrency chan int
 
-	quitChan chan int
-	closed   bool
-	wg       util.WaitGroupWrapper
+	quitChan  chan int
+	closeOnce sync.Once
+	wg        util.WaitGroupWrapper
 
 	// pipeline used seq
 	reqSequence  int64
 	respSequence int64
+	// 写完这个 seq 的回复之后关闭 Session，-1 表示不关闭
+	quitSequence int64
 
 	lastUsed time.Time
 	remote   string
+
+	// 客户端协议版本 2 or 3，通过 HELLO 协商，atomic 读写
+	proto int32
+
+	// CLIENT SETNAME 设置的名字，只在 Dispatch 中读写
+	name string
+
+	// 认证的用户，nil 表示还没有认证，只在 Dispatch 中读写
+	user *User
+
+	// WATCH 或者 MULTI 之后的事务状态，nil 表示没有事务，只在 Dispatch 中读写
+	tx *transaction
+
+	// 订阅状态，nil 表示不在订阅模式，只在 Dispatch 中读写
+	ps *pubsub
+	// 订阅模式下为 1，atomic 读写，不检查 idle 超时
+	subscribed int32
+	// 正在执行的阻塞命令数，atomic 读写，不检查 idle 超时
+	blocked int32
 }
 
 func NewSession(p *Proxy, c net.Conn) *Session {
@@ -105,10 +127,13 @@ func NewSession(p *Proxy, c net.Conn) *Session {
 		//out-of-order store temporary
 		ooo: make(map[int64]Resp, p.pc.conCurrency),
 		//max dispatch concurrency goroutine per session
-		conCurrency: make(chan int, p.pc.conCurrency),
-		quitChan:    make(chan int, 1),
-		lastUsed:    time.Now(),
-		remote:      c.RemoteAddr().String(),
+		conCurrency:  make(chan int, p.pc.conCurrency),
+		quitChan:     make(chan int, 1),
+		lastUsed:     time.Now(),
+		remote:       c.RemoteAddr().String(),
+		proto:        2,
+		quitSequence: -1,
+		user:         p.acl.NoAuthUser(),
 	}
 
 	if p.pc.readTimeout > 0 {
@@ -130,23 +155,68 @@ func NewSession(p *Proxy, c net.Conn) *Session {
 }
 
 func (s *Session) ReadLoop() {
-	for !s.closed {
-
-		cmd, err := ReadProtocol(s.r)
-		if err != nil && err != io.EOF {
-			log.Warningf("%s ReadLoop read err: %s", s.c.RemoteAddr().String(), err)
+	for {
+		// Close 可能在其它 goroutine 中调用，通过 quitChan 判断
+		select {
+		case <-s.quitChan:
+			goto quit
+		default:
+		}
+		// 等待下一个请求的第一个字节，请求之间的读超时不影响流的同步
+		_, err := s.r.Peek(1)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
 			continue
 		}
+		var cmd Resp
+		if err == nil {
+			cmd, err = ReadProtocolPooled(s.r, s.p.limit, s.p.pc.streamThreshold)
+		}
 		if err == io.EOF {
 			log.Infof("%s ReadLoop read EOF just quit ", s.c.RemoteAddr().String())
 			s.Close()
 			goto quit
 		}
+		if err != nil {
+			// Session 已经关闭，连接被其它 goroutine 关闭
+			select {
+			case <-s.quitChan:
+				goto quit
+			default:
+			}
+			// 读到一半的请求出错，流已经无法同步，回复错误后关闭连接
+			msg := err.Error()
+			if IsProtocolError(err) {
+				log.Warningf("%s ReadLoop protocol err: %s", s.c.RemoteAddr().String(), err)
+			} else {
+				log.Warningf("%s ReadLoop read err: %s", s.c.RemoteAddr().String(), err)
+				msg = "ERR read request failed: " + msg
+			}
+			s.CloseAfter(s.reqSequence)
+			s.resps <- WrappedErrorResp([]byte(msg), s.reqSequence)
+			goto quit
+		}
+
+		// 放入 s.cmds 之后 cmd 可能已经被 Release，提前取出流式参数
+		sb := streamOf(cmd)
 
 		s.cmds <- WrappedResp(cmd, s.reqSequence)
 
 		s.lastUsed = time.Now()
 		atomic.AddInt64(&s.reqSequence, 1)
+
+		// 大 value 的 payload 还在 s.r 中，等转发到后端之后才能读取下一个请求
+		if sb != nil {
+			select {
+			case <-sb.Done():
+			case <-s.quitChan:
+				goto quit
+			}
+			if sb.Err() != nil {
+				log.Warningf("%s ReadLoop stream bulk err: %s", s.c.RemoteAddr().String(), sb.Err())
+				s.Close()
+				goto quit
+			}
+		}
 	}
 quit:
 	log.Warning("quit ReadLoop")
@@ -158,31 +228,136 @@ func (s *Session) Dispatch() {
 		case c := <-s.cmds:
 			command, err := s.p.filter.Inspect(c.resp)
 			if err != nil {
-				s.resps <- WrappedErrorResp([]byte(err.Error()), c.seq)
+				s.reject(c, err)
 				continue
 			}
 
 			ar := c.resp.(*ArrayResp)
+			// 只有 value 可以流式转发，key 需要完整读取才能计算 slot
+			if err := ar.materializeKeys(commandTable[command]); err != nil {
+				Release(ar)
+				s.resps <- WrappedErrorResp([]byte(err.Error()), c.seq)
+				continue
+			}
+			// 认证和权限检查
+			if err := s.checkPerm(command, ar); err != nil {
+				s.reject(c, err)
+				continue
+			}
+			// 事务命令和 MULTI 之后的命令在 Dispatch 中同步转发到固定的连接
+			if s.Transaction(command, ar, c.seq) {
+				continue
+			}
+			// 订阅命令和订阅模式下的命令在 Dispatch 中同步处理
+			if s.PubSub(command, ar, c.seq) {
+				continue
+			}
+			// proxy 不拆分的多 key 命令要求所有 key 在同一个 slot
+			if ci := commandTable[command]; ci != nil && ci.Has(FlagMultiKey) && !specList[command] && !sameSlot(ci, ar) {
+				s.reject(c, CrossSlotError)
+				continue
+			}
+			// 只有 DefaultOP 支持流式转发，其它命令需要完整的参数
+			if _, ok := specList[command]; ok {
+				if err := ar.Materialize(); err != nil {
+					Release(ar)
+					s.resps <- WrappedErrorResp([]byte(err.Error()), c.seq)
+					continue
+				}
+			}
+			// proxy 本地处理的命令回复之后立即回收请求，其它命令在 Route 中回收
 			switch command {
 			case "PING":
+				Release(ar)
 				s.resps <- WrappedPONGResp(c.seq)
 				continue
 			case "QUIT":
+				Release(ar)
+				s.CloseAfter(c.seq)
 				s.resps <- WrappedOKResp(c.seq)
-				s.Close()
 				goto quit
 			case "SELECT":
+				Release(ar)
 				s.resps <- WrappedOKResp(c.seq)
 				continue
+			case "AUTH":
+				resp := s.Auth(ar)
+				Release(ar)
+				s.resps <- WrappedResp(resp, c.seq)
+				continue
+			case "HELLO":
+				resp := s.Hello(ar)
+				Release(ar)
+				s.resps <- WrappedResp(resp, c.seq)
+				continue
+			case "CLIENT":
+				resp := s.Client(ar)
+				Release(ar)
+				s.resps <- WrappedResp(resp, c.seq)
+				continue
 			case "INFO":
 				//TODO: implement INFO command
+				Release(ar)
 				s.resps <- WrappedOKResp(c.seq)
 			case "MSET":
 				s.Route(ar, c.seq, "MSET")
 			case "MGET":
 				s.Route(ar, c.seq, "MGET")
-			case "DEL":
-				s.Route(ar, c.seq, "DEL")
+			case "DEL", "UNLINK", "EXISTS", "TOUCH":
+				s.Route(ar, c.seq, "SUMKEYS")
+			case "SINTER", "SUNION", "SDIFF", "SINTERSTORE", "SUNIONSTORE", "SDIFFSTORE":
+				// 同一个 slot 直接转发
+				if sameSlot(commandTable[command], ar) {
+					s.Route(ar, c.seq, "")
+				} else {
+					s.Route(ar, c.seq, "SETOP")
+				}
+			case "SCAN":
+				s.Route(ar, c.seq, "SCAN")
+			case "KEYS", "DBSIZE", "RANDOMKEY", "FLUSHDB", "FLUSHALL":
+				s.Route(ar, c.seq, "KEYSPACE")
+			case "EVAL", "EVAL_RO", "EVALSHA", "EVALSHA_RO":
+				// 需要完整的脚本，不经过上面的 CROSSSLOT 检查
+				if !sameSlot(commandTable[command], ar) {
+					s.reject(c, CrossSlotError)
+					continue
+				}
+				s.Route(ar, c.seq, "EVAL")
+			case "SCRIPT":
+				s.Route(ar, c.seq, "SCRIPT")
+			case "PUBLISH":
+				s.Route(ar, c.seq, "PUBLISH")
+			case "BLPOP", "BRPOP", "BRPOPLPUSH", "BLMOVE", "BLMPOP", "BZPOPMIN", "BZPOPMAX", "BZMPOP":
+				// 使用单独的连接池，不经过上面的 CROSSSLOT 检查
+				if !sameSlot(commandTable[command], ar) {
+					s.reject(c, CrossSlotError)
+					continue
+				}
+				s.Route(ar, c.seq, "BLOCKING")
+			case "XREAD", "XREADGROUP":
+				// 带 BLOCK 的使用阻塞命令的连接池
+				if _, ok := xreadBlock(ar); !ok {
+					s.Route(ar, c.seq, "")
+					continue
+				}
+				if err := ar.Materialize(); err != nil {
+					Release(ar)
+					s.resps <- WrappedErrorResp([]byte(err.Error()), c.seq)
+					continue
+				}
+				s.Route(ar, c.seq, "BLOCKING")
+			case "RENAME", "RENAMENX":
+				if sameSlot(commandTable[command], ar) {
+					s.Route(ar, c.seq, "")
+				} else {
+					s.Route(ar, c.seq, "RENAME")
+				}
+			case "ZUNION", "ZINTER", "ZDIFF", "ZUNIONSTORE", "ZINTERSTORE":
+				if sameSlot(commandTable[command], ar) {
+					s.Route(ar, c.seq, "")
+				} else {
+					s.Route(ar, c.seq, "ZSETOP")
+				}
 			default:
 				s.Route(ar, c.seq, "")
 			}
@@ -192,85 +367,221 @@ func (s *Session) Dispatch() {
 		}
 	}
 quit:
+	// 未结束的事务关闭固定的连接，后端会丢弃事务状态
+	s.releaseTx(false)
+	s.leavePubSub()
 	log.Warning("quit Dispatch")
 }
 
+// reject 回复错误并回收请求，流式参数需要先读完
+func (s *Session) reject(c *wrappedResp, err error) {
+	if ar, ok := c.resp.(*ArrayResp); ok && ar.Stream() != nil {
+		ar.Stream().Discard()
+	}
+	// MULTI 之后被拒绝的命令让 EXEC 失败
+	if s.tx != nil && s.tx.multi {
+		s.tx.dirty = true
+	}
+	Release(c.resp)
+	s.resps <- WrappedErrorResp([]byte(err.Error()), c.seq)
+}
+
+// checkPerm 未认证的 Session 只能执行 AUTH HELLO QUIT
+func (s *Session) checkPerm(command string, req *ArrayResp) error {
+	if s.user == nil {
+		if noAuthCommands[command] {
+			return nil
+		}
+		return NoAuthError
+	}
+	return s.user.CheckCommand(command, req)
+}
+
 func (s *Session) Route(req *ArrayResp, seq int64, multop string) {
 	//channel timeout ???
 	<-s.conCurrency
 
-	switch multop {
-	case "MSET":
-		go s.MSET(req, seq)
-	case "MGET":
-		go s.MGET(req, seq)
-	case "DEL":
-		go s.DEL(req, seq)
-	default:
-		go s.DefaultOP(req, seq)
-	}
+	go func() {
+		// 命令处理完之后回收请求，回复中不能引用请求的 []byte
+		defer Release(req)
+
+		switch multop {
+		case "MSET":
+			s.MSET(req, seq)
+		case "MGET":
+			s.MGET(req, seq)
+		case "SUMKEYS":
+			s.SumKeys(req, seq)
+		case "SETOP":
+			s.SetOp(req, seq)
+		case "ZSETOP":
+			s.ZSetOp(req, seq)
+		case "RENAME":
+			s.Rename(req, seq)
+		case "SCAN":
+			s.Scan(req, seq)
+		case "KEYSPACE":
+			s.Keyspace(req, seq)
+		case "EVAL":
+			s.Eval(req, seq)
+		case "SCRIPT":
+			s.Script(req, seq)
+		case "PUBLISH":
+			s.Publish(req, seq)
+		case "BLOCKING":
+			s.Blocking(req, seq)
+		default:
+			s.DefaultOP(req, seq)
+		}
+	}()
 }
 
 func (s *Session) DefaultOP(req *ArrayResp, seq int64) {
 	defer func() {
 		s.conCurrency <- 1
 	}()
-	resp, err := s.ExecWithRedirect(req, true)
+	resp, err := s.execWithRedirect(req, true, s.p.pc.streamThreshold)
 	if err != nil {
 		errinfo := fmt.Errorf("proxy internal error %s", err.Error())
 		s.resps <- WrappedErrorResp([]byte(errinfo.Error()), seq)
 		return
 	}
-	s.resps <- WrappedResp(resp, seq)
+	s.resps <- WrappedResp(s.resp3Reply(req, resp), seq)
 }
 
+// RESP3 客户端按 resp3Replies 转换回复，RESP2 原样返回
+func (s *Session) resp3Reply(req *ArrayResp, resp Resp) Resp {
+	if atomic.LoadInt32(&s.proto) != 3 {
+		return resp
+	}
+
+	var kind string
+	if ci := commandOf(req); ci != nil {
+		kind = resp3Replies[ci.Name]
+	}
+	if kind == Reply3ScorePairs && !bytes.EqualFold(req.Arg(req.Length()), WITHSCORES) {
+		kind = ""
+	}
+	return ToRESP3(resp, kind)
+}
+
+// WriteLoop 按 seq 顺序把回复写给客户端
+// 回复只写入 s.w 的缓冲区，在 resps 队列为空、缓冲超过 flushBytes
+// 或者第一个未发送的回复等待超过 flushDelay 时才 Flush，pipeline 的回复合并发送
 func (s *Session) WriteLoop() {
+	var pending time.Time // 第一个未 Flush 回复的写入时间
 	for {
+		var r *wrappedResp
 		select {
-		case r := <-s.resps:
-			// log.Info("WriteLoop Read Response ", r.resp.String(), r.seq)
-			// req and resp sequence must equal, thus we can ensure pipeline seq
-			resp := r.resp
-			if r.seq > s.respSequence {
-				// log.Warningf("WriteLoop receive resp unorder %d expected %d", r.seq, s.respSequence)
-				s.ooo[r.seq] = r.resp
-				// we will find r.respSequence in s.ooo
-				var ok bool
-				resp, ok = s.ooo[s.respSequence]
-				if !ok {
-					// can't find, and wait again
-					// TODO:: we can't wait forever, may timeout after 1 second or p.pc.conCurrency-1 ???
-					// currently just p.pc.conCurrency-1 seq
-					if r.seq-s.respSequence < int64(s.p.pc.conCurrency-1) {
-						continue
-					}
-					// log.Warningf("WriteLoop receive resp unorder for %d, we send ERROR instead", s.p.pc.conCurrency-1)
-					er := &ErrorResp{}
-					er.Rtype = ErrorType
-					er.Args = append(er.Args, []byte("proxy internal error pipeline unorder"))
-					resp = er
-				}
+		case r = <-s.resps:
+		default:
+			// 队列已经空了，把缓冲的回复发出去再阻塞等待
+			if s.w.Buffered() > 0 {
+				s.flush()
 			}
-
-			// we already discard r.seq response
-			if r.seq < s.respSequence {
-				log.Warningf("WriteLoop receive %d < %d just discard resp:%s", r.seq, s.respSequence, r.resp.String())
-				continue
+			select {
+			case r = <-s.resps:
+			case <-s.quitChan:
+				goto quit
 			}
-			atomic.AddInt64(&s.respSequence, 1)
+		}
 
-			err := WriteProtocol(s.w, resp)
-			if err != nil {
+		// 订阅推送的消息之前的回复都已经写完，直接写入缓冲
+		if r.seq == pushSeq {
+			if s.w.Buffered() == 0 {
+				pending = time.Now()
+			}
+			if err := r.resp.Encode(s.w); err != nil {
 				log.Warning("WriteLoop WriteProtocol err ", err.Error())
 			}
-		case <-s.quitChan:
-			goto quit
+			Release(r.resp)
+			if s.w.Buffered() >= s.p.pc.flushBytes || time.Since(pending) >= s.p.pc.flushDelay {
+				s.flush()
+			}
+			continue
+		}
+
+		// req and resp sequence must equal, thus we can ensure pipeline seq
+		// we already discard r.seq response
+		if r.seq < s.respSequence {
+			log.Warningf("WriteLoop receive %d < %d just discard resp:%s", r.seq, s.respSequence, r.resp.String())
+			if sb := streamOf(r.resp); sb != nil {
+				sb.Abort()
+			}
+			Release(r.resp)
+			continue
+		}
+		s.ooo[r.seq] = r.resp
+
+		// out-of-order 缓存不能无限增长，等待太久的 seq 用错误代替
+		if _, ok := s.ooo[s.respSequence]; !ok && len(s.ooo) > s.p.pc.pipeLength {
+			log.Warningf("WriteLoop wait %d too long, we send ERROR instead", s.respSequence)
+			s.ooo[s.respSequence] = NewErrorResp([]byte("proxy internal error pipeline unorder"))
+		}
+
+		// 把已经就绪的连续回复全部写入缓冲
+		for {
+			resp, ok := s.ooo[s.respSequence]
+			if !ok {
+				break
+			}
+			delete(s.ooo, s.respSequence)
+			written := atomic.AddInt64(&s.respSequence, 1) - 1
+
+			if s.w.Buffered() == 0 {
+				pending = time.Now()
+			}
+			// 订阅命令的回复以推送消息发送，seq 只占位
+			if resp != nil {
+				err := resp.Encode(s.w)
+				if err != nil {
+					log.Warning("WriteLoop WriteProtocol err ", err.Error())
+				}
+				// 已经写入缓冲区，回收回复
+				Release(resp)
+			}
+			if written == atomic.LoadInt64(&s.quitSequence) {
+				s.flush()
+				s.Close()
+				goto quit
+			}
+		}
+
+		if s.w.Buffered() >= s.p.pc.flushBytes || (s.w.Buffered() > 0 && time.Since(pending) >= s.p.pc.flushDelay) {
+			s.flush()
 		}
 	}
 quit:
+	s.abortStreams()
 	log.Warning("quit WriteLoop")
 }
 
+func (s *Session) flush() {
+	err := s.w.Flush()
+	if err != nil {
+		log.Warning("WriteLoop Flush err ", err.Error())
+	}
+}
+
+// abortStreams 回收还没有写给客户端的流式回复占用的 RedisConn
+func (s *Session) abortStreams() {
+	for _, resp := range s.ooo {
+		if sb := streamOf(resp); sb != nil {
+			sb.Abort()
+		}
+	}
+	for {
+		select {
+		case r := <-s.resps:
+			if sb := streamOf(r.resp); sb != nil {
+				sb.Abort()
+			}
+		default:
+			return
+		}
+	}
+}
+
 func WrappedErrorResp(reason []byte, seq int64) *wrappedResp {
 	er := &ErrorResp{}
 	er.Rtype = ErrorType
@@ -311,7 +622,6 @@ func WrappedResp(r Resp, seq int64) *wrappedResp {
 
 // caller call 	defer s.p.cluster.PutConn(conn)
 func (s *Session) GetRedisConnByKey(key []byte, slave bool) (*RedisConn, error) {
-	//ensure req.Args[0].Args[1] is key
 	conn, err := s.p.cluster.GetConn(key, slave)
 	if err != nil {
 		return nil, err
@@ -326,7 +636,7 @@ func (s *Session) GetRedisConnByKey(key []byte, slave bool) (*RedisConn, error)
 }
 
 func (s *Session) GetRedisConnByID(id string) (*RedisConn, error) {
-	conn, err := s.p.cluster.pools[id].Get()
+	conn, err := s.p.cluster.GetConnByID(id)
 	if err != nil {
 		return nil, err
 	}
@@ -339,7 +649,7 @@ func (s *Session) GetRedisConnByID(id string) (*RedisConn, error) {
 	return rc, nil
 }
 
-//tp type: moved ask normal
+// tp type: moved ask normal
 func (s *Session) Redirect(tp string, req *ArrayResp, target string) Resp {
 	//reclaim RedisConn
 	rc, err := s.GetRedisConnByID(target)
@@ -350,25 +660,25 @@ func (s *Session) Redirect(tp string, req *ArrayResp, target string) Resp {
 		er.Args = append(er.Args, []byte("proxy internal error pool conn not RedisConn"))
 		return er
 	}
-	defer s.p.cluster.PutConn(rc)
 
+	var resp Resp
 	switch tp {
 	case "ASK":
-		//ask first sending a ASKING command
-		ar := &ArrayResp{}
-		ar.Rtype = ArrayType
-		br := &BulkResp{}
-		br.Rtype = BulkType
-		br.Args = [][]byte{[]byte("ASKING")}
-		ar.Args = append(ar.Args, br)
-		err = WriteProtocol(rc.w, ar)
+		//ask first sending a ASKING command, ASKING 和请求一起发送
+		var resps []Resp
+		resps, err = s.ExecPipeline(rc, []*ArrayResp{NewCommand(ASKING), req})
+		if err == nil {
+			resp = resps[1]
+		}
+	default:
+		resp, err = s.ExecOnce(rc, req)
 	}
-
-	var resp Resp
-	resp, err = s.ExecOnce(rc, req)
 	if err == nil {
+		s.p.cluster.PutConn(rc)
 		return resp
 	}
+	// 出错的连接中可能还有没读完的回复，不能放回连接池
+	s.p.cluster.RemoveConn(rc)
 
 	er := &ErrorResp{}
 	er.Rtype = ErrorType
@@ -377,22 +687,47 @@ func (s *Session) Redirect(tp string, req *ArrayResp, target string) Resp {
 }
 
 func (s *Session) ExecWithRedirect(req *ArrayResp, redirect bool) (Resp, error) {
-	//ensure req.Args[1].Args[0] is key
-	rc, err := s.GetRedisConnByKey(req.Args[1].Args[0], false)
+	return s.execWithRedirect(req, redirect, 0)
+}
+
+// stream 大于 0 时回复中的大 bulk 返回 StreamBulkResp，RedisConn 在 WriteLoop 拷贝完成后回收
+func (s *Session) execWithRedirect(req *ArrayResp, redirect bool, stream int) (Resp, error) {
+	// 按照命令表中的第一个 key 路由，slaveok 时只读命令发到从库
+	slave := false
+	if ci := commandOf(req); ci != nil && ci.IsRead() {
+		slave = s.p.pc.slaveOk
+	}
+	rc, err := s.GetRedisConnByKey(RouteKey(req), slave)
 	if err != nil {
 		log.Warning("ExecWithRedirect GetRedisConnByKey get conn failed ", err)
+		if sb := req.Stream(); sb != nil {
+			sb.Discard()
+		}
 		return nil, err
 	}
-	//reclaim RedisConn
-	defer s.p.cluster.PutConn(rc)
 
 	var resp Resp
-	resp, err = s.ExecOnce(rc, req)
+	resp, err = s.execOnce(rc, req, stream)
 	if err != nil {
 		log.Warning("Session forward ReadProtocol error ", err)
+		// 连接上可能残留半个请求或回复，不能放回连接池
+		s.p.cluster.RemoveConn(rc)
 		return nil, err
 	}
 
+	if sb := streamOf(resp); sb != nil {
+		sb.release = func(err error) {
+			if err != nil {
+				s.p.cluster.RemoveConn(rc)
+				return
+			}
+			s.p.cluster.PutConn(rc)
+		}
+		return resp, nil
+	}
+	//reclaim RedisConn
+	s.p.cluster.PutConn(rc)
+
 	er, ok := resp.(*ErrorResp)
 	if ok {
 		//-MOVED 15495 10.10.200.11:6481 redirect to target
@@ -400,10 +735,18 @@ func (s *Session) ExecWithRedirect(req *ArrayResp, redirect bool) (Resp, error)
 		//handle error response
 		e := strings.Fields(hack.String(er.Args[0]))
 		if len(e) == 3 && redirect {
+			// 流式转发的请求已经被读走，无法重发，让客户端重试
+			if req.Stream() != nil {
+				if e[0] == "MOVED" {
+					s.p.cluster.topo.Reload()
+				}
+				return NewErrorResp([]byte("TRYAGAIN streamed request redirected, please retry")), nil
+			}
+
 			switch e[0] {
 			case "MOVED":
 				//we need reload Slots Info
-				s.p.cluster.topo.reloadChan <- 1
+				s.p.cluster.topo.Reload()
 				resp = s.Redirect("MOVED", req, e[2])
 			case "ASK":
 				//need not reload Slots Info, wait Migrate Done
@@ -414,32 +757,64 @@ func (s *Session) ExecWithRedirect(req *ArrayResp, redirect bool) (Resp, error)
 	return resp, nil
 }
 
+// ExecPipeline 把多个请求写入缓冲后一次 Flush，再按顺序读取所有回复
+func (s *Session) ExecPipeline(c *RedisConn, reqs []*ArrayResp) ([]Resp, error) {
+	for _, req := range reqs {
+		err := req.Encode(c.w)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := c.w.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	resps := make([]Resp, 0, len(reqs))
+	for i := 0; i < len(reqs); i++ {
+		resp, err := ReadProtocol(c.r)
+		if err != nil {
+			return nil, err
+		}
+		resps = append(resps, resp)
+	}
+	return resps, nil
+}
+
 func (s *Session) ExecOnce(c *RedisConn, req *ArrayResp) (Resp, error) {
+	return s.execOnce(c, req, 0)
+}
+
+func (s *Session) execOnce(c *RedisConn, req *ArrayResp, stream int) (Resp, error) {
 	err := WriteProtocol(c.w, req)
 	if err != nil {
 		return nil, err
 	}
 
 	var resp Resp
-	resp, err = ReadProtocol(c.r)
+	resp, err = ReadProtocolPooled(c.r, nil, stream)
 	if err != nil {
 		return nil, err
 	}
 	return resp, nil
 }
 
-func (s *Session) Close() {
-	if s.closed {
-		return
-	}
+// CloseAfter 在 seq 对应的回复写给客户端之后关闭 Session
+// 必须在把回复放入 s.resps 之前调用
+func (s *Session) CloseAfter(seq int64) {
+	atomic.StoreInt64(&s.quitSequence, seq)
+}
 
-	s.closed = true
-	close(s.quitChan)
-	s.p.sm.Del(s.remote, s)
+// Close 可能同时被 ReadLoop、WriteLoop 和 CheckIdleLoop 调用
+func (s *Session) Close() {
+	s.closeOnce.Do(func() {
+		close(s.quitChan)
+		s.p.sm.Del(s.remote, s)
 
-	if s.c != nil {
-		s.c.Close()
-	}
+		if s.c != nil {
+			s.c.Close()
+		}
+	})
 }
 
 func (s *Session) Serve() {
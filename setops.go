@@ -0,0 +1,191 @@
+package archer
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dongzerun/archer/hack"
+	log "github.com/ngaut/logging"
+)
+
+// SetOp 处理跨 slot 的 SINTER SUNION SDIFF 和对应的 STORE 命令
+// 先用 SCARD 检查成员总数不超过 maxSetMembers，再从各个节点并发读取 SMEMBERS，在 proxy 中计算
+// STORE 命令把结果写到 destination 所在的节点
+func (s *Session) SetOp(req *ArrayResp, seq int64) {
+	defer func() {
+		s.conCurrency <- 1
+	}()
+
+	ci := commandOf(req)
+	op := strings.TrimSuffix(ci.Name, "STORE")
+	store := op != ci.Name
+	first := 1
+	if store {
+		first = 2
+	}
+	keys := make([][]byte, 0, len(req.Args)-first)
+	for i := first; i < len(req.Args); i++ {
+		keys = append(keys, req.Arg(i))
+	}
+	slave := !store && s.p.pc.slaveOk
+
+	if max := s.p.pc.maxSetMembers; max > 0 {
+		total, er := s.sumInts(perKey([]byte("SCARD"), keys), slave)
+		if er != nil {
+			s.resps <- WrappedResp(er, seq)
+			return
+		}
+		if total > int64(max) {
+			s.resps <- WrappedErrorResp([]byte(fmt.Sprintf("ERR %s on %d members exceeds maxsetmembers %d", ci.Name, total, max)), seq)
+			return
+		}
+	}
+
+	subs := perKey([]byte("SMEMBERS"), keys)
+	s.scatter(subs, slave)
+	if er := firstError(subs); er != nil {
+		s.resps <- WrappedResp(er, seq)
+		return
+	}
+	sets := make([][]Resp, len(subs))
+	for i, sub := range subs {
+		ar, ok := sub.resp.(*ArrayResp)
+		if !ok {
+			log.Warning("Session ", ci.Name, " wrong SMEMBERS reply ", sub.resp.String())
+			s.resps <- WrappedErrorResp([]byte("proxy internal "+ci.Name+" failed"), seq)
+			return
+		}
+		sets[i] = ar.Args
+	}
+	result := computeSetOp(op, sets)
+
+	if !store {
+		s.resps <- WrappedResp(s.resp3Reply(req, NewArrayResp(result...)), seq)
+		return
+	}
+	if er := s.storeSet(req.Arg(1), result); er != nil {
+		s.resps <- WrappedResp(er, seq)
+		return
+	}
+	s.resps <- WrappedResp(NewIntResp(len(result)), seq)
+}
+
+// computeSetOp 结果中成员的顺序和它在源集合中第一次出现的顺序一致
+func computeSetOp(op string, sets [][]Resp) []Resp {
+	member := func(r Resp) string {
+		if br, ok := r.(*BulkResp); ok && len(br.Args) > 0 {
+			return hack.String(br.Args[0])
+		}
+		return ""
+	}
+	index := func(set []Resp) map[string]bool {
+		m := make(map[string]bool, len(set))
+		for _, r := range set {
+			m[member(r)] = true
+		}
+		return m
+	}
+
+	var result []Resp
+	switch op {
+	case "SUNION":
+		seen := make(map[string]bool)
+		for _, set := range sets {
+			for _, r := range set {
+				if m := member(r); !seen[m] {
+					seen[m] = true
+					result = append(result, r)
+				}
+			}
+		}
+	case "SINTER", "SDIFF":
+		others := make([]map[string]bool, 0, len(sets)-1)
+		for _, set := range sets[1:] {
+			others = append(others, index(set))
+		}
+		for _, r := range sets[0] {
+			keep := true
+			for _, o := range others {
+				// SINTER 保留所有集合中都有的成员，SDIFF 保留其它集合中都没有的成员
+				if o[member(r)] != (op == "SINTER") {
+					keep = false
+					break
+				}
+			}
+			if keep {
+				result = append(result, r)
+			}
+		}
+	}
+	return result
+}
+
+// storeSet 用 DEL 和 SADD 覆盖 dest
+func (s *Session) storeSet(dest []byte, members []Resp) *ErrorResp {
+	var sadd *ArrayResp
+	if len(members) > 0 {
+		sadd = NewCommand([]byte("SADD"), dest)
+		sadd.Args = append(sadd.Args, members...)
+	}
+	return s.storeTx(dest, sadd)
+}
+
+// storeTx 在 dest 所在节点用 MULTI EXEC 执行 DEL 和 write，write 为 nil 时只删除 dest
+// 失败时 dest 保持原样，其它客户端也看不到删除之后还没有写入的中间状态
+// MOVED 时重新加载拓扑并在目标节点重试一次，slot 迁移中回复 ASK 时让客户端重试
+func (s *Session) storeTx(dest []byte, write *ArrayResp) *ErrorResp {
+	cmds := []*ArrayResp{NewCommand([]byte("DEL"), dest)}
+	if write != nil {
+		cmds = append(cmds, write)
+	}
+	id := s.p.cluster.topo.GetNodeID(dest, false)
+	er, moved := s.execTx(id, cmds)
+	if moved != "" {
+		s.p.cluster.topo.Reload()
+		er, _ = s.execTx(moved, cmds)
+	}
+	return er
+}
+
+// execTx 返回第一个错误，命令入队时回复 MOVED 同时返回重定向的目标
+func (s *Session) execTx(id string, cmds []*ArrayResp) (*ErrorResp, string) {
+	rc, err := s.GetRedisConnByID(id)
+	if err != nil {
+		return NewErrorResp([]byte("proxy internal error " + err.Error())), ""
+	}
+	reqs := append([]*ArrayResp{NewCommand([]byte("MULTI"))}, cmds...)
+	reqs = append(reqs, NewCommand([]byte("EXEC")))
+	resps, err := s.ExecPipeline(rc, reqs)
+	if err != nil {
+		log.Warning("Session store transaction failed ", id, err)
+		s.p.cluster.RemoveConn(rc)
+		return NewErrorResp([]byte("proxy internal error " + err.Error())), ""
+	}
+	s.p.cluster.PutConn(rc)
+
+	// 入队失败时 EXEC 回复 EXECABORT，返回入队时的错误
+	for _, resp := range resps[:len(resps)-1] {
+		er, ok := resp.(*ErrorResp)
+		if !ok {
+			continue
+		}
+		switch e := strings.Fields(hack.String(er.Args[0])); {
+		case len(e) == 3 && e[0] == "MOVED":
+			return er, e[2]
+		case len(e) == 3 && e[0] == "ASK":
+			return NewErrorResp([]byte("TRYAGAIN destination slot is migrating, please retry")), ""
+		}
+		return er, ""
+	}
+	switch exec := resps[len(resps)-1].(type) {
+	case *ErrorResp:
+		return exec, ""
+	case *ArrayResp:
+		for _, r := range exec.Args {
+			if er, ok := r.(*ErrorResp); ok {
+				return er, ""
+			}
+		}
+	}
+	return nil, ""
+}
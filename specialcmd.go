@@ -2,141 +2,236 @@ package archer
 
 import (
 	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
 
-	"github.com/dongzerun/archer/util"
+	"github.com/dongzerun/archer/hack"
 	log "github.com/ngaut/logging"
 )
 
+var (
+	ClientNameError  = []byte("ERR Client names cannot contain spaces, newlines or special characters.")
+	HelloNoAuthError = []byte("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+)
+
+// MGET 按 slot 拆分成多个 MGET，每个节点一个连接 pipeline 发送，结果按原始顺序合并
 func (s *Session) MGET(req *ArrayResp, seq int64) {
 	defer func() {
 		s.conCurrency <- 1
 	}()
-	var failed bool
-	mget := &ArrayResp{}
-	mget.Rtype = ArrayType
-	mget.Args = make([]*BulkResp, req.Length())
-	for i := 0; i < req.Length(); i++ {
-		ar := &ArrayResp{}
-		ar.Rtype = ArrayType
-		br := &BulkResp{}
-		br.Rtype = BulkType
-		br.Args = [][]byte{[]byte("GET")}
-		ar.Args = append(ar.Args, br)
-
-		br1 := &BulkResp{}
-		br1.Rtype = BulkType
-		br1.Args = [][]byte{req.Args[i+1].Args[0]}
-		ar.Args = append(ar.Args, br1)
-
-		resp, err := s.ExecWithRedirect(ar, true)
-		if err != nil {
-			log.Warning("Session MGET ExecWithRedirect wrong ", ar.String())
-			failed = true
-			break
-		}
-		br, ok := resp.(*BulkResp)
-		if !ok {
-			log.Warning("Session MGET ExecWithRedirect  wrong must get BulkResp")
-			failed = true
-			break
-		}
-		mget.Args[i] = br
-	}
 
-	if failed {
-		s.resps <- WrappedErrorResp([]byte("proxy internal MGET failed"), seq)
+	subs := splitBySlot(req, []byte("MGET"), 1, 1)
+	s.scatter(subs, s.p.pc.slaveOk)
+	if er := firstError(subs); er != nil {
+		log.Warning("Session MGET sub request failed ", string(er.Args[0]))
+		s.resps <- WrappedResp(er, seq)
 		return
 	}
-	s.resps <- WrappedResp(mget, seq)
+
+	mget := NewArrayResp()
+	mget.Args = make([]Resp, req.Length())
+	for _, sub := range subs {
+		ar, ok := sub.resp.(*ArrayResp)
+		if !ok || len(ar.Args) != len(sub.keys) {
+			log.Warning("Session MGET wrong reply ", sub.resp.String())
+			s.resps <- WrappedErrorResp([]byte("proxy internal MGET failed"), seq)
+			return
+		}
+		for i, k := range sub.keys {
+			mget.Args[k] = ar.Args[i]
+		}
+	}
+	s.resps <- WrappedResp(s.resp3Reply(req, mget), seq)
 }
 
+// MSET 按 slot 拆分成多个 MSET 并发执行，MSET 本身不是原子的，部分失败时按 msetPolicy 处理
 func (s *Session) MSET(req *ArrayResp, seq int64) {
 	defer func() {
 		s.conCurrency <- 1
 	}()
 
 	if req.Length()%2 != 0 {
-		s.resps <- WrappedErrorResp([]byte("MSET args count must Even"), seq)
+		s.resps <- WrappedErrorResp([]byte("ERR wrong number of arguments for 'mset' command"), seq)
 		return
 	}
 
-	var failed bool
-	for i := 0; i < req.Length(); i += 2 {
-		ar := &ArrayResp{}
-		ar.Rtype = ArrayType
-		br := &BulkResp{}
-		br.Rtype = BulkType
-		br.Args = [][]byte{[]byte("SET")}
-		ar.Args = append(ar.Args, br)
-
-		br1 := &BulkResp{}
-		br1.Rtype = BulkType
-		br1.Args = [][]byte{req.Args[i+1].Args[0]}
-		ar.Args = append(ar.Args, br1)
-
-		br2 := &BulkResp{}
-		br2.Rtype = BulkType
-		br2.Args = [][]byte{req.Args[i+2].Args[0]}
-		ar.Args = append(ar.Args, br2)
+	subs := splitBySlot(req, []byte("MSET"), 1, 2)
+	s.scatter(subs, false)
 
-		resp, err := s.ExecWithRedirect(ar, true)
-		if err != nil {
-			log.Warning("Session MSET ExecWithRedirect wrong ", ar.String())
-			failed = true
-			break
+	var failed [][]byte
+	for _, sub := range subs {
+		if sr, ok := sub.resp.(*SimpleResp); ok && bytes.Equal(sr.Args[0], OK) {
+			continue
 		}
-		_, ok := resp.(*SimpleResp)
-		if !ok {
-			log.Warning("Session MSET ExecWithRedirect  wrong must get SimpleResp ")
-			failed = true
-			break
+		log.Warning("Session MSET sub request failed ", sub.resp.String())
+		for i := 1; i < len(sub.req.Args); i += 2 {
+			failed = append(failed, sub.req.Arg(i))
 		}
 	}
-
-	if failed {
-		s.resps <- WrappedErrorResp([]byte("MGET partitial failed"), seq)
+	if len(failed) > 0 && s.p.pc.msetPolicy != MSetBestEffort {
+		s.resps <- WrappedErrorResp(msetFailedError(failed, req.Length()/2), seq)
 		return
 	}
 	s.resps <- WrappedOKResp(seq)
 }
 
-func (s *Session) DEL(req *ArrayResp, seq int64) {
+// msetFailedError 列出没有写入的 key，最多 10 个
+func msetFailedError(failed [][]byte, total int) []byte {
+	b := []byte(fmt.Sprintf("ERR MSET partially failed, %d of %d keys not set:", len(failed), total))
+	for i, k := range failed {
+		if i == 10 {
+			b = append(b, " ..."...)
+			break
+		}
+		b = append(b, ' ')
+		b = append(b, k...)
+	}
+	return b
+}
+
+// SumKeys 处理回复整数的多 key 命令 DEL UNLINK EXISTS TOUCH
+// 按 slot 拆分之后并发执行，回复是所有子请求的和，任何一个子请求失败都回复错误
+func (s *Session) SumKeys(req *ArrayResp, seq int64) {
 	defer func() {
 		s.conCurrency <- 1
 	}()
 
-	var del int
-	for i := 0; i < req.Length(); i++ {
-		ar := &ArrayResp{}
-		ar.Rtype = ArrayType
-		br := &BulkResp{}
-		br.Rtype = BulkType
-		br.Args = [][]byte{[]byte("DEL")}
-		ar.Args = append(ar.Args, br)
-
-		br1 := &BulkResp{}
-		br1.Rtype = BulkType
-		br1.Args = [][]byte{req.Args[i+1].Args[0]}
-		ar.Args = append(ar.Args, br1)
-
-		resp, err := s.ExecWithRedirect(ar, true)
+	ci := commandOf(req)
+	sum, er := s.sumInts(splitBySlot(req, []byte(ci.Name), 1, 1), ci.IsRead() && s.p.pc.slaveOk)
+	if er != nil {
+		log.Warning("Session ", ci.Name, " sub request failed ", string(er.Args[0]))
+		s.resps <- WrappedResp(er, seq)
+		return
+	}
+	s.resps <- WrappedResp(NewIntResp(int(sum)), seq)
+}
+
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+// 协议版本是 Session 级别的，后端连接始终使用 RESP2
+func (s *Session) Hello(req *ArrayResp) Resp {
+	proto := int(atomic.LoadInt32(&s.proto))
+	if req.Length() >= 1 {
+		v, err := strconv.Atoi(hack.String(req.Arg(1)))
 		if err != nil {
-			log.Warning("Session DEL ExecWithRedirect wrong ", ar.String())
-			continue
+			return NewErrorResp([]byte("ERR Protocol version is not an integer or out of range"))
 		}
-		ir, ok := resp.(*IntResp)
-		if !ok {
-			log.Warning("Session DEL ExecWithRedirect  wrong must get IntResp")
-			continue
+		if v != 2 && v != 3 {
+			return NewErrorResp([]byte("NOPROTO unsupported protocol version"))
 		}
-		log.Info("DEL resp ", ir.Rtype, string(ir.Args[0]))
-		if bytes.Equal(ir.Args[0], []byte("1")) {
-			del += 1
+		proto = v
+	}
+
+	var (
+		name []byte
+		user *User
+	)
+	for i := 2; i <= req.Length(); i++ {
+		switch strings.ToUpper(hack.String(req.Arg(i))) {
+		case "AUTH":
+			if i+2 > req.Length() {
+				return NewErrorResp([]byte("ERR Syntax error in HELLO option 'AUTH'"))
+			}
+			u, err := s.p.acl.Authenticate(req.Arg(i+1), req.Arg(i+2))
+			if err != nil {
+				return NewErrorResp([]byte(err.Error()))
+			}
+			user = u
+			i += 2
+		case "SETNAME":
+			if i+1 > req.Length() {
+				return NewErrorResp([]byte("ERR Syntax error in HELLO option 'SETNAME'"))
+			}
+			i++
+			name = req.Arg(i)
+			if !validClientName(name) {
+				return NewErrorResp(ClientNameError)
+			}
+		default:
+			return NewErrorResp([]byte("ERR Syntax error in HELLO option '" + hack.String(req.Arg(i)) + "'"))
+		}
+	}
+
+	if user != nil {
+		s.user = user
+	}
+	if s.user == nil {
+		return NewErrorResp(HelloNoAuthError)
+	}
+
+	atomic.StoreInt32(&s.proto, int32(proto))
+	if name != nil {
+		s.name = string(name)
+	}
+
+	info := []Resp{
+		NewBulkResp([]byte("server")), NewBulkResp([]byte("archer")),
+		NewBulkResp([]byte("version")), NewBulkResp([]byte(Version)),
+		NewBulkResp([]byte("proto")), NewIntResp(proto),
+		NewBulkResp([]byte("mode")), NewBulkResp([]byte("cluster")),
+		NewBulkResp([]byte("role")), NewBulkResp([]byte("master")),
+		NewBulkResp([]byte("modules")), NewArrayResp(),
+	}
+	if proto == 3 {
+		return NewMapResp(info...)
+	}
+	return NewArrayResp(info...)
+}
+
+// AUTH [username] password，认证失败不影响之前的认证状态
+func (s *Session) Auth(req *ArrayResp) Resp {
+	var (
+		user *User
+		err  error
+	)
+	switch req.Length() {
+	case 1:
+		if s.p.acl.NoAuthUser() != nil {
+			return NewErrorResp([]byte(NoPassError.Error()))
+		}
+		user, err = s.p.acl.Authenticate([]byte(DefaultUser), req.Arg(1))
+	case 2:
+		user, err = s.p.acl.Authenticate(req.Arg(1), req.Arg(2))
+	default:
+		return NewErrorResp([]byte("ERR syntax error"))
+	}
+	if err != nil {
+		return NewErrorResp([]byte(err.Error()))
+	}
+	s.user = user
+	return NewSimpleResp(OK)
+}
+
+// CLIENT SETNAME|GETNAME 由 proxy 处理，名字保存在 Session 中，不发给后端
+// 其它子命令由 Filter 拒绝
+func (s *Session) Client(req *ArrayResp) Resp {
+	switch strings.ToUpper(hack.String(req.Arg(1))) {
+	case "SETNAME":
+		if req.Length() != 2 {
+			return NewErrorResp([]byte("ERR wrong number of arguments for 'client|setname' command"))
+		}
+		if !validClientName(req.Arg(2)) {
+			return NewErrorResp(ClientNameError)
+		}
+		// 请求会被回收，必须拷贝
+		s.name = string(req.Arg(2))
+		return NewSimpleResp(OK)
+	case "GETNAME":
+		if s.name == "" {
+			return NewBulkResp(nil)
+		}
+		return NewBulkResp([]byte(s.name))
+	}
+	return NewErrorResp([]byte("ERR unsupported CLIENT subcommand '" + hack.String(req.Arg(1)) + "'"))
+}
+
+// 和 Redis 一样，名字不能包含空格、换行等特殊字符
+func validClientName(name []byte) bool {
+	for _, b := range name {
+		if b < '!' || b > '~' {
+			return false
 		}
 	}
-	r := &IntResp{}
-	r.Rtype = IntType
-	r.Args = append(r.Args, util.Iu32tob2(del))
-	s.resps <- WrappedResp(r, seq)
-	return
+	return true
 }
@@ -0,0 +1,198 @@
+package archer
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"sync"
+
+	"github.com/dongzerun/archer/util"
+)
+
+var (
+	_ Resp = (*StreamBulkResp)(nil)
+
+	StreamType = "stream"
+
+	StreamAbortError = errors.New("stream bulk aborted")
+)
+
+// StreamBulkResp 是超过 streamthreshold 的大 bulk，解析时只读了 $len\r\n 头部
+// payload 还留在 src 中，Encode 时直接从 src 拷贝到目标 writer，不在内存中保存
+// 后端回复 src 是 RedisConn.r，拷贝完成后通过 release 回收连接
+// 客户端请求 src 是 Session.r，拷贝完成前 ReadLoop 不能继续读取
+type StreamBulkResp struct {
+	BaseResp
+	Len int
+
+	src  *bufio.Reader
+	once sync.Once
+	err  error
+	done chan struct{}
+
+	// payload 消费完之后调用，err 不为空说明 src 已经无法同步
+	release func(err error)
+}
+
+func newStreamBulkResp(src *bufio.Reader, l int) *StreamBulkResp {
+	sb := &StreamBulkResp{
+		Len:  l,
+		src:  src,
+		done: make(chan struct{}),
+	}
+	sb.Rtype = StreamType
+	return sb
+}
+
+func (sb *StreamBulkResp) String() string {
+	return "$" + strconv.Itoa(sb.Len) + " stream"
+}
+
+// Encode 写入头部，然后把 payload 从 src 拷贝到 w
+func (sb *StreamBulkResp) Encode(w *bufio.Writer) error {
+	return sb.writeTo(w)
+}
+
+// encode 只在嵌套到其它 Resp 中序列化时使用，payload 会被读到 b 中
+func (sb *StreamBulkResp) encode(b *bytes.Buffer) {
+	b.WriteByte(BulkSep)
+	util.WriteLength(b, sb.Len)
+	b.Write(CRLF)
+	_, err := io.CopyN(b, sb.src, int64(sb.Len+2))
+	sb.finish(err)
+}
+
+func (sb *StreamBulkResp) writeTo(w *bufio.Writer) error {
+	w.WriteByte(BulkSep)
+	w.WriteString(strconv.Itoa(sb.Len))
+	w.Write(CRLF)
+	_, err := io.CopyN(w, sb.src, int64(sb.Len+2))
+	sb.finish(err)
+	return err
+}
+
+// Materialize 把 payload 读到内存，转换成普通的 BulkResp
+func (sb *StreamBulkResp) Materialize() (*BulkResp, error) {
+	buf := make([]byte, sb.Len+2)
+	_, err := io.ReadFull(sb.src, buf)
+	sb.finish(err)
+	if err != nil {
+		return nil, err
+	}
+	return NewBulkResp(buf[:sb.Len]), nil
+}
+
+// Discard 读取并丢弃 payload，保证 src 可以继续读取下一个请求
+func (sb *StreamBulkResp) Discard() {
+	_, err := io.CopyN(ioutil.Discard, sb.src, int64(sb.Len+2))
+	sb.finish(err)
+}
+
+// Abort 不读取 payload，src 已经无法同步，只能关闭
+func (sb *StreamBulkResp) Abort() {
+	sb.finish(StreamAbortError)
+}
+
+// Done payload 被消费之后关闭
+func (sb *StreamBulkResp) Done() <-chan struct{} {
+	return sb.done
+}
+
+func (sb *StreamBulkResp) Err() error {
+	return sb.err
+}
+
+// consumed payload 已经被转发、读取或者丢弃
+func (sb *StreamBulkResp) consumed() bool {
+	select {
+	case <-sb.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (sb *StreamBulkResp) finish(err error) {
+	sb.once.Do(func() {
+		sb.err = err
+		if sb.release != nil {
+			sb.release(err)
+		}
+		close(sb.done)
+	})
+}
+
+// streamOf 返回回复中流式读取的 bulk，没有返回 nil
+func streamOf(r Resp) *StreamBulkResp {
+	switch v := r.(type) {
+	case *StreamBulkResp:
+		return v
+	case *ArrayResp:
+		return v.Stream()
+	}
+	return nil
+}
+
+// Stream 返回命令中流式读取的最后一个参数，没有返回 nil
+func (ar *ArrayResp) Stream() *StreamBulkResp {
+	if len(ar.Args) == 0 {
+		return nil
+	}
+	sb, _ := ar.Args[len(ar.Args)-1].(*StreamBulkResp)
+	return sb
+}
+
+// Materialize 把流式参数读到内存，用于需要完整参数的命令
+func (ar *ArrayResp) Materialize() error {
+	sb := ar.Stream()
+	if sb == nil {
+		return nil
+	}
+	br, err := sb.Materialize()
+	if err != nil {
+		return err
+	}
+	ar.Args[len(ar.Args)-1] = br
+	return nil
+}
+
+// materializeKeys 流式参数在 key 的位置时读到内存，计算 slot 需要完整的 key
+func (ar *ArrayResp) materializeKeys(ci *CommandInfo) error {
+	if ar.Stream() == nil || ci == nil {
+		return nil
+	}
+	idx, err := ci.KeyIndexes(ar)
+	if err != nil {
+		return nil
+	}
+	for _, i := range idx {
+		if i == len(ar.Args)-1 {
+			return ar.Materialize()
+		}
+	}
+	return nil
+}
+
+// encodeStream 先写入前面的参数，再从 src 拷贝最后一个参数
+func (ar *ArrayResp) encodeStream(w *bufio.Writer, sb *StreamBulkResp) error {
+	b := bPool.Get().(*bytes.Buffer)
+	b.Reset()
+	defer bPool.Put(b)
+	b.WriteByte(ArrSep)
+	util.WriteLength(b, len(ar.Args))
+	b.Write(CRLF)
+	for _, arg := range ar.Args[:len(ar.Args)-1] {
+		arg.encode(b)
+	}
+
+	_, err := w.Write(b.Bytes())
+	if err != nil {
+		// payload 还没开始读，丢弃之后 src 还能继续使用
+		sb.Discard()
+		return err
+	}
+	return sb.writeTo(w)
+}
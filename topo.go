@@ -4,8 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
-	"strconv"
-	"strings"
+	"sort"
 	"sync"
 	"time"
 
@@ -18,12 +17,13 @@ func init() {
 }
 
 type Node struct {
-	id        string // host:port
-	host      string
-	port      int
-	role      string
-	serveSlot *SlotRange // 0-16384
-	slaveOf   string
+	id         string // host:port
+	name       string // cluster node id
+	host       string
+	port       int
+	role       string
+	serveSlots []*SlotRange // 0-16384
+	slaveOf    string       // master 的 name
 }
 
 type SlotRange struct {
@@ -51,7 +51,7 @@ func NewTopo(pc *ProxyConfig) *Topology {
 	t := &Topology{
 		conf:       pc,
 		reloadChan: make(chan int, 1),
-		slots:      make([]*Slot, 1),
+		slots:      make([]*Slot, 16384),
 	}
 
 	t.reloadSlots()
@@ -72,10 +72,18 @@ func (t *Topology) ReloadLoop() {
 
 }
 
+// Reload 通知 ReloadLoop 重新加载，已经有待处理的通知时直接返回
+func (t *Topology) Reload() {
+	select {
+	case t.reloadChan <- 1:
+	default:
+	}
+}
+
 func (t *Topology) reloadSlots() {
 	ss, err := t.getSlots()
 	if err != nil {
-		log.Warningf("ReloadLoop failed ", err)
+		log.Warning("ReloadLoop failed ", err)
 		return
 	}
 
@@ -87,62 +95,64 @@ func (t *Topology) reloadSlots() {
 // 从配置中随机挑选一个节点，调用 cluster nodes 命令获取slot信息
 // 失败的话应该有重试，并且将失败的节点踢出掉
 func (t *Topology) getSlots() ([]*Slot, error) {
-	var nodes []*Node
+	var (
+		nodes []*Node
+		err   error
+	)
 	for i := 0; i < 3; i++ {
+		if len(t.conf.nodes) == 0 {
+			return nil, errors.New("loadSlots no available nodes")
+		}
 		idx := rand.Intn(len(t.conf.nodes))
 
-		url := strings.Split(t.conf.nodes[idx], ":")
-		if len(url) != 2 {
-			return nil, errors.New("loadSlots read nodes failed")
-		}
 		var (
-			err  error
+			host string
 			port int
 		)
-		port, err = strconv.Atoi(url[1])
+		host, port, err = splitAddr(t.conf.nodes[idx])
 		if err != nil {
-			return nil, fmt.Errorf("Topology getSlots port failed %s ", err.Error())
+			return nil, fmt.Errorf("Topology getSlots node %s failed %s ", t.conf.nodes[idx], err.Error())
 		}
-		nodes, err = GetClusterNodes(url[0], port)
+		nodes, err = GetClusterNodes(host, port, t.conf)
 		if err == nil {
 			break
 		}
 
 		log.Warningf("getSlots failed, kick off url %s for reason %s", t.conf.nodes[idx], err.Error())
-		t.conf.kickOff = append(t.conf.kickOff, t.conf.nodes[idx])
-		if idx == 0 {
-			t.conf.nodes = t.conf.nodes[1:]
-		} else if idx == len(t.conf.nodes)-1 {
-			t.conf.nodes = t.conf.nodes[:len(t.conf.nodes)-2]
-		} else {
-			t.conf.nodes = append(t.conf.nodes[:idx-1], t.conf.nodes[idx+1:]...)
+		// 至少保留一个节点，避免全部踢掉之后无法恢复
+		if len(t.conf.nodes) > 1 {
+			t.conf.kickOff = append(t.conf.kickOff, t.conf.nodes[idx])
+			t.conf.nodes = append(t.conf.nodes[:idx:idx], t.conf.nodes[idx+1:]...)
 		}
-
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	slots := make([]*Slot, 16384)
-	slaves := make([]*Node, 0)
+	masters := make(map[string][]*Slot)
 
 	// range master node
 	for _, n := range nodes {
-		s := &Slot{}
-		for i := n.serveSlot.start; i <= n.serveSlot.stop; i++ {
-			s.id = i
-			if n.role == "master" {
-				s.master = n
+		if n.role != "master" {
+			continue
+		}
+		for _, r := range n.serveSlots {
+			for i := r.start; i <= r.stop; i++ {
+				s := &Slot{id: i, master: n}
 				slots[i] = s
-			} else {
-				slaves = append(slaves, n)
+				masters[n.name] = append(masters[n.name], s)
 			}
 		}
 	}
 
 	// range slave nodes
-	for _, n := range slaves {
-		for _, s := range slots {
-			if n.slaveOf == s.master.id {
-				s.slaves = append(s.slaves, n)
-			}
+	for _, n := range nodes {
+		if n.role != "slave" {
+			continue
+		}
+		for _, s := range masters[n.slaveOf] {
+			s.slaves = append(s.slaves, n)
 		}
 	}
 
@@ -152,7 +162,13 @@ func (t *Topology) getSlots() ([]*Slot, error) {
 func (t *Topology) GetNodeID(key []byte, slave bool) string {
 	id := util.Crc16sum(key) % 16384
 
+	t.rw.RLock()
 	s := t.slots[id]
+	t.rw.RUnlock()
+
+	if s == nil {
+		return ""
+	}
 
 	if !slave && s.master != nil {
 		return s.master.id
@@ -164,11 +180,38 @@ func (t *Topology) GetNodeID(key []byte, slave bool) string {
 		return s.slaves[0].id
 	}
 
+	// 没有从库时读主库
+	if s.master != nil {
+		return s.master.id
+	}
 	return ""
 }
 
+// Masters 返回所有负责 slot 的主库，按 id 排序，拓扑不变时顺序不变
+func (t *Topology) Masters() []*Node {
+	t.rw.RLock()
+	seen := make(map[string]bool)
+	var masters []*Node
+	for _, s := range t.slots {
+		if s == nil || s.master == nil || seen[s.master.id] {
+			continue
+		}
+		seen[s.master.id] = true
+		masters = append(masters, s.master)
+	}
+	t.rw.RUnlock()
+
+	sort.Slice(masters, func(i, j int) bool { return masters[i].id < masters[j].id })
+	return masters
+}
+
 func (t *Topology) GetNode(id string) *Node {
+	t.rw.RLock()
+	defer t.rw.RUnlock()
 	for _, s := range t.slots {
+		if s == nil {
+			continue
+		}
 		if s.master != nil && s.master.id == id {
 			return s.master
 		}
@@ -181,6 +224,6 @@ func (t *Topology) GetNode(id string) *Node {
 	}
 
 	log.Warning("Topology GetNode Empty, Notify to Reload Topology ")
-	t.reloadChan <- 1
+	t.Reload()
 	return nil
 }
@@ -21,3 +21,70 @@ func Benchmark_Iu32tob2(b *testing.B) {
 		Iu32tob2(i)
 	}
 }
+
+func TestSplitArgs(t *testing.T) {
+	cases := []struct {
+		line string
+		args []string
+	}{
+		{"", nil},
+		{"   ", nil},
+		{"PING", []string{"PING"}},
+		{"set  foo bar ", []string{"set", "foo", "bar"}},
+		{`set foo "hello world"`, []string{"set", "foo", "hello world"}},
+		{`set foo "a\nb\x41\"c"`, []string{"set", "foo", "a\nbA\"c"}},
+		{`set foo 'it\'s'`, []string{"set", "foo", "it's"}},
+		{`set foo ""`, []string{"set", "foo", ""}},
+	}
+	for _, c := range cases {
+		args, err := SplitArgs([]byte(c.line))
+		if err != nil {
+			t.Fatalf("SplitArgs %q failed %s", c.line, err)
+		}
+		if len(args) != len(c.args) {
+			t.Fatalf("SplitArgs %q got %q", c.line, args)
+		}
+		for i := range args {
+			if string(args[i]) != c.args[i] {
+				t.Fatalf("SplitArgs %q got %q", c.line, args)
+			}
+		}
+	}
+
+	for _, line := range []string{`set foo "bar`, `set foo 'bar`, `set foo "bar"baz`} {
+		if _, err := SplitArgs([]byte(line)); err == nil {
+			t.Fatalf("SplitArgs %q must fail", line)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		pattern, str string
+		match        bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "users:1", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[b-a]llo", "hallo", true},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+		{"{app}:*", "{app}:1", true},
+		{"a[bc", "ab", true},
+	}
+	for _, c := range cases {
+		if got := Match([]byte(c.pattern), []byte(c.str)); got != c.match {
+			t.Fatalf("Match(%q, %q) got %v", c.pattern, c.str, got)
+		}
+	}
+}
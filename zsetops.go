@@ -0,0 +1,282 @@
+package archer
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dongzerun/archer/hack"
+	log "github.com/ngaut/logging"
+)
+
+var (
+	WeightNotFloatError = errors.New("ERR weight value is not a float")
+	SyntaxError         = errors.New("ERR syntax error")
+)
+
+// zsetOp 是解析之后的 ZUNION ZINTER ZDIFF 和对应的 STORE 命令
+type zsetOp struct {
+	op         string // ZUNION ZINTER ZDIFF
+	dest       []byte // STORE 命令的 destination
+	keys       [][]byte
+	weights    []float64
+	aggregate  string // SUM MIN MAX
+	withScores bool
+}
+
+// parseZSetOp 解析 [destination] numkeys key [key ...] [WEIGHTS weight ...] [AGGREGATE SUM|MIN|MAX] [WITHSCORES]
+func parseZSetOp(req *ArrayResp) (*zsetOp, error) {
+	name := commandOf(req).Name
+	z := &zsetOp{op: strings.TrimSuffix(name, "STORE"), aggregate: "SUM"}
+	store := z.op != name
+
+	i := 1
+	if store {
+		z.dest = req.Arg(1)
+		i = 2
+	}
+	numkeys, err := strconv.Atoi(hack.String(req.Arg(i)))
+	if err != nil || numkeys < 0 || i+numkeys >= len(req.Args) {
+		return nil, SyntaxError
+	}
+	if numkeys == 0 {
+		return nil, fmt.Errorf("ERR at least 1 input key is needed for '%s' command", strings.ToLower(name))
+	}
+	for j := 0; j < numkeys; j++ {
+		z.keys = append(z.keys, req.Arg(i+1+j))
+		z.weights = append(z.weights, 1)
+	}
+
+	for i += numkeys + 1; i < len(req.Args); i++ {
+		switch opt := strings.ToUpper(hack.String(req.Arg(i))); {
+		case opt == "WEIGHTS" && z.op != "ZDIFF" && i+numkeys < len(req.Args):
+			for j := 0; j < numkeys; j++ {
+				w, err := strconv.ParseFloat(hack.String(req.Arg(i+1+j)), 64)
+				if err != nil || math.IsNaN(w) {
+					return nil, WeightNotFloatError
+				}
+				z.weights[j] = w
+			}
+			i += numkeys
+		case opt == "AGGREGATE" && z.op != "ZDIFF" && i+1 < len(req.Args):
+			i++
+			z.aggregate = strings.ToUpper(hack.String(req.Arg(i)))
+			if z.aggregate != "SUM" && z.aggregate != "MIN" && z.aggregate != "MAX" {
+				return nil, SyntaxError
+			}
+		case opt == "WITHSCORES" && !store:
+			z.withScores = true
+		default:
+			return nil, SyntaxError
+		}
+	}
+	return z, nil
+}
+
+// combine 和 Redis 一样，inf 和 -inf 相加得到 0
+func (z *zsetOp) combine(a, b float64) float64 {
+	switch z.aggregate {
+	case "MIN":
+		return math.Min(a, b)
+	case "MAX":
+		return math.Max(a, b)
+	}
+	if s := a + b; !math.IsNaN(s) {
+		return s
+	}
+	return 0
+}
+
+// weighted inf 乘以 0 得到 0
+func weighted(score, w float64) float64 {
+	if s := score * w; !math.IsNaN(s) {
+		return s
+	}
+	return 0
+}
+
+// compute sets 是每个 key 的成员和分数，结果按分数和成员排序
+func (z *zsetOp) compute(sets []map[string]float64) ([]string, map[string]float64) {
+	result := make(map[string]float64)
+	for m, score := range sets[0] {
+		if z.op == "ZDIFF" {
+			result[m] = score
+		} else {
+			result[m] = weighted(score, z.weights[0])
+		}
+	}
+	for i, set := range sets[1:] {
+		w := z.weights[i+1]
+		switch z.op {
+		case "ZUNION":
+			for m, score := range set {
+				if old, ok := result[m]; ok {
+					result[m] = z.combine(old, weighted(score, w))
+				} else {
+					result[m] = weighted(score, w)
+				}
+			}
+		case "ZINTER":
+			for m, old := range result {
+				if score, ok := set[m]; ok {
+					result[m] = z.combine(old, weighted(score, w))
+				} else {
+					delete(result, m)
+				}
+			}
+		case "ZDIFF":
+			for m := range set {
+				delete(result, m)
+			}
+		}
+	}
+
+	members := make([]string, 0, len(result))
+	for m := range result {
+		members = append(members, m)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if result[members[i]] != result[members[j]] {
+			return result[members[i]] < result[members[j]]
+		}
+		return members[i] < members[j]
+	})
+	return members, result
+}
+
+// formatScore 和 Redis 一样输出最短的表示
+func formatScore(f float64) []byte {
+	switch {
+	case math.IsInf(f, 1):
+		return []byte("inf")
+	case math.IsInf(f, -1):
+		return []byte("-inf")
+	}
+	return strconv.AppendFloat(nil, f, 'g', -1, 64)
+}
+
+// ZSetOp 处理跨 slot 的 ZUNION ZINTER ZDIFF 和 ZUNIONSTORE ZINTERSTORE
+// 从各个节点并发读取 ZRANGE key 0 -1 WITHSCORES，set 类型的 key 改用 SMEMBERS，在 proxy 中计算，STORE 命令写到 destination 所在的节点
+func (s *Session) ZSetOp(req *ArrayResp, seq int64) {
+	defer func() {
+		s.conCurrency <- 1
+	}()
+
+	z, err := parseZSetOp(req)
+	if err != nil {
+		s.resps <- WrappedErrorResp([]byte(err.Error()), seq)
+		return
+	}
+	slave := z.dest == nil && s.p.pc.slaveOk
+
+	if max := s.p.pc.maxSetMembers; max > 0 {
+		cards := perKey([]byte("ZCARD"), z.keys)
+		s.scatter(cards, slave)
+		s.retryWrongType(cards, []byte("SCARD"), slave)
+		total, er := sumReplies(cards)
+		if er != nil {
+			s.resps <- WrappedResp(er, seq)
+			return
+		}
+		if total > int64(max) {
+			s.resps <- WrappedErrorResp([]byte(fmt.Sprintf("ERR %s on %d members exceeds maxsetmembers %d", commandOf(req).Name, total, max)), seq)
+			return
+		}
+	}
+
+	subs := perKey([]byte("ZRANGE"), z.keys, []byte("0"), []byte("-1"), WITHSCORES)
+	s.scatter(subs, slave)
+	// 和 Redis 一样输入也可以是 set，用 SMEMBERS 读取，成员分数为 1
+	isSet := s.retryWrongType(subs, []byte("SMEMBERS"), slave)
+	if er := firstError(subs); er != nil {
+		s.resps <- WrappedResp(er, seq)
+		return
+	}
+	sets := make([]map[string]float64, len(subs))
+	for i, sub := range subs {
+		var (
+			set map[string]float64
+			err error
+		)
+		if isSet[i] {
+			set, err = parseSetMembers(sub.resp)
+		} else {
+			set, err = parseScorePairs(sub.resp)
+		}
+		if err != nil {
+			log.Warning("Session ZSetOp wrong ", sub.req.Arg(0), " reply ", sub.resp.String())
+			s.resps <- WrappedErrorResp([]byte("proxy internal "+commandOf(req).Name+" failed"), seq)
+			return
+		}
+		sets[i] = set
+	}
+	members, scores := z.compute(sets)
+
+	if z.dest == nil {
+		ar := NewArrayResp()
+		for _, m := range members {
+			ar.Args = append(ar.Args, NewBulkResp([]byte(m)))
+			if z.withScores {
+				ar.Args = append(ar.Args, NewBulkResp(formatScore(scores[m])))
+			}
+		}
+		s.resps <- WrappedResp(s.resp3Reply(req, ar), seq)
+		return
+	}
+
+	// 用 DEL 和 ZADD 覆盖 destination，在一个事务中执行
+	var zadd *ArrayResp
+	if len(members) > 0 {
+		zadd = NewCommand([]byte("ZADD"), z.dest)
+		for _, m := range members {
+			zadd.Args = append(zadd.Args, NewBulkResp(formatScore(scores[m])), NewBulkResp([]byte(m)))
+		}
+	}
+	if er := s.storeTx(z.dest, zadd); er != nil {
+		s.resps <- WrappedResp(er, seq)
+		return
+	}
+	s.resps <- WrappedResp(NewIntResp(len(members)), seq)
+}
+
+// parseScorePairs 解析 WITHSCORES 的回复 member score member score ...
+func parseScorePairs(resp Resp) (map[string]float64, error) {
+	ar, ok := resp.(*ArrayResp)
+	if !ok || len(ar.Args)%2 != 0 {
+		return nil, errors.New("wrong score pairs")
+	}
+	set := make(map[string]float64, len(ar.Args)/2)
+	for i := 0; i < len(ar.Args); i += 2 {
+		m, ok1 := ar.Args[i].(*BulkResp)
+		sc, ok2 := ar.Args[i+1].(*BulkResp)
+		if !ok1 || !ok2 || len(m.Args) == 0 || len(sc.Args) == 0 {
+			return nil, errors.New("wrong score pairs")
+		}
+		f, err := strconv.ParseFloat(hack.String(sc.Args[0]), 64)
+		if err != nil {
+			return nil, err
+		}
+		set[string(m.Args[0])] = f
+	}
+	return set, nil
+}
+
+// parseSetMembers 解析 SMEMBERS 的回复，每个成员的分数为 1
+func parseSetMembers(resp Resp) (map[string]float64, error) {
+	ar, ok := resp.(*ArrayResp)
+	if !ok {
+		return nil, errors.New("wrong set members")
+	}
+	set := make(map[string]float64, len(ar.Args))
+	for _, r := range ar.Args {
+		m, ok := r.(*BulkResp)
+		if !ok || len(m.Args) == 0 {
+			return nil, errors.New("wrong set members")
+		}
+		set[string(m.Args[0])] = 1
+	}
+	return set, nil
+}